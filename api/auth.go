@@ -0,0 +1,76 @@
+package api
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tectiv3/edrtsp/rtsp"
+)
+
+// READ_AUTH_TTL how long an http reader stays authorized, hls players fetch
+// a playlist or segment every part duration and must not hit on_play each time
+const READ_AUTH_TTL = 10 * time.Second
+
+var (
+	readAuths     = make(map[string]time.Time) // credentials, ip and path <-> expiry
+	readAuthsLock sync.Mutex
+)
+
+// authorizeRead authenticates an http reader of path with Basic credentials
+// and checks it against the acl and on_play like rtsp and rtmp players,
+// aborting with 401 or 403 when it is not allowed
+func authorizeRead(c *gin.Context, id, path string) bool {
+	server := rtsp.GetServer()
+	user, password, _ := c.Request.BasicAuth()
+	host, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
+	cacheKey := fmt.Sprintf("%x|%s|%s", md5.Sum([]byte(user+":"+password)), host, path)
+	now := time.Now()
+	readAuthsLock.Lock()
+	expiry, ok := readAuths[cacheKey]
+	readAuthsLock.Unlock()
+	if ok && now.Before(expiry) {
+		return true
+	}
+
+	err := server.Authenticate(user, password)
+	if err == nil {
+		scheme := "http"
+		if c.Request.TLS != nil {
+			scheme = "https"
+		}
+		err = server.Authorize(&rtsp.HookEvent{
+			Event:      "on_play",
+			ID:         id,
+			Path:       path,
+			URL:        fmt.Sprintf("%s://%s%s", scheme, c.Request.Host, c.Request.RequestURI),
+			RemoteAddr: c.Request.RemoteAddr,
+			User:       user,
+			TransType:  "HTTP",
+		})
+	}
+	if err != nil {
+		if user == "" {
+			// anonymous, credentials may grant it
+			c.Header("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, server.Realm()))
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "Unauthorized")
+		} else {
+			c.AbortWithStatusJSON(http.StatusForbidden, "Forbidden")
+		}
+		return false
+	}
+
+	readAuthsLock.Lock()
+	for k, v := range readAuths {
+		if now.After(v) {
+			delete(readAuths, k)
+		}
+	}
+	readAuths[cacheKey] = now.Add(READ_AUTH_TTL)
+	readAuthsLock.Unlock()
+	return true
+}
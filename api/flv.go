@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/tectiv3/edrtsp/flv"
+	"github.com/tectiv3/edrtsp/rtsp"
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+/**
+ * @api {get} /live/:path.flv
+ * chunked http-flv, or websocket-flv when asked to upgrade
+ */
+func (h *apiHandler) FLV(c *gin.Context) {
+	file := c.Param("file")
+	if !strings.HasSuffix(file, ".flv") {
+		c.AbortWithStatusJSON(http.StatusNotFound, "Not found")
+		return
+	}
+	path := strings.TrimSuffix(file, ".flv")
+	id := flv.NewSinkID()
+	if !authorizeRead(c, id, path) {
+		return
+	}
+	pusher, err := rtsp.GetServer().DemandPusher(path)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadGateway, err.Error())
+		return
+	}
+	if pusher == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, "Stream not found")
+		return
+	}
+	sink := flv.NewSink(pusher)
+	sink.ID = id
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go func() {
+			// reads only to notice the viewer going away
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					sink.Stop()
+					return
+				}
+			}
+		}()
+		sink.Serve(func(hasVideo, hasAudio bool) error {
+			return conn.WriteMessage(websocket.BinaryMessage, flv.Header(hasVideo, hasAudio))
+		}, func(tag *flv.Tag) error {
+			return conn.WriteMessage(websocket.BinaryMessage, tag.Bytes())
+		})
+		return
+	}
+	go func() {
+		select {
+		case <-c.Request.Context().Done():
+			sink.Stop()
+		case <-sink.Done():
+		}
+	}()
+	err = sink.Serve(func(hasVideo, hasAudio bool) error {
+		c.Header("Content-Type", "video/x-flv")
+		c.Header("Cache-Control", "no-cache")
+		c.Status(http.StatusOK)
+		_, err := c.Writer.Write(flv.Header(hasVideo, hasAudio))
+		c.Writer.Flush()
+		return err
+	}, func(tag *flv.Tag) error {
+		_, err := c.Writer.Write(tag.Bytes())
+		c.Writer.Flush()
+		return err
+	})
+	if err != nil && !c.Writer.Written() {
+		c.AbortWithStatusJSON(http.StatusNotFound, err.Error())
+	}
+}
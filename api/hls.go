@@ -0,0 +1,96 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tectiv3/edrtsp/hls"
+	"github.com/tectiv3/edrtsp/rtsp"
+)
+
+/**
+ * @api {get} /hls/:path/index.m3u8
+ * also serves init<id>.mp4, seg<seq>.m4s and part<seq>.<index>.m4s listed in the playlist,
+ * _HLS_msn and _HLS_part block the playlist until that segment or part is muxed
+ */
+func (h *apiHandler) HLS(c *gin.Context) {
+	dir, file := path.Split(c.Param("file"))
+	streamPath := strings.TrimSuffix(dir, "/")
+	if !authorizeRead(c, "", streamPath) {
+		return
+	}
+	stream := hls.GetStream(streamPath)
+	if stream == nil {
+		// muxed as soon as a source pulled on demand is added
+		if _, err := rtsp.GetServer().DemandPusher(streamPath); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadGateway, err.Error())
+			return
+		}
+		stream = hls.GetStream(streamPath)
+	}
+	if stream == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, "Stream not found")
+		return
+	}
+	stream.Touch()
+	switch {
+	case file == "index.m3u8":
+		msn, part := -1, -1
+		if v, err := strconv.Atoi(c.Query("_HLS_msn")); err == nil && v >= 0 {
+			msn = v
+			if v, err := strconv.Atoi(c.Query("_HLS_part")); err == nil && v >= 0 {
+				part = v
+			}
+		} else if c.Query("_HLS_part") != "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "_HLS_part without _HLS_msn")
+			return
+		}
+		playlist, err := stream.Playlist(msn, part)
+		switch err {
+		case nil:
+		case hls.ErrTooFarAhead:
+			c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+			return
+		default:
+			c.AbortWithStatusJSON(http.StatusNotFound, "Stream not ready")
+			return
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(playlist))
+	case strings.HasPrefix(file, "init") && strings.HasSuffix(file, ".mp4"):
+		id, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(file, "init"), ".mp4"))
+		data, ok := stream.InitSection(id)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusNotFound, "Init section not found")
+			return
+		}
+		c.Data(http.StatusOK, "video/mp4", data)
+	case strings.HasPrefix(file, "seg") && strings.HasSuffix(file, ".m4s"):
+		seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(file, "seg"), ".m4s"))
+		data, ok := stream.Segment(seq)
+		if err != nil || !ok {
+			c.AbortWithStatusJSON(http.StatusNotFound, "Segment not found")
+			return
+		}
+		c.Data(http.StatusOK, "video/iso.segment", data)
+	case strings.HasPrefix(file, "part") && strings.HasSuffix(file, ".m4s"):
+		var seq, index int
+		_, err := fmt.Sscanf(file, "part%d.%d.m4s", &seq, &index)
+		var data []byte
+		ok := false
+		if err == nil && seq >= 0 && index >= 0 {
+			data, ok = stream.Part(seq, index)
+		}
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusNotFound, "Part not found")
+			return
+		}
+		c.Data(http.StatusOK, "video/iso.segment", data)
+	default:
+		c.AbortWithStatusJSON(http.StatusNotFound, "Not found")
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tectiv3/edrtsp/record"
+)
+
+type recordRequest struct {
+	Path string `form:"path" json:"path" binding:"required"`
+}
+
+/**
+ * @api {post} /api/v1/record/start
+ */
+func (h *apiHandler) RecordStart(c *gin.Context) {
+	h.recordEnable(c, true)
+}
+
+/**
+ * @api {post} /api/v1/record/stop
+ */
+func (h *apiHandler) RecordStop(c *gin.Context) {
+	h.recordEnable(c, false)
+}
+
+func (h *apiHandler) recordEnable(c *gin.Context, enable bool) {
+	var req recordRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+	if !strings.HasPrefix(req.Path, "/") {
+		req.Path = "/" + req.Path
+	}
+	record.Enable(req.Path, enable)
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"path":      req.Path,
+		"enabled":   enable,
+		"recording": record.Recording(req.Path),
+	})
+}
+
+/**
+ * @api {get} /api/v1/records
+ */
+func (h *apiHandler) Records(c *gin.Context) {
+	files, err := record.Files(c.Query("path"))
+	if err == record.ErrOutsideDir {
+		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, fmt.Sprintf("list records failed, %v", err))
+		return
+	}
+	c.IndentedJSON(http.StatusOK, response{
+		Total: len(files),
+		Rows:  files,
+	})
+}
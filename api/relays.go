@@ -0,0 +1,98 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tectiv3/edrtsp/relay"
+	"github.com/tectiv3/edrtsp/rtsp"
+)
+
+type relayStartRequest struct {
+	Path      string `form:"path" json:"path" binding:"required"`
+	URL       string `form:"url" json:"url" binding:"required,url"`
+	TransType string `form:"transType" json:"transType" binding:"omitempty,eq=TCP|eq=UDP|eq=tcp|eq=udp"`
+}
+
+/**
+ * @api {post} /api/v1/relay/start
+ * push a local path to a remote rtsp server
+ */
+func (h *apiHandler) RelayStart(c *gin.Context) {
+	var req relayStartRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+	if !strings.HasPrefix(req.Path, "/") {
+		req.Path = "/" + req.Path
+	}
+	transType, _ := rtsp.ParseTransType(strings.ToUpper(req.TransType))
+	r, err := relay.Add(req.Path, req.URL, transType)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("start relay failed, %v", err))
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"id":   r.ID,
+		"path": r.Path,
+	})
+}
+
+/**
+ * @api {post} /api/v1/relay/stop
+ */
+func (h *apiHandler) RelayStop(c *gin.Context) {
+	var req stopRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+	if req.ID == "" && req.Path == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "id or path required")
+		return
+	}
+	if req.Path != "" && !strings.HasPrefix(req.Path, "/") {
+		req.Path = "/" + req.Path
+	}
+	stopped := false
+	for _, r := range relay.Relays() {
+		if r.ID == req.ID || r.Path == req.Path {
+			stopped = relay.Remove(r.ID) || stopped
+		}
+	}
+	if !stopped {
+		c.AbortWithStatusJSON(http.StatusNotFound, "relay not found")
+		return
+	}
+	c.JSON(http.StatusOK, "OK")
+}
+
+/**
+ * @api {get} /api/v1/relays
+ */
+func (h *apiHandler) Relays(c *gin.Context) {
+	rows := make([]interface{}, 0)
+	for _, r := range relay.Relays() {
+		status, err := r.Status()
+		row := gin.H{
+			"id":        r.ID,
+			"path":      r.Path,
+			"url":       r.URL,
+			"transType": r.TransType.String(),
+			"status":    status,
+			"outBytes":  r.OutBytes(),
+			"startAt":   r.StartAt,
+		}
+		if err != nil {
+			row["error"] = err.Error()
+		}
+		rows = append(rows, row)
+	}
+	c.IndentedJSON(http.StatusOK, response{
+		Total: len(rows),
+		Rows:  rows,
+	})
+}
@@ -28,6 +28,11 @@ var api = &apiHandler{}
 type request struct {
 }
 
+type stopRequest struct {
+	ID   string `form:"id" json:"id"`
+	Path string `form:"path" json:"path"`
+}
+
 type response struct {
 	Total int         `json:"total"`
 	Rows  interface{} `json:"rows"`
@@ -53,6 +58,27 @@ func GetRouter() *gin.Engine {
 
 	router.GET("/api/v1/pushers", api.Pushers)
 	router.GET("/api/v1/players", api.Players)
+	router.POST("/api/v1/pusher/stop", api.PusherStop)
+	router.POST("/api/v1/player/stop", api.PlayerStop)
+
+	router.POST("/api/v1/stream/start", api.StreamStart)
+	router.POST("/api/v1/stream/stop", api.StreamStop)
+	router.GET("/api/v1/streams", api.Streams)
+
+	router.GET("/api/v1/users", userAPI(), api.Users)
+	router.POST("/api/v1/user/save", userAPI(), api.UserSave)
+	router.POST("/api/v1/user/remove", userAPI(), api.UserRemove)
+
+	router.POST("/api/v1/record/start", api.RecordStart)
+	router.POST("/api/v1/record/stop", api.RecordStop)
+	router.GET("/api/v1/records", api.Records)
+
+	router.POST("/api/v1/relay/start", api.RelayStart)
+	router.POST("/api/v1/relay/stop", api.RelayStop)
+	router.GET("/api/v1/relays", api.Relays)
+
+	router.GET("/hls/*file", api.HLS)
+	router.GET("/live/*file", api.FLV)
 	return router
 }
 
@@ -136,3 +162,62 @@ func (h *apiHandler) Players(c *gin.Context) {
 	}
 	c.IndentedJSON(200, res)
 }
+
+/**
+ * @api {post} /api/v1/pusher/stop
+ */
+func (h *apiHandler) PusherStop(c *gin.Context) {
+	var req stopRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+	var pusher *rtsp.Pusher
+	if req.Path != "" {
+		if !strings.HasPrefix(req.Path, "/") {
+			req.Path = "/" + req.Path
+		}
+		pusher = rtsp.GetServer().GetPusher(req.Path)
+	} else if req.ID != "" {
+		for _, v := range rtsp.GetServer().GetPushers() {
+			if v.ID() == req.ID {
+				pusher = v
+				break
+			}
+		}
+	} else {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "id or path required")
+		return
+	}
+	if pusher == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, "pusher not found")
+		return
+	}
+	log.Printf("stop pusher %v", pusher)
+	pusher.Stop()
+	c.JSON(http.StatusOK, "OK")
+}
+
+/**
+ * @api {post} /api/v1/player/stop
+ */
+func (h *apiHandler) PlayerStop(c *gin.Context) {
+	var req stopRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+	if req.ID == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "id required")
+		return
+	}
+	for _, pusher := range rtsp.GetServer().GetPushers() {
+		if player, ok := pusher.GetPlayers()[req.ID]; ok {
+			log.Printf("stop player %v", player)
+			player.Session.Stop()
+			c.JSON(http.StatusOK, "OK")
+			return
+		}
+	}
+	c.AbortWithStatusJSON(http.StatusNotFound, "player not found")
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tectiv3/edrtsp/pull"
+	"github.com/tectiv3/edrtsp/rtsp"
+	"github.com/tectiv3/edrtsp/store"
+)
+
+type streamStartRequest struct {
+	URL               string   `form:"url" json:"url" binding:"required,url"`
+	BackupURLs        []string `form:"backupURL" json:"backupURLs" binding:"omitempty,dive,url"`
+	CustomPath        string   `form:"customPath" json:"customPath"`
+	TransType         string   `form:"transType" json:"transType" binding:"omitempty,eq=TCP|eq=UDP|eq=MULTICAST|eq=AUTO|eq=tcp|eq=udp|eq=multicast|eq=auto"`
+	IdleTimeout       int      `form:"idleTimeout" json:"idleTimeout" binding:"min=0"`
+	HeartbeatInterval int      `form:"heartbeatInterval" json:"heartbeatInterval" binding:"min=0"`
+	Persist           bool     `form:"persist" json:"persist"`
+	OnDemand          bool     `form:"onDemand" json:"onDemand"`
+}
+
+/**
+ * @api {post} /api/v1/stream/start
+ */
+func (h *apiHandler) StreamStart(c *gin.Context) {
+	var req streamStartRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+	if req.CustomPath != "" && !strings.HasPrefix(req.CustomPath, "/") {
+		req.CustomPath = "/" + req.CustomPath
+	}
+	stream := store.Stream{
+		URL:               req.URL,
+		CustomPath:        req.CustomPath,
+		TransType:         strings.ToUpper(req.TransType),
+		IdleTimeout:       req.IdleTimeout,
+		HeartbeatInterval: req.HeartbeatInterval,
+		OnDemand:          req.OnDemand,
+		BackupURLs:        req.BackupURLs,
+	}
+	puller, err := pull.Add(stream)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("pull stream failed, %v", err))
+		return
+	}
+	// on demand streams are pulled by the first player
+	if !stream.OnDemand {
+		if err := puller.WaitConnected(); err != nil {
+			pull.Remove(puller.ID)
+			c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("pull stream failed, %v", err))
+			return
+		}
+	}
+	if req.Persist {
+		if err := store.SaveStream(stream); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, fmt.Sprintf("save stream failed, %v", err))
+			return
+		}
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"id":   puller.ID,
+		"path": puller.Path(),
+	})
+}
+
+/**
+ * @api {post} /api/v1/stream/stop
+ */
+func (h *apiHandler) StreamStop(c *gin.Context) {
+	var req stopRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+	if req.ID == "" && req.Path == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "id or path required")
+		return
+	}
+	if req.Path != "" && !strings.HasPrefix(req.Path, "/") {
+		req.Path = "/" + req.Path
+	}
+	var puller *pull.Puller
+	for _, v := range pull.Pullers() {
+		if v.ID == req.ID || v.Path() == req.Path {
+			puller = v
+			break
+		}
+	}
+	// client pushers not supervised, like relays of other servers
+	var pusher *rtsp.Pusher
+	if puller == nil {
+		for _, v := range rtsp.GetServer().GetPushers() {
+			if v.RTSPClient != nil && (v.ID() == req.ID || v.Path() == req.Path) {
+				pusher = v
+				break
+			}
+		}
+	}
+	path := req.Path
+	if puller != nil {
+		path = puller.Path()
+	} else if pusher != nil {
+		path = pusher.Path()
+	}
+	persisted := false
+	for _, v := range store.Streams() {
+		if v.Path() == path {
+			persisted = true
+			if err := store.DeleteStream(v.URL); err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, fmt.Sprintf("delete stream failed, %v", err))
+				return
+			}
+		}
+	}
+	if puller == nil && pusher == nil && !persisted {
+		c.AbortWithStatusJSON(http.StatusNotFound, "stream not found")
+		return
+	}
+	if puller != nil {
+		pull.Remove(puller.ID)
+	}
+	if pusher != nil {
+		pusher.Stop()
+	}
+	c.JSON(http.StatusOK, "OK")
+}
+
+/**
+ * @api {get} /api/v1/streams
+ */
+func (h *apiHandler) Streams(c *gin.Context) {
+	rows := make([]interface{}, 0)
+	pullers := make(map[string]*pull.Puller)
+	for _, v := range pull.Pullers() {
+		pullers[v.Path()] = v
+	}
+	for _, v := range store.Streams() {
+		row := gin.H{
+			"url":               v.URL,
+			"backupURLs":        v.BackupURLs,
+			"path":              v.Path(),
+			"customPath":        v.CustomPath,
+			"transType":         v.TransType,
+			"idleTimeout":       v.IdleTimeout,
+			"heartbeatInterval": v.HeartbeatInterval,
+			"persist":           true,
+			"onDemand":          v.OnDemand,
+			"online":            false,
+		}
+		if puller, ok := pullers[v.Path()]; ok {
+			pullerRow(row, puller)
+			delete(pullers, v.Path())
+		}
+		rows = append(rows, row)
+	}
+	for _, puller := range pull.Pullers() {
+		if _, ok := pullers[puller.Path()]; !ok {
+			continue
+		}
+		v := puller.Stream
+		row := gin.H{
+			"url":               v.URL,
+			"backupURLs":        v.BackupURLs,
+			"path":              v.Path(),
+			"customPath":        v.CustomPath,
+			"transType":         v.TransType,
+			"idleTimeout":       v.IdleTimeout,
+			"heartbeatInterval": v.HeartbeatInterval,
+			"persist":           false,
+			"onDemand":          v.OnDemand,
+			"online":            false,
+		}
+		pullerRow(row, puller)
+		rows = append(rows, row)
+	}
+	c.IndentedJSON(http.StatusOK, response{
+		Total: len(rows),
+		Rows:  rows,
+	})
+}
+
+// pullerRow adds the supervisor state of puller to a streams row
+func pullerRow(row gin.H, puller *pull.Puller) {
+	state, err, retries, nextRetry := puller.Status()
+	row["id"] = puller.ID
+	row["sourceURL"] = puller.SourceURL()
+	row["state"] = state
+	row["retries"] = retries
+	if err != nil {
+		row["lastError"] = err.Error()
+	}
+	if state == pull.STATE_RETRYING {
+		row["nextRetry"] = nextRetry
+	}
+	if pusher := puller.Pusher(); pusher != nil {
+		// the transport in use, auto ends up with udp or tcp
+		row["activeTransType"] = pusher.TransType()
+		row["online"] = state == pull.STATE_PLAYING
+		row["players"] = len(pusher.GetPlayers())
+	}
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tectiv3/edrtsp/rtsp"
+	"github.com/tectiv3/edrtsp/store"
+	"github.com/tectiv3/edrtsp/utils"
+)
+
+type userRequest struct {
+	Username string `form:"username" json:"username" binding:"required,excludes=:"`
+	Password string `form:"password" json:"password"`
+}
+
+// userAPI guards the user endpoints, which create rtsp credentials. They are
+// off unless [http] user_api_enable is set and take the Basic credentials of
+// user_api_user and user_api_password.
+func userAPI() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		section := utils.Conf().Section("http")
+		if !section.Key("user_api_enable").MustBool(false) {
+			c.AbortWithStatusJSON(http.StatusForbidden, "User api disabled")
+			return
+		}
+		wantUser, wantPassword := section.Key("user_api_user").String(), section.Key("user_api_password").String()
+		user, password, _ := c.Request.BasicAuth()
+		if wantUser == "" || wantPassword == "" ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(wantUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(wantPassword)) != 1 {
+			c.Header("WWW-Authenticate", `Basic realm="edrtsp user api"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		c.Next()
+	}
+}
+
+/**
+ * @api {get} /api/v1/users
+ */
+func (h *apiHandler) Users(c *gin.Context) {
+	users := store.Users()
+	c.IndentedJSON(http.StatusOK, response{
+		Total: len(users),
+		Rows:  users,
+	})
+}
+
+/**
+ * @api {post} /api/v1/user/save
+ */
+func (h *apiHandler) UserSave(c *gin.Context) {
+	var req userRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+	if req.Password == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Password required")
+		return
+	}
+	if err := store.SaveUser(req.Username, rtsp.GetServer().Realm(), req.Password); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, fmt.Sprintf("save user failed, %v", err))
+		return
+	}
+	c.JSON(http.StatusOK, "OK")
+}
+
+/**
+ * @api {post} /api/v1/user/remove
+ */
+func (h *apiHandler) UserRemove(c *gin.Context) {
+	var req userRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.Error(err).SetType(gin.ErrorTypeBind)
+		return
+	}
+	removed, err := store.DeleteUser(req.Username, rtsp.GetServer().Realm())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, fmt.Sprintf("remove user failed, %v", err))
+		return
+	}
+	if !removed {
+		c.AbortWithStatusJSON(http.StatusNotFound, "user not found")
+		return
+	}
+	c.JSON(http.StatusOK, "OK")
+}
@@ -0,0 +1,80 @@
+package codec
+
+import "fmt"
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// AACConfig AudioSpecificConfig of MPEG-4 audio
+type AACConfig struct {
+	ObjectType      int
+	SampleRateIndex int
+	SampleRate      int
+	Channels        int
+}
+
+func ParseAACConfig(data []byte) (config *AACConfig, err error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("aac config too short")
+	}
+	r := NewBitReader(data)
+	config = &AACConfig{}
+	objectType, _ := r.ReadBits(5)
+	if objectType == 31 {
+		ext, _ := r.ReadBits(6)
+		objectType = 32 + ext
+	}
+	config.ObjectType = int(objectType)
+	index, _ := r.ReadBits(4)
+	config.SampleRateIndex = int(index)
+	if index == 0x0f {
+		rate, err := r.ReadBits(24)
+		if err != nil {
+			return nil, err
+		}
+		config.SampleRate = int(rate)
+	} else if int(index) < len(aacSampleRates) {
+		config.SampleRate = aacSampleRates[index]
+	} else {
+		return nil, fmt.Errorf("aac sample rate index %d invalid", index)
+	}
+	channels, err := r.ReadBits(4)
+	config.Channels = int(channels)
+	return
+}
+
+// Bytes encodes the config as a 2 bytes AudioSpecificConfig
+func (config *AACConfig) Bytes() []byte {
+	return []byte{
+		byte(config.ObjectType<<3) | byte(config.SampleRateIndex>>1),
+		byte(config.SampleRateIndex<<7) | byte(config.Channels<<3),
+	}
+}
+
+// ADTSHeader builds the 7 bytes header of a raw aac frame in mpeg-ts
+func (config *AACConfig) ADTSHeader(frameLen int) []byte {
+	size := frameLen + 7
+	profile := config.ObjectType - 1
+	if profile < 0 || profile > 3 {
+		profile = 1
+	}
+	return []byte{
+		0xff,
+		0xf1,
+		byte(profile<<6) | byte(config.SampleRateIndex<<2) | byte(config.Channels>>2),
+		byte(config.Channels&3<<6) | byte(size>>11),
+		byte(size >> 3),
+		byte(size&7<<5) | 0x1f,
+		0xfc,
+	}
+}
+
+// NewAACConfig makes an AAC-LC config
+func NewAACConfig(sampleRate, channels int) *AACConfig {
+	config := &AACConfig{ObjectType: 2, SampleRate: sampleRate, Channels: channels, SampleRateIndex: 0x0f}
+	for i, v := range aacSampleRates {
+		if v == sampleRate {
+			config.SampleRateIndex = i
+		}
+	}
+	return config
+}
@@ -0,0 +1,89 @@
+package codec
+
+import "fmt"
+
+// BitReader reads big-endian bits and exp-golomb codes
+type BitReader struct {
+	buf []byte
+	pos int
+}
+
+func NewBitReader(buf []byte) *BitReader {
+	return &BitReader{buf: buf}
+}
+
+func (r *BitReader) ReadBit() (uint, error) {
+	if r.pos >= len(r.buf)*8 {
+		return 0, fmt.Errorf("bit reader out of range")
+	}
+	bit := uint(r.buf[r.pos/8]>>(7-uint(r.pos%8))) & 1
+	r.pos++
+	return bit, nil
+}
+
+func (r *BitReader) ReadBits(n int) (v uint, err error) {
+	for i := 0; i < n; i++ {
+		var bit uint
+		if bit, err = r.ReadBit(); err != nil {
+			return
+		}
+		v = v<<1 | bit
+	}
+	return
+}
+
+func (r *BitReader) Skip(n int) error {
+	if r.pos+n > len(r.buf)*8 {
+		return fmt.Errorf("bit reader out of range")
+	}
+	r.pos += n
+	return nil
+}
+
+// ReadUE reads unsigned exp-golomb code
+func (r *BitReader) ReadUE() (uint, error) {
+	zeros := 0
+	for {
+		bit, err := r.ReadBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, fmt.Errorf("exp-golomb code too long")
+		}
+	}
+	v, err := r.ReadBits(zeros)
+	return (1<<uint(zeros) - 1) + v, err
+}
+
+// ReadSE reads signed exp-golomb code
+func (r *BitReader) ReadSE() (int, error) {
+	v, err := r.ReadUE()
+	if v%2 == 0 {
+		return -int(v / 2), err
+	}
+	return int(v+1) / 2, err
+}
+
+// RemoveEmulationPrevention strips 0x03 of 0x000003 sequences in a NAL unit
+func RemoveEmulationPrevention(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
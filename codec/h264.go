@@ -0,0 +1,245 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	H264_NAL_SLICE = 1
+	H264_NAL_IDR   = 5
+	H264_NAL_SEI   = 6
+	H264_NAL_SPS   = 7
+	H264_NAL_PPS   = 8
+	H264_NAL_AUD   = 9
+)
+
+func H264NALType(nalu []byte) int {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return int(nalu[0] & 0x1f)
+}
+
+// H264SPS fields of a sequence parameter set needed by muxers
+type H264SPS struct {
+	ProfileIdc    uint
+	ConstraintSet uint
+	LevelIdc      uint
+	ChromaFormat  uint
+	Width         int
+	Height        int
+}
+
+func ParseH264SPS(nalu []byte) (sps *H264SPS, err error) {
+	if len(nalu) < 4 {
+		return nil, fmt.Errorf("h264 sps too short")
+	}
+	r := NewBitReader(RemoveEmulationPrevention(nalu[1:]))
+	sps = &H264SPS{ChromaFormat: 1}
+	if sps.ProfileIdc, err = r.ReadBits(8); err != nil {
+		return
+	}
+	if sps.ConstraintSet, err = r.ReadBits(8); err != nil {
+		return
+	}
+	if sps.LevelIdc, err = r.ReadBits(8); err != nil {
+		return
+	}
+	if _, err = r.ReadUE(); err != nil { // seq_parameter_set_id
+		return
+	}
+	switch sps.ProfileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if sps.ChromaFormat, err = r.ReadUE(); err != nil {
+			return
+		}
+		if sps.ChromaFormat == 3 {
+			r.Skip(1) // separate_colour_plane_flag
+		}
+		r.ReadUE() // bit_depth_luma_minus8
+		r.ReadUE() // bit_depth_chroma_minus8
+		r.Skip(1)  // qpprime_y_zero_transform_bypass_flag
+		var scalingMatrix uint
+		if scalingMatrix, err = r.ReadBit(); err != nil {
+			return
+		}
+		if scalingMatrix == 1 {
+			lists := 8
+			if sps.ChromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				present, _ := r.ReadBit()
+				if present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						delta, _ := r.ReadSE()
+						next = (last + delta + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.ReadUE() // log2_max_frame_num_minus4
+	pocType, _ := r.ReadUE()
+	switch pocType {
+	case 0:
+		r.ReadUE() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.Skip(1) // delta_pic_order_always_zero_flag
+		r.ReadSE()
+		r.ReadSE()
+		cycle, _ := r.ReadUE()
+		for i := uint(0); i < cycle; i++ {
+			r.ReadSE()
+		}
+	}
+	r.ReadUE() // max_num_ref_frames
+	r.Skip(1)  // gaps_in_frame_num_value_allowed_flag
+	widthMbs, _ := r.ReadUE()
+	heightMapUnits, _ := r.ReadUE()
+	frameMbsOnly, _ := r.ReadBit()
+	if frameMbsOnly == 0 {
+		r.Skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.Skip(1) // direct_8x8_inference_flag
+	cropping, err := r.ReadBit()
+	if err != nil {
+		return
+	}
+	var cropLeft, cropRight, cropTop, cropBottom uint
+	if cropping == 1 {
+		cropLeft, _ = r.ReadUE()
+		cropRight, _ = r.ReadUE()
+		cropTop, _ = r.ReadUE()
+		cropBottom, err = r.ReadUE()
+		if err != nil {
+			return
+		}
+	}
+	cropUnitX, cropUnitY := uint(1), 2-frameMbsOnly
+	switch sps.ChromaFormat {
+	case 1:
+		cropUnitX, cropUnitY = 2, 2*(2-frameMbsOnly)
+	case 2:
+		cropUnitX, cropUnitY = 2, 2-frameMbsOnly
+	}
+	sps.Width = int((widthMbs+1)*16 - cropUnitX*(cropLeft+cropRight))
+	sps.Height = int((2-frameMbsOnly)*(heightMapUnits+1)*16 - cropUnitY*(cropTop+cropBottom))
+	return
+}
+
+// AVCDecoderConfigurationRecord builds avcC box payload, also the AVC sequence header of flv
+func AVCDecoderConfigurationRecord(sps, pps []byte) ([]byte, error) {
+	if len(sps) < 4 {
+		return nil, fmt.Errorf("h264 sps too short")
+	}
+	buf := bytes.Buffer{}
+	buf.Write([]byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1})
+	binary.Write(&buf, binary.BigEndian, uint16(len(sps)))
+	buf.Write(sps)
+	buf.WriteByte(1)
+	binary.Write(&buf, binary.BigEndian, uint16(len(pps)))
+	buf.Write(pps)
+	return buf.Bytes(), nil
+}
+
+// AVCC joins NAL units with 4 bytes length prefix
+func AVCC(nalus [][]byte) []byte {
+	size := 0
+	for _, nalu := range nalus {
+		size += 4 + len(nalu)
+	}
+	buf := make([]byte, 0, size)
+	for _, nalu := range nalus {
+		buf = append(buf, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+		buf = append(buf, nalu...)
+	}
+	return buf
+}
+
+// AnnexB joins NAL units with start codes
+func AnnexB(nalus [][]byte) []byte {
+	buf := make([]byte, 0)
+	for _, nalu := range nalus {
+		buf = append(buf, 0, 0, 0, 1)
+		buf = append(buf, nalu...)
+	}
+	return buf
+}
+
+// SplitAVCC splits 4 bytes length prefixed NAL units
+func SplitAVCC(data []byte) (nalus [][]byte, err error) {
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("avcc nalu length truncated")
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if size > len(data) {
+			return nil, fmt.Errorf("avcc nalu size %d exceeds %d", size, len(data))
+		}
+		nalus = append(nalus, data[:size])
+		data = data[size:]
+	}
+	return
+}
+
+// ParseAVCDecoderConfigurationRecord gets sps and pps of an avcC record
+func ParseAVCDecoderConfigurationRecord(data []byte) (sps, pps []byte, err error) {
+	if len(data) < 8 {
+		return nil, nil, fmt.Errorf("avcC too short")
+	}
+	off := 5
+	numSPS := int(data[off] & 0x1f)
+	off++
+	for i := 0; i < numSPS; i++ {
+		if off+2 > len(data) {
+			return nil, nil, fmt.Errorf("avcC truncated")
+		}
+		size := int(binary.BigEndian.Uint16(data[off:]))
+		off += 2
+		if off+size > len(data) {
+			return nil, nil, fmt.Errorf("avcC truncated")
+		}
+		if sps == nil {
+			sps = data[off : off+size]
+		}
+		off += size
+	}
+	if off >= len(data) {
+		return nil, nil, fmt.Errorf("avcC truncated")
+	}
+	numPPS := int(data[off])
+	off++
+	for i := 0; i < numPPS; i++ {
+		if off+2 > len(data) {
+			return nil, nil, fmt.Errorf("avcC truncated")
+		}
+		size := int(binary.BigEndian.Uint16(data[off:]))
+		off += 2
+		if off+size > len(data) {
+			return nil, nil, fmt.Errorf("avcC truncated")
+		}
+		if pps == nil {
+			pps = data[off : off+size]
+		}
+		off += size
+	}
+	if sps == nil || pps == nil {
+		err = fmt.Errorf("avcC without sps or pps")
+	}
+	return
+}
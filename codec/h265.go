@@ -0,0 +1,183 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	H265_NAL_IDR_W_RADL = 19
+	H265_NAL_IDR_N_LP   = 20
+	H265_NAL_CRA        = 21
+	H265_NAL_VPS        = 32
+	H265_NAL_SPS        = 33
+	H265_NAL_PPS        = 34
+	H265_NAL_AUD        = 35
+	H265_NAL_SEI_PREFIX = 39
+	H265_NAL_AP         = 48
+	H265_NAL_FU         = 49
+)
+
+func H265NALType(nalu []byte) int {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return int(nalu[0]>>1) & 0x3f
+}
+
+// H265IsKeyFrame reports IRAP pictures
+func H265IsKeyFrame(nalType int) bool {
+	return nalType >= 16 && nalType <= 21
+}
+
+// H265SPS fields of a sequence parameter set needed by muxers
+type H265SPS struct {
+	MaxSubLayersMinus1   uint
+	TemporalIDNesting    uint
+	ProfileTierLevel     []byte // general profile space .. general level idc, 12 bytes
+	ChromaFormat         uint
+	BitDepthLumaMinus8   uint
+	BitDepthChromaMinus8 uint
+	Width                int
+	Height               int
+}
+
+func ParseH265SPS(nalu []byte) (sps *H265SPS, err error) {
+	rbsp := RemoveEmulationPrevention(nalu)
+	if len(rbsp) < 15 {
+		return nil, fmt.Errorf("h265 sps too short")
+	}
+	sps = &H265SPS{}
+	r := NewBitReader(rbsp[2:])
+	r.Skip(4) // sps_video_parameter_set_id
+	if sps.MaxSubLayersMinus1, err = r.ReadBits(3); err != nil {
+		return
+	}
+	if sps.TemporalIDNesting, err = r.ReadBits(1); err != nil {
+		return
+	}
+	sps.ProfileTierLevel = rbsp[3:15]
+	r.Skip(96)
+	subLayerProfilePresent := make([]uint, sps.MaxSubLayersMinus1)
+	subLayerLevelPresent := make([]uint, sps.MaxSubLayersMinus1)
+	for i := uint(0); i < sps.MaxSubLayersMinus1; i++ {
+		subLayerProfilePresent[i], _ = r.ReadBit()
+		subLayerLevelPresent[i], _ = r.ReadBit()
+	}
+	if sps.MaxSubLayersMinus1 > 0 {
+		for i := sps.MaxSubLayersMinus1; i < 8; i++ {
+			r.Skip(2)
+		}
+	}
+	for i := uint(0); i < sps.MaxSubLayersMinus1; i++ {
+		if subLayerProfilePresent[i] == 1 {
+			r.Skip(88)
+		}
+		if subLayerLevelPresent[i] == 1 {
+			r.Skip(8)
+		}
+	}
+	r.ReadUE() // sps_seq_parameter_set_id
+	if sps.ChromaFormat, err = r.ReadUE(); err != nil {
+		return
+	}
+	if sps.ChromaFormat == 3 {
+		r.Skip(1) // separate_colour_plane_flag
+	}
+	width, _ := r.ReadUE()
+	height, _ := r.ReadUE()
+	conformance, err := r.ReadBit()
+	if err != nil {
+		return
+	}
+	var left, right, top, bottom uint
+	if conformance == 1 {
+		left, _ = r.ReadUE()
+		right, _ = r.ReadUE()
+		top, _ = r.ReadUE()
+		bottom, _ = r.ReadUE()
+	}
+	if sps.BitDepthLumaMinus8, err = r.ReadUE(); err != nil {
+		return
+	}
+	if sps.BitDepthChromaMinus8, err = r.ReadUE(); err != nil {
+		return
+	}
+	subWidth, subHeight := uint(1), uint(1)
+	switch sps.ChromaFormat {
+	case 1:
+		subWidth, subHeight = 2, 2
+	case 2:
+		subWidth = 2
+	}
+	sps.Width = int(width - subWidth*(left+right))
+	sps.Height = int(height - subHeight*(top+bottom))
+	return
+}
+
+// HEVCDecoderConfigurationRecord builds hvcC box payload, also the HEVC sequence header of flv
+func HEVCDecoderConfigurationRecord(vps, sps, pps []byte) ([]byte, error) {
+	info, err := ParseH265SPS(sps)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.Buffer{}
+	buf.WriteByte(1)
+	buf.Write(info.ProfileTierLevel)
+	buf.Write([]byte{0xf0, 0x00, 0xfc})
+	buf.WriteByte(0xfc | byte(info.ChromaFormat))
+	buf.WriteByte(0xf8 | byte(info.BitDepthLumaMinus8))
+	buf.WriteByte(0xf8 | byte(info.BitDepthChromaMinus8))
+	buf.Write([]byte{0, 0})
+	buf.WriteByte(byte(info.MaxSubLayersMinus1+1)<<3 | byte(info.TemporalIDNesting)<<2 | 3)
+	buf.WriteByte(3)
+	for _, nalu := range [][]byte{vps, sps, pps} {
+		buf.WriteByte(0x80 | byte(H265NALType(nalu)))
+		binary.Write(&buf, binary.BigEndian, uint16(1))
+		binary.Write(&buf, binary.BigEndian, uint16(len(nalu)))
+		buf.Write(nalu)
+	}
+	return buf.Bytes(), nil
+}
+
+// ParseHEVCDecoderConfigurationRecord gets vps, sps and pps of a hvcC record
+func ParseHEVCDecoderConfigurationRecord(data []byte) (vps, sps, pps []byte, err error) {
+	if len(data) < 23 {
+		return nil, nil, nil, fmt.Errorf("hvcC too short")
+	}
+	off := 23
+	arrays := int(data[22])
+	for i := 0; i < arrays; i++ {
+		if off+3 > len(data) {
+			return nil, nil, nil, fmt.Errorf("hvcC truncated")
+		}
+		nalType := int(data[off] & 0x3f)
+		count := int(binary.BigEndian.Uint16(data[off+1:]))
+		off += 3
+		for j := 0; j < count; j++ {
+			if off+2 > len(data) {
+				return nil, nil, nil, fmt.Errorf("hvcC truncated")
+			}
+			size := int(binary.BigEndian.Uint16(data[off:]))
+			off += 2
+			if off+size > len(data) {
+				return nil, nil, nil, fmt.Errorf("hvcC truncated")
+			}
+			nalu := data[off : off+size]
+			off += size
+			switch {
+			case nalType == H265_NAL_VPS && vps == nil:
+				vps = nalu
+			case nalType == H265_NAL_SPS && sps == nil:
+				sps = nalu
+			case nalType == H265_NAL_PPS && pps == nil:
+				pps = nalu
+			}
+		}
+	}
+	if vps == nil || sps == nil || pps == nil {
+		err = fmt.Errorf("hvcC without vps, sps or pps")
+	}
+	return
+}
@@ -0,0 +1,77 @@
+package flv
+
+import "encoding/binary"
+
+const (
+	TAG_TYPE_AUDIO  = 8
+	TAG_TYPE_VIDEO  = 9
+	TAG_TYPE_SCRIPT = 18
+)
+
+const (
+	VIDEO_CODEC_AVC = 7
+	// VIDEO_CODEC_HEVC the id commonly used by flv.js forks and media servers
+	VIDEO_CODEC_HEVC = 12
+	SOUND_FORMAT_AAC = 10
+)
+
+const (
+	// AVCPacketType and AACPacketType
+	PACKET_TYPE_SEQUENCE_HEADER = 0
+	PACKET_TYPE_NALU            = 1
+	PACKET_TYPE_RAW             = 1
+)
+
+// Tag an flv tag, Data is the tag body, an rtmp message payload as well
+type Tag struct {
+	Type      uint8
+	Timestamp uint32 // milliseconds
+	Data      []byte
+}
+
+// Header returns the flv file header and the first PreviousTagSize
+func Header(hasVideo, hasAudio bool) []byte {
+	var flags byte
+	if hasAudio {
+		flags |= 0x04
+	}
+	if hasVideo {
+		flags |= 0x01
+	}
+	return []byte{'F', 'L', 'V', 1, flags, 0, 0, 0, 9, 0, 0, 0, 0}
+}
+
+// Bytes returns the tag with its header and PreviousTagSize
+func (tag *Tag) Bytes() []byte {
+	size := len(tag.Data)
+	b := make([]byte, 11+size+4)
+	b[0] = tag.Type
+	b[1], b[2], b[3] = byte(size>>16), byte(size>>8), byte(size)
+	b[4], b[5], b[6] = byte(tag.Timestamp>>16), byte(tag.Timestamp>>8), byte(tag.Timestamp)
+	b[7] = byte(tag.Timestamp >> 24)
+	copy(b[11:], tag.Data)
+	binary.BigEndian.PutUint32(b[11+size:], uint32(11+size))
+	return b
+}
+
+// VideoData builds a video tag body, payload is a decoder configuration record or AVCC NAL units
+func VideoData(codecID uint8, keyFrame bool, packetType uint8, cts int32, payload []byte) []byte {
+	frameType := byte(2)
+	if keyFrame {
+		frameType = 1
+	}
+	b := make([]byte, 5, 5+len(payload))
+	b[0] = frameType<<4 | codecID&0x0f
+	b[1] = packetType
+	b[2], b[3], b[4] = byte(cts>>16), byte(cts>>8), byte(cts)
+	return append(b, payload...)
+}
+
+// AudioData builds an aac audio tag body, payload is an AudioSpecificConfig or a raw frame
+func AudioData(packetType uint8, payload []byte) []byte {
+	// aac is always signalled as 44kHz 16bit stereo, the real format is in the config
+	b := make([]byte, 2, 2+len(payload))
+	b[0] = SOUND_FORMAT_AAC<<4 | 0x0f
+	b[1] = packetType
+	return append(b, payload...)
+}
@@ -0,0 +1,115 @@
+package flv
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/tectiv3/edrtsp/codec"
+	"github.com/tectiv3/edrtsp/rtsp"
+)
+
+// Muxer turns a pusher's rtp packets into flv tags. The first tags are the
+// sequence headers and a keyframe, audio before it is dropped. Sequence
+// headers are sent again when the parameter sets change.
+type Muxer struct {
+	depacketizer *rtsp.Depacketizer
+	started      bool
+	base         time.Duration
+	vps          []byte
+	sps          []byte
+	pps          []byte
+	aacSent      bool
+}
+
+func NewMuxer(sdpRaw string) *Muxer {
+	return &Muxer{depacketizer: rtsp.NewDepacketizer(sdpRaw)}
+}
+
+func (m *Muxer) HasVideo() bool {
+	v := m.depacketizer.VCodec
+	return v == "h264" || v == "h265"
+}
+
+func (m *Muxer) HasAudio() bool {
+	return m.depacketizer.ACodec == "aac" && m.depacketizer.AACConfig != nil
+}
+
+// Feed depacketizes pack, returns tags of the frames it completes
+func (m *Muxer) Feed(pack *rtsp.RTPPack) (tags []*Tag) {
+	d := m.depacketizer
+	for _, frame := range d.Decode(pack) {
+		if !d.Ready() {
+			continue
+		}
+		isVideo := frame.Type == rtsp.RTP_TYPE_VIDEO
+		if !m.started {
+			if isVideo && !frame.KeyFrame || !isVideo && m.HasVideo() {
+				continue
+			}
+			m.started = true
+			m.base = frame.PTS
+		}
+		ts := uint32(0)
+		if frame.PTS > m.base {
+			ts = uint32((frame.PTS - m.base) / time.Millisecond)
+		}
+		if isVideo {
+			tags = append(tags, m.videoTags(frame, ts)...)
+		} else {
+			tags = append(tags, m.audioTags(frame, ts)...)
+		}
+	}
+	return
+}
+
+func (m *Muxer) videoTags(frame *rtsp.Frame, ts uint32) (tags []*Tag) {
+	d := m.depacketizer
+	codecID := uint8(VIDEO_CODEC_AVC)
+	if d.VCodec == "h265" {
+		codecID = VIDEO_CODEC_HEVC
+	}
+	if !bytes.Equal(m.sps, d.SPS) || !bytes.Equal(m.pps, d.PPS) || !bytes.Equal(m.vps, d.VPS) {
+		var config []byte
+		var err error
+		if d.VCodec == "h265" {
+			config, err = codec.HEVCDecoderConfigurationRecord(d.VPS, d.SPS, d.PPS)
+		} else {
+			config, err = codec.AVCDecoderConfigurationRecord(d.SPS, d.PPS)
+		}
+		if err != nil {
+			return
+		}
+		m.vps, m.sps, m.pps = d.VPS, d.SPS, d.PPS
+		tags = append(tags, &Tag{
+			Type:      TAG_TYPE_VIDEO,
+			Timestamp: ts,
+			Data:      VideoData(codecID, true, PACKET_TYPE_SEQUENCE_HEADER, 0, config),
+		})
+	}
+	tags = append(tags, &Tag{
+		Type:      TAG_TYPE_VIDEO,
+		Timestamp: ts,
+		Data:      VideoData(codecID, frame.KeyFrame, PACKET_TYPE_NALU, 0, codec.AVCC(frame.NALUs)),
+	})
+	return
+}
+
+func (m *Muxer) audioTags(frame *rtsp.Frame, ts uint32) (tags []*Tag) {
+	if !m.HasAudio() {
+		return
+	}
+	if !m.aacSent {
+		m.aacSent = true
+		tags = append(tags, &Tag{
+			Type:      TAG_TYPE_AUDIO,
+			Timestamp: ts,
+			Data:      AudioData(PACKET_TYPE_SEQUENCE_HEADER, m.depacketizer.AACConfig.Bytes()),
+		})
+	}
+	tags = append(tags, &Tag{
+		Type:      TAG_TYPE_AUDIO,
+		Timestamp: ts,
+		Data:      AudioData(PACKET_TYPE_RAW, frame.Data),
+	})
+	return
+}
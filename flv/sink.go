@@ -0,0 +1,94 @@
+package flv
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tectiv3/edrtsp/rtsp"
+)
+
+var sinkSeq uint64
+
+// Sink a pusher sink feeding one flv viewer. Attached with Pusher.AddSink it
+// gets the GOP cache first, so playback starts on a keyframe.
+type Sink struct {
+	ID       string
+	Player   *rtsp.Player // attached as this player instead of a sink when set
+	pusher   *rtsp.Pusher
+	queue    chan *rtsp.RTPPack
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewSinkID gets a new id for a flv sink
+func NewSinkID() string {
+	return fmt.Sprintf("flv-%d", atomic.AddUint64(&sinkSeq, 1))
+}
+
+func NewSink(pusher *rtsp.Pusher) *Sink {
+	return &Sink{
+		ID:     NewSinkID(),
+		pusher: pusher,
+		queue:  make(chan *rtsp.RTPPack, 2048),
+		quit:   make(chan struct{}),
+	}
+}
+
+// QueueRTP queues pack, a viewer too slow to keep up is stopped since
+// dropping packets would corrupt the stream
+func (s *Sink) QueueRTP(pack *rtsp.RTPPack) {
+	select {
+	case s.queue <- pack:
+	default:
+		s.Stop()
+	}
+}
+
+func (s *Sink) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.quit)
+	})
+}
+
+// Done is closed when the sink is stopped
+func (s *Sink) Done() <-chan struct{} {
+	return s.quit
+}
+
+// Serve attaches to the pusher and writes the flv header then tags until the
+// sink is stopped, the source changes or a write fails
+func (s *Sink) Serve(writeHeader func(hasVideo, hasAudio bool) error, writeTag func(tag *Tag) error) (err error) {
+	sdpRaw := s.pusher.SDPRaw()
+	muxer := NewMuxer(sdpRaw)
+	if !muxer.HasVideo() && !muxer.HasAudio() {
+		return fmt.Errorf("no flv codec in %s", s.pusher.Path())
+	}
+	if err = writeHeader(muxer.HasVideo(), muxer.HasAudio()); err != nil {
+		return
+	}
+	if s.Player != nil {
+		s.pusher.AddPlayer(s.Player)
+		defer s.pusher.RemovePlayer(s.Player)
+	} else {
+		if !s.pusher.AddSink(s.ID, s) {
+			return fmt.Errorf("sink %s exists", s.ID)
+		}
+		defer s.pusher.RemoveSink(s.ID)
+	}
+	for {
+		select {
+		case pack := <-s.queue:
+			if s.pusher.SDPRaw() != sdpRaw {
+				return fmt.Errorf("source of %s changed", s.pusher.Path())
+			}
+			for _, tag := range muxer.Feed(pack) {
+				if err = writeTag(tag); err != nil {
+					return
+				}
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
@@ -6,6 +6,8 @@ require (
 	github.com/gin-contrib/cors v1.3.0
 	github.com/gin-contrib/pprof v1.2.0
 	github.com/gin-gonic/gin v1.4.0
+	github.com/go-ini/ini v1.46.0
+	github.com/gorilla/websocket v1.4.1
 	github.com/pixelbender/go-sdp v0.0.0-20190116125447-0a02a4c349b5
 	github.com/shirou/gopsutil v2.18.12+incompatible
 	gopkg.in/go-playground/validator.v8 v8.18.2
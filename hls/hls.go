@@ -0,0 +1,64 @@
+package hls
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/tectiv3/edrtsp/rtsp"
+	"github.com/tectiv3/edrtsp/utils"
+)
+
+// SinkID id of hls streams among pusher sinks
+const SinkID = "hls"
+
+var (
+	streams     = make(map[string]*Stream) // Path <-> Stream
+	streamsLock sync.RWMutex
+)
+
+// key gets key from [hls] config section
+func key(name string) *ini.Key {
+	return utils.Conf().Section("hls").Key(name)
+}
+
+// Start muxes every pusher added from now on into hls
+func Start(server *rtsp.Server) {
+	if !key("enable").MustBool(true) {
+		return
+	}
+	server.AddPusherHandles = append(server.AddPusherHandles, attach)
+}
+
+func attach(pusher *rtsp.Pusher) {
+	stream := NewStream(pusher,
+		time.Duration(key("segment_duration").MustFloat64(2)*float64(time.Second)),
+		time.Duration(key("part_duration").MustFloat64(0.5)*float64(time.Second)),
+		key("window").MustInt(6),
+		key("low_latency").MustBool(true))
+	if !pusher.AddSink(SinkID, stream) {
+		return
+	}
+	streamsLock.Lock()
+	if old, ok := streams[stream.Path]; ok {
+		old.Stop()
+	}
+	streams[stream.Path] = stream
+	streamsLock.Unlock()
+	go stream.Start()
+}
+
+func removeStream(stream *Stream) {
+	streamsLock.Lock()
+	if streams[stream.Path] == stream {
+		delete(streams, stream.Path)
+	}
+	streamsLock.Unlock()
+}
+
+// GetStream gets hls stream of path
+func GetStream(path string) *Stream {
+	streamsLock.RLock()
+	defer streamsLock.RUnlock()
+	return streams[path]
+}
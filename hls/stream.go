@@ -0,0 +1,469 @@
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tectiv3/edrtsp/codec"
+	"github.com/tectiv3/edrtsp/mp4"
+	"github.com/tectiv3/edrtsp/rtsp"
+)
+
+var (
+	ErrNotReady = errors.New("stream not ready")
+	// ErrTooFarAhead a blocking reload asked for a segment more than two ahead
+	ErrTooFarAhead = errors.New("_HLS_msn too far ahead")
+)
+
+// Part an LL-HLS partial segment, a single moof/mdat pair
+type Part struct {
+	Duration    time.Duration
+	Independent bool // starts with a keyframe
+	data        []byte
+}
+
+// Segment an fMP4 media segment made of its parts
+type Segment struct {
+	Seq           int
+	Duration      time.Duration
+	Init          int // id of the init section the segment needs
+	Discontinuity bool
+	Parts         []*Part
+	data          []byte // joined parts, set once the segment is complete
+}
+
+// Stream a pusher sink muxing its rtp into a sliding window of fMP4 segments.
+// Segments are cut on GOP starts found by the pusher, audio only streams are
+// cut on any frame once the segment duration is reached. Segments are built
+// from parts of about PartDuration, published as soon as they are muxed so
+// every viewer shares the same muxing.
+type Stream struct {
+	Path            string
+	SegmentDuration time.Duration
+	PartDuration    time.Duration
+	Window          int
+	LowLatency      bool
+
+	logger   *log.Logger
+	pusher   *rtsp.Pusher
+	queue    chan *rtsp.RTPPack
+	quit     chan struct{}
+	stopOnce sync.Once
+	dropped  int
+	readAt   int64 // unix nano of the last request, see Touch
+
+	// owned by the mux goroutine
+	sdpRaw       string
+	depacketizer *rtsp.Depacketizer
+	muxer        *mp4.Muxer
+	video        *mp4.Track
+	audio        *mp4.Track
+	segmentStart time.Duration
+	partStart    time.Duration
+	lastPTS      time.Duration
+	unsupported  bool
+
+	lock          sync.RWMutex
+	inits         map[int][]byte
+	initID        int
+	current       *Segment // segment being muxed, nil between sources
+	segments      []*Segment
+	nextSeq       int
+	discontinuity int // EXT-X-DISCONTINUITY-SEQUENCE
+	updated       chan struct{}
+}
+
+func NewStream(pusher *rtsp.Pusher, segmentDuration, partDuration time.Duration, window int, lowLatency bool) *Stream {
+	return &Stream{
+		Path:            pusher.Path(),
+		SegmentDuration: segmentDuration,
+		PartDuration:    partDuration,
+		Window:          window,
+		LowLatency:      lowLatency,
+		logger:          log.New(os.Stdout, "[HLS]", log.LstdFlags|log.Lshortfile),
+		pusher:          pusher,
+		queue:           make(chan *rtsp.RTPPack, 2048),
+		quit:            make(chan struct{}),
+		inits:           make(map[int][]byte),
+		updated:         make(chan struct{}),
+	}
+}
+
+// QueueRTP queues pack to be muxed, drops it when the muxer falls behind
+func (s *Stream) QueueRTP(pack *rtsp.RTPPack) {
+	select {
+	case s.queue <- pack:
+	default:
+		s.dropped++
+		if s.dropped%1000 == 1 {
+			s.logger.Printf("%s hls queue full, %d packets dropped", s.Path, s.dropped)
+		}
+	}
+}
+
+// Touch marks the stream as read by a viewer
+func (s *Stream) Touch() {
+	atomic.StoreInt64(&s.readAt, time.Now().UnixNano())
+}
+
+// ReadAt gets when a viewer last read the stream, an on demand pusher is
+// kept only while its hls stream is read
+func (s *Stream) ReadAt() time.Time {
+	if readAt := atomic.LoadInt64(&s.readAt); readAt > 0 {
+		return time.Unix(0, readAt)
+	}
+	return time.Time{}
+}
+
+func (s *Stream) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.quit)
+	})
+}
+
+func (s *Stream) Start() {
+	s.logger.Printf("%s hls start", s.Path)
+	defer func() {
+		removeStream(s)
+		s.logger.Printf("%s hls stop", s.Path)
+	}()
+	for {
+		select {
+		case pack := <-s.queue:
+			s.handleRTP(pack)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *Stream) handleRTP(pack *rtsp.RTPPack) {
+	if sdpRaw := s.pusher.SDPRaw(); s.depacketizer == nil || sdpRaw != s.sdpRaw {
+		// new or rebound source, the next segment needs a new init section
+		s.reset()
+		s.sdpRaw = sdpRaw
+		s.depacketizer = rtsp.NewDepacketizer(sdpRaw)
+		s.unsupported = false
+	}
+	for _, frame := range s.depacketizer.Decode(pack) {
+		if err := s.writeFrame(frame); err != nil {
+			s.logger.Printf("%s hls mux failed, %v", s.Path, err)
+			s.reset()
+		}
+	}
+}
+
+// reset drops the muxer, parts already served stay valid as a short segment
+func (s *Stream) reset() {
+	s.muxer = nil
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.current != nil && len(s.current.Parts) > 0 {
+		s.publish()
+	}
+	s.current = nil
+}
+
+func (s *Stream) hasVideo() bool {
+	v := s.depacketizer.VCodec
+	return v == "h264" || v == "h265"
+}
+
+func (s *Stream) writeFrame(frame *rtsp.Frame) (err error) {
+	if !s.depacketizer.Ready() || s.unsupported {
+		return
+	}
+	isVideo := frame.Type == rtsp.RTP_TYPE_VIDEO
+	// parts and segments are cut on video frames, on audio ones without video
+	cutter := isVideo || !s.hasVideo()
+	boundary := isVideo && frame.SequenceStart || !s.hasVideo()
+	if s.muxer == nil {
+		if !boundary || !cutter {
+			return
+		}
+		if err = s.newMuxer(); err != nil || s.muxer == nil {
+			return
+		}
+	}
+	track := s.audio
+	data := frame.Data
+	if isVideo {
+		track = s.video
+		data = codec.AVCC(frame.NALUs)
+	}
+	if track == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.current == nil {
+		s.newSegment(frame.PTS)
+	}
+	// the frame written last is held back by the muxer, so a cut at this
+	// frame ends the part and segment right before it
+	s.muxer.WriteSample(track, frame.PTS, data, frame.KeyFrame)
+	if !cutter {
+		return
+	}
+	interval := frame.PTS - s.lastPTS
+	s.lastPTS = frame.PTS
+	if boundary && frame.PTS-s.segmentStart >= s.SegmentDuration {
+		s.addPart(frame.PTS)
+		s.publish()
+		s.newSegment(frame.PTS)
+	} else if frame.PTS+interval-s.partStart > s.PartDuration {
+		// the next frame would overflow the part target
+		s.addPart(frame.PTS)
+	}
+	return
+}
+
+func (s *Stream) newMuxer() (err error) {
+	d := s.depacketizer
+	s.video, s.audio = nil, nil
+	tracks := make([]*mp4.Track, 0)
+	if s.hasVideo() {
+		if s.video, err = mp4.NewVideoTrack(1, d.VCodec, d.VPS, d.SPS, d.PPS); err != nil {
+			return
+		}
+		tracks = append(tracks, s.video)
+	}
+	if d.ACodec == "aac" && d.AACConfig != nil {
+		s.audio = mp4.NewAudioTrack(2, d.AACConfig)
+		tracks = append(tracks, s.audio)
+	}
+	if len(tracks) == 0 {
+		s.unsupported = true
+		s.logger.Printf("%s hls skipped, no supported codec in video[%s] audio[%s]", s.Path, d.VCodec, d.ACodec)
+		return
+	}
+	muxer := mp4.NewMuxer(tracks...)
+	init, err := muxer.InitSegment()
+	if err != nil {
+		return
+	}
+	s.muxer = muxer
+	s.lock.Lock()
+	s.initID++
+	s.inits[s.initID] = init
+	s.lock.Unlock()
+	return
+}
+
+// newSegment starts the current segment, called with the lock held
+func (s *Stream) newSegment(pts time.Duration) {
+	segment := &Segment{Seq: s.nextSeq, Init: s.initID}
+	s.nextSeq++
+	if n := len(s.segments); n > 0 && s.segments[n-1].Init != segment.Init {
+		segment.Discontinuity = true
+	}
+	s.current = segment
+	s.segmentStart = pts
+	s.partStart = pts
+	s.lastPTS = pts
+}
+
+// addPart closes the current part at pts, called with the lock held
+func (s *Stream) addPart(pts time.Duration) {
+	fragment := s.muxer.Fragment(false)
+	if fragment == nil {
+		return
+	}
+	s.current.Parts = append(s.current.Parts, &Part{
+		Duration:    pts - s.partStart,
+		Independent: len(s.current.Parts) == 0 || !s.hasVideo(),
+		data:        fragment,
+	})
+	s.partStart = pts
+	s.notify()
+}
+
+// publish appends the current segment and slides the window, called with the lock held
+func (s *Stream) publish() {
+	segment := s.current
+	s.current = nil
+	for _, part := range segment.Parts {
+		segment.Duration += part.Duration
+		segment.data = append(segment.data, part.data...)
+	}
+	s.segments = append(s.segments, segment)
+	// keep a few segments past the window for clients reading a stale playlist
+	for len(s.segments) > s.Window+2 {
+		if s.segments[0].Discontinuity {
+			s.discontinuity++
+		}
+		s.segments = s.segments[1:]
+	}
+	for id := range s.inits {
+		if id < s.segments[0].Init {
+			delete(s.inits, id)
+		}
+	}
+	s.notify()
+}
+
+// notify wakes up blocked requests, called with the lock held
+func (s *Stream) notify() {
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+// Wait blocks until ready, called with the read lock held, returns true or until timeout
+func (s *Stream) Wait(ready func() bool, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.lock.RLock()
+		ok := ready()
+		updated := s.updated
+		s.lock.RUnlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-updated:
+		case <-timer.C:
+			return false
+		case <-s.quit:
+			return false
+		}
+	}
+}
+
+// hasPart reports whether part of segment msn is muxed, part -1 asks for the whole segment
+func (s *Stream) hasPart(msn, part int) bool {
+	if n := len(s.segments); n > 0 && s.segments[n-1].Seq >= msn {
+		return true
+	}
+	if part < 0 || s.current == nil {
+		return false
+	}
+	return s.current.Seq > msn || s.current.Seq == msn && len(s.current.Parts) > part
+}
+
+// Playlist renders the media playlist. With msn >= 0 it blocks until segment
+// msn, or its part when part >= 0, is available, like _HLS_msn and _HLS_part.
+func (s *Stream) Playlist(msn, part int) (string, error) {
+	timeout := 2*s.SegmentDuration + 5*time.Second
+	if !s.Wait(func() bool { return len(s.segments) > 0 }, timeout) {
+		return "", ErrNotReady
+	}
+	if msn >= 0 {
+		s.lock.RLock()
+		next := s.nextSeq
+		s.lock.RUnlock()
+		if msn > next+1 {
+			return "", ErrTooFarAhead
+		}
+		s.Wait(func() bool { return s.hasPart(msn, part) }, 3*s.SegmentDuration)
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	segments := s.segments
+	if len(segments) > s.Window {
+		segments = segments[len(segments)-s.Window:]
+	}
+	discontinuity := s.discontinuity
+	for _, segment := range s.segments[:len(s.segments)-len(segments)] {
+		if segment.Discontinuity {
+			discontinuity++
+		}
+	}
+	target := math.Ceil(s.SegmentDuration.Seconds())
+	for _, segment := range segments {
+		target = math.Max(target, math.Ceil(segment.Duration.Seconds()))
+	}
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(target))
+	if s.LowLatency {
+		fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*s.PartDuration.Seconds())
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", s.PartDuration.Seconds())
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].Seq)
+	fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuity)
+	if s.current != nil {
+		segments = append(segments[:len(segments):len(segments)], s.current)
+	}
+	for i, segment := range segments {
+		if segment.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if i == 0 || segment.Init != segments[i-1].Init {
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init%d.mp4\"\n", segment.Init)
+		}
+		// parts of the last segments only, older ones are fetched whole
+		if s.LowLatency && i >= len(segments)-3 {
+			for j, part := range segment.Parts {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=\"part%d.%d.m4s\"", part.Duration.Seconds(), segment.Seq, j)
+				if part.Independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+		if segment == s.current {
+			break
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", segment.Duration.Seconds())
+		fmt.Fprintf(&b, "seg%d.m4s\n", segment.Seq)
+	}
+	if s.LowLatency {
+		if s.current != nil {
+			fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.m4s\"\n", s.current.Seq, len(s.current.Parts))
+		} else {
+			fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.0.m4s\"\n", s.nextSeq)
+		}
+	}
+	return b.String(), nil
+}
+
+// InitSection returns init section id
+func (s *Stream) InitSection(id int) ([]byte, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	init, ok := s.inits[id]
+	return init, ok
+}
+
+// Segment returns data of segment seq
+func (s *Stream) Segment(seq int) ([]byte, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, segment := range s.segments {
+		if segment.Seq == seq {
+			return segment.data, true
+		}
+	}
+	return nil, false
+}
+
+// Part returns data of part index of segment seq, blocks for a hinted part not muxed yet
+func (s *Stream) Part(seq, index int) ([]byte, bool) {
+	s.lock.RLock()
+	upcoming := seq >= s.nextSeq-1 && seq <= s.nextSeq
+	s.lock.RUnlock()
+	if upcoming {
+		s.Wait(func() bool { return s.hasPart(seq, index) }, s.SegmentDuration+3*s.PartDuration)
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	segments := s.segments
+	if s.current != nil {
+		segments = append(segments[:len(segments):len(segments)], s.current)
+	}
+	for _, segment := range segments {
+		if segment.Seq == seq && index >= 0 && index < len(segment.Parts) {
+			return segment.Parts[index].data, true
+		}
+	}
+	return nil, false
+}
@@ -2,14 +2,22 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/tectiv3/edrtsp/api"
+	"github.com/tectiv3/edrtsp/hls"
+	"github.com/tectiv3/edrtsp/pull"
+	"github.com/tectiv3/edrtsp/record"
+	"github.com/tectiv3/edrtsp/relay"
+	"github.com/tectiv3/edrtsp/rtmp"
 	"github.com/tectiv3/edrtsp/rtsp"
+	"github.com/tectiv3/edrtsp/store"
 	"github.com/tectiv3/edrtsp/utils"
 )
 
@@ -27,6 +35,7 @@ type program struct {
 	httpServer *http.Server
 	rtspPort   int
 	rtspServer *rtsp.Server
+	rtmpServer *rtmp.Server
 }
 
 func (p *program) stopHTTP() (err error) {
@@ -93,11 +102,27 @@ func (p *program) stopRTSP() (err error) {
 	return
 }
 
-type stream struct {
-	URL               string `gorm:"type:varchar(256);primary_key;unique"`
-	CustomPath        string `gorm:"type:varchar(256)"`
-	IdleTimeout       int
-	HeartbeatInterval int
+func (p *program) startRTMP() (err error) {
+	if p.rtmpServer == nil {
+		return
+	}
+	link := fmt.Sprintf("rtmp://%s:%d", utils.LocalIP(), p.rtmpServer.Port)
+	log.Println("rtmp server started -->", link)
+	go func() {
+		if err := p.rtmpServer.Start(); err != nil {
+			log.Println("rtmp server start failed", err)
+		}
+		log.Println("rtmp server stopped")
+	}()
+	return
+}
+
+func (p *program) stopRTMP() (err error) {
+	if p.rtmpServer == nil {
+		return
+	}
+	p.rtmpServer.Stop()
+	return
 }
 
 func (p *program) start() (err error) {
@@ -107,49 +132,34 @@ func (p *program) start() (err error) {
 		return
 	}
 
+	streamsFile := utils.DataDir(utils.Conf().Section("store").Key("streams_file").MustString("streams.json"))
+	if err = store.Open(streamsFile); err != nil {
+		return
+	}
+	usersFile := utils.DataDir(utils.Conf().Section("store").Key("users_file").MustString("users.digest"))
+	if err = store.OpenUsers(usersFile); err != nil {
+		return
+	}
+	p.rtspServer.Credentials = store.UserStore{}
+	p.rtspServer.Sources = pull.Provider{}
+	p.rtspServer.Hooks = rtsp.LoadHooks()
+	if aclFile := utils.Conf().Section("rtsp").Key("acl_file").String(); aclFile != "" {
+		if p.rtspServer.ACL, err = rtsp.LoadACL(utils.DataDir(aclFile)); err != nil {
+			return
+		}
+	}
+
+	record.Start(p.rtspServer)
+	hls.Start(p.rtspServer)
+	relay.Start(p.rtspServer)
+	pull.Start(p.rtspServer)
+
 	p.startRTSP()
+	p.startRTMP()
 	p.startHTTP()
 
 	log.SetOutput(os.Stdout)
 
-	go func() {
-		streams := []stream{}
-		log.Printf("demon pull streams %d\n", len(streams))
-		for {
-			// streams = append(streams, stream{
-			// 	"rtsp://localhost:8554/roi",
-			// 	"roi",
-			// 	1,
-			// 	10,
-			// })
-			for i := len(streams) - 1; i > -1; i-- {
-				v := streams[i]
-				agent := fmt.Sprintf("edrtsp/%s", "0.0.1")
-				if BuildDateTime != "" {
-					agent = fmt.Sprintf("%s(%s)", agent, BuildDateTime)
-				}
-				client, err := rtsp.NewRTSPClient(rtsp.GetServer(), v.URL, int64(v.HeartbeatInterval)*1000, agent)
-				if err != nil {
-					continue
-				}
-				client.CustomPath = v.CustomPath
-
-				pusher := rtsp.NewClientPusher(client)
-				if rtsp.GetServer().GetPusher(pusher.Path()) != nil {
-					continue
-				}
-				err = client.Start(time.Duration(v.IdleTimeout) * time.Second)
-				if err != nil {
-					log.Printf("Pull stream err :%v", err)
-					continue
-				}
-				rtsp.GetServer().AddPusher(pusher)
-				//streams = streams[0:i]
-				//streams = append(streams[:i], streams[i+1:]...)
-			}
-			time.Sleep(10 * time.Second)
-		}
-	}()
 	return
 }
 
@@ -157,24 +167,57 @@ func (p *program) stop() (err error) {
 	defer log.Println("********** STOP **********")
 	p.stopHTTP()
 	p.stopRTSP()
+	p.stopRTMP()
 	return
 }
 
+type overrides []string
+
+func (o *overrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *overrides) Set(value string) error {
+	*o = append(*o, value)
+	return nil
+}
+
 func main() {
 	// log
 	log.SetPrefix("[edrtsp] ")
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
 
+	confFile := flag.String("config", "", "config file path, default edrtsp.ini next to the executable")
+	var sets overrides
+	flag.Var(&sets, "set", "override config key, section.key=value, repeatable")
+	flag.Parse()
+
 	log.Printf("git commit code:%s", GitCommitCode)
 	log.Printf("build date:%s", BuildDateTime)
 
+	if err := utils.LoadConf(*confFile, sets); err != nil {
+		log.Fatalf("load config failed, %v", err)
+	}
+
 	rtspServer := rtsp.GetServer()
+	rtspServer.TCPPort = utils.Conf().Section("rtsp").Key("port").MustInt(554)
+	rtspServer.TLSPort = utils.Conf().Section("rtsp").Key("tls_port").MustInt(0)
+	rtspServer.Agent = fmt.Sprintf("edrtsp/%s", "0.0.1")
+	if BuildDateTime != "" {
+		rtspServer.Agent = fmt.Sprintf("%s(%s)", rtspServer.Agent, BuildDateTime)
+	}
 	p := &program{
 		rtspPort:   rtspServer.TCPPort,
 		rtspServer: rtspServer,
-		httpPort:   8080,
+		httpPort:   utils.Conf().Section("http").Key("port").MustInt(8080),
+	}
+	if utils.Conf().Section("rtmp").Key("enable").MustBool(true) {
+		p.rtmpServer = rtmp.GetServer()
+		p.rtmpServer.Port = utils.Conf().Section("rtmp").Key("port").MustInt(1935)
+	}
+	if err := p.start(); err != nil {
+		log.Fatal(err)
 	}
-	p.start()
 
 	select {}
 }
@@ -0,0 +1,67 @@
+package mp4
+
+import "encoding/binary"
+
+func u8(v uint8) []byte {
+	return []byte{v}
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func zeros(n int) []byte {
+	return make([]byte, n)
+}
+
+// box joins parts into a box of type typ
+func box(typ string, parts ...[]byte) []byte {
+	size := 8
+	for _, p := range parts {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = append(b, u32(uint32(size))...)
+	b = append(b, typ...)
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func fullBox(typ string, version uint8, flags uint32, parts ...[]byte) []byte {
+	return box(typ, append([][]byte{u32(uint32(version)<<24 | flags&0xffffff)}, parts...)...)
+}
+
+var matrix = []byte{
+	0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0x00, 0x00, 0x00,
+}
+
+// descriptor builds an mpeg-4 descriptor of esds
+func descriptor(tag uint8, parts ...[]byte) []byte {
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+	b := []byte{tag, 0x80 | byte(size>>21&0x7f), 0x80 | byte(size>>14&0x7f), 0x80 | byte(size>>7&0x7f), byte(size & 0x7f)}
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
@@ -0,0 +1,286 @@
+package mp4
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tectiv3/edrtsp/codec"
+)
+
+// Track an h264, h265 or aac track of a fragmented mp4
+type Track struct {
+	ID        uint32
+	Codec     string
+	TimeScale uint32
+
+	// video
+	VPS    []byte
+	SPS    []byte
+	PPS    []byte
+	Width  int
+	Height int
+
+	// audio
+	AACConfig *codec.AACConfig
+
+	pending      []*Sample
+	lastDTS      uint64
+	lastDuration uint32
+}
+
+// Sample a frame of a track, Data in AVCC format for video
+type Sample struct {
+	DTS      uint64
+	Data     []byte
+	KeyFrame bool
+	duration uint32
+}
+
+func NewVideoTrack(id uint32, codecName string, vps, sps, pps []byte) (track *Track, err error) {
+	track = &Track{
+		ID:        id,
+		Codec:     codecName,
+		TimeScale: 90000,
+		VPS:       vps,
+		SPS:       sps,
+		PPS:       pps,
+	}
+	switch codecName {
+	case "h264":
+		info, err := codec.ParseH264SPS(sps)
+		if err != nil {
+			return nil, err
+		}
+		track.Width, track.Height = info.Width, info.Height
+	case "h265":
+		info, err := codec.ParseH265SPS(sps)
+		if err != nil {
+			return nil, err
+		}
+		track.Width, track.Height = info.Width, info.Height
+	default:
+		err = fmt.Errorf("mp4 video codec %s not supported", codecName)
+	}
+	return
+}
+
+func NewAudioTrack(id uint32, config *codec.AACConfig) *Track {
+	return &Track{
+		ID:        id,
+		Codec:     "aac",
+		TimeScale: uint32(config.SampleRate),
+		AACConfig: config,
+	}
+}
+
+func (track *Track) IsVideo() bool {
+	return track.Codec != "aac"
+}
+
+// Muxer builds an init segment and moof/mdat fragments of its tracks.
+// Sample times are taken relative to the first sample written.
+type Muxer struct {
+	Tracks []*Track
+
+	seq     uint32
+	started bool
+	start   time.Duration
+}
+
+func NewMuxer(tracks ...*Track) *Muxer {
+	return &Muxer{Tracks: tracks}
+}
+
+// InitSegment returns ftyp and moov boxes
+func (m *Muxer) InitSegment() ([]byte, error) {
+	traks := make([]byte, 0)
+	trexs := make([]byte, 0)
+	nextID := uint32(1)
+	for _, track := range m.Tracks {
+		trak, err := track.trak()
+		if err != nil {
+			return nil, err
+		}
+		traks = append(traks, trak...)
+		trexs = append(trexs, fullBox("trex", 0, 0, u32(track.ID), u32(1), u32(0), u32(0), u32(0))...)
+		if track.ID >= nextID {
+			nextID = track.ID + 1
+		}
+	}
+	ftyp := box("ftyp", []byte("iso5"), u32(512), []byte("iso5iso6mp41"))
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(1000), u32(0),
+		u32(0x00010000), u16(0x0100), zeros(10), matrix, zeros(24), u32(nextID))
+	moov := box("moov", mvhd, traks, box("mvex", trexs))
+	return append(ftyp, moov...), nil
+}
+
+func (track *Track) trak() ([]byte, error) {
+	var width, height uint32
+	var volume uint16
+	var handler, name string
+	var mhd, entry []byte
+	switch track.Codec {
+	case "h264":
+		width, height = uint32(track.Width), uint32(track.Height)
+		handler, name = "vide", "VideoHandler"
+		mhd = fullBox("vmhd", 0, 1, zeros(8))
+		avcc, err := codec.AVCDecoderConfigurationRecord(track.SPS, track.PPS)
+		if err != nil {
+			return nil, err
+		}
+		entry = track.videoEntry("avc1", box("avcC", avcc))
+	case "h265":
+		width, height = uint32(track.Width), uint32(track.Height)
+		handler, name = "vide", "VideoHandler"
+		mhd = fullBox("vmhd", 0, 1, zeros(8))
+		hvcc, err := codec.HEVCDecoderConfigurationRecord(track.VPS, track.SPS, track.PPS)
+		if err != nil {
+			return nil, err
+		}
+		entry = track.videoEntry("hvc1", box("hvcC", hvcc))
+	case "aac":
+		volume = 0x0100
+		handler, name = "soun", "SoundHandler"
+		mhd = fullBox("smhd", 0, 0, zeros(4))
+		config := track.AACConfig.Bytes()
+		esds := fullBox("esds", 0, 0, descriptor(0x03,
+			u16(uint16(track.ID)), u8(0),
+			descriptor(0x04, u8(0x40), u8(0x15), zeros(3), u32(0), u32(0), descriptor(0x05, config)),
+			descriptor(0x06, u8(0x02))))
+		entry = box("mp4a", zeros(6), u16(1), zeros(8),
+			u16(uint16(track.AACConfig.Channels)), u16(16), zeros(4), u32(uint32(track.AACConfig.SampleRate)<<16), esds)
+	default:
+		return nil, fmt.Errorf("mp4 codec %s not supported", track.Codec)
+	}
+	tkhd := fullBox("tkhd", 0, 3,
+		u32(0), u32(0), u32(track.ID), zeros(4), u32(0), zeros(8),
+		u16(0), u16(0), u16(volume), zeros(2), matrix, u32(width<<16), u32(height<<16))
+	mdhd := fullBox("mdhd", 0, 0, u32(0), u32(0), u32(track.TimeScale), u32(0), u16(0x55c4), u16(0))
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte(handler), zeros(12), []byte(name), u8(0))
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), entry),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)))
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", mhd, dinf, stbl))), nil
+}
+
+func (track *Track) videoEntry(typ string, config []byte) []byte {
+	return box(typ, zeros(6), u16(1), zeros(16),
+		u16(uint16(track.Width)), u16(uint16(track.Height)),
+		u32(0x00480000), u32(0x00480000), zeros(4), u16(1), zeros(32), u16(0x0018), u16(0xffff), config)
+}
+
+// WriteSample queues a sample of track at time t, it is written by the next Fragment
+func (m *Muxer) WriteSample(track *Track, t time.Duration, data []byte, keyFrame bool) {
+	if !m.started {
+		m.started = true
+		m.start = t
+	}
+	t -= m.start
+	if t < 0 {
+		t = 0
+	}
+	dts := durationTicks(t, track.TimeScale)
+	if len(track.pending) > 0 || track.lastDuration > 0 {
+		if dts <= track.lastDTS {
+			dts = track.lastDTS + 1
+		}
+	}
+	track.lastDTS = dts
+	track.pending = append(track.pending, &Sample{DTS: dts, Data: data, KeyFrame: keyFrame})
+}
+
+// Buffered returns duration of samples queued on track
+func (m *Muxer) Buffered(track *Track) time.Duration {
+	if len(track.pending) < 2 {
+		return 0
+	}
+	d := track.pending[len(track.pending)-1].DTS - track.pending[0].DTS
+	return ticksDuration(d, track.TimeScale)
+}
+
+// durationTicks converts t to ticks of timescale, whole seconds apart so it
+// doesn't overflow on long running streams
+func durationTicks(t time.Duration, timescale uint32) uint64 {
+	scale := uint64(timescale)
+	return uint64(t/time.Second)*scale + uint64(t%time.Second)*scale/uint64(time.Second)
+}
+
+// ticksDuration converts ticks of timescale to a duration
+func ticksDuration(ticks uint64, timescale uint32) time.Duration {
+	scale := uint64(timescale)
+	return time.Duration(ticks/scale)*time.Second + time.Duration(ticks%scale*uint64(time.Second)/scale)
+}
+
+// Fragment returns moof and mdat of queued samples, nil when there is none.
+// The last sample of each track waits for the next one to know its duration
+// unless final is set.
+func (m *Muxer) Fragment(final bool) []byte {
+	type trackRun struct {
+		track   *Track
+		samples []*Sample
+	}
+	runs := make([]trackRun, 0)
+	for _, track := range m.Tracks {
+		n := len(track.pending)
+		if !final {
+			n--
+		}
+		if n <= 0 {
+			continue
+		}
+		samples := track.pending[:n]
+		for i, s := range samples {
+			if i+1 < len(track.pending) {
+				s.duration = uint32(track.pending[i+1].DTS - s.DTS)
+				track.lastDuration = s.duration
+			} else if track.lastDuration > 0 {
+				s.duration = track.lastDuration
+			} else if track.IsVideo() {
+				s.duration = track.TimeScale / 25
+			} else {
+				s.duration = 1024
+			}
+		}
+		track.pending = append([]*Sample{}, track.pending[n:]...)
+		runs = append(runs, trackRun{track, samples})
+	}
+	if len(runs) == 0 {
+		return nil
+	}
+	m.seq++
+	build := func(offsets []uint32) []byte {
+		trafs := make([]byte, 0)
+		for i, run := range runs {
+			entries := make([]byte, 0, 12*len(run.samples))
+			for _, s := range run.samples {
+				flags := uint32(0x01010000)
+				if s.KeyFrame {
+					flags = 0x02000000
+				}
+				entries = append(entries, u32(s.duration)...)
+				entries = append(entries, u32(uint32(len(s.Data)))...)
+				entries = append(entries, u32(flags)...)
+			}
+			trafs = append(trafs, box("traf",
+				fullBox("tfhd", 0, 0x020000, u32(run.track.ID)),
+				fullBox("tfdt", 1, 0, u64(run.samples[0].DTS)),
+				fullBox("trun", 0, 0x000701, u32(uint32(len(run.samples))), u32(offsets[i]), entries))...)
+		}
+		return box("moof", fullBox("mfhd", 0, 0, u32(m.seq)), trafs)
+	}
+	offsets := make([]uint32, len(runs))
+	moofSize := uint32(len(build(offsets)))
+	mdat := make([]byte, 0)
+	for i, run := range runs {
+		offsets[i] = moofSize + 8 + uint32(len(mdat))
+		for _, s := range run.samples {
+			mdat = append(mdat, s.Data...)
+		}
+	}
+	return append(build(offsets), box("mdat", mdat)...)
+}
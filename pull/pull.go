@@ -0,0 +1,112 @@
+package pull
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/go-ini/ini"
+	"github.com/tectiv3/edrtsp/rtsp"
+	"github.com/tectiv3/edrtsp/store"
+	"github.com/tectiv3/edrtsp/utils"
+)
+
+var (
+	server    *rtsp.Server
+	pulls     = make(map[string]*Puller) // ID <-> Puller
+	pullsLock sync.RWMutex
+)
+
+// key gets key from [pull] config section
+func key(name string) *ini.Key {
+	return utils.Conf().Section("pull").Key(name)
+}
+
+// Start pulls the streams kept in the store
+func Start(s *rtsp.Server) {
+	server = s
+	for _, stream := range store.Streams() {
+		if _, err := Add(stream); err != nil {
+			log.Printf("pull %s failed, %v", stream.URL, err)
+		}
+	}
+}
+
+// Add starts pulling stream, it keeps reconnecting until removed
+func Add(stream store.Stream) (puller *Puller, err error) {
+	if server == nil {
+		return nil, fmt.Errorf("pull not started")
+	}
+	pullsLock.Lock()
+	defer pullsLock.Unlock()
+	for _, v := range pulls {
+		if v.Path() == stream.Path() {
+			return nil, fmt.Errorf("%s is pulled from %s already", v.Path(), v.Stream.URL)
+		}
+	}
+	puller = newPuller(server, stream)
+	pulls[puller.ID] = puller
+	if !stream.OnDemand {
+		puller.start()
+	}
+	return
+}
+
+// Remove stops the puller with id, dropping its pusher and players
+func Remove(id string) bool {
+	pullsLock.Lock()
+	puller, ok := pulls[id]
+	delete(pulls, id)
+	pullsLock.Unlock()
+	if ok {
+		puller.Stop()
+	}
+	return ok
+}
+
+// Get gets the puller of path
+func Get(path string) *Puller {
+	pullsLock.RLock()
+	defer pullsLock.RUnlock()
+	for _, v := range pulls {
+		if v.Path() == path {
+			return v
+		}
+	}
+	return nil
+}
+
+// Provider pulls on demand streams for the rtsp server
+type Provider struct {
+}
+
+// Demand starts pulling the on demand stream of path and waits until it plays
+func (Provider) Demand(path string) (*rtsp.Pusher, error) {
+	puller := Get(path)
+	if puller == nil || !puller.Stream.OnDemand {
+		return nil, nil
+	}
+	puller.start()
+	if err := puller.WaitConnected(); err != nil {
+		return nil, err
+	}
+	if pusher := puller.Pusher(); pusher != nil {
+		return pusher, nil
+	}
+	return nil, fmt.Errorf("source of %s lost", path)
+}
+
+// Pullers gets pullers ordered by start time
+func Pullers() []*Puller {
+	pullsLock.RLock()
+	list := make([]*Puller, 0, len(pulls))
+	for _, v := range pulls {
+		list = append(list, v)
+	}
+	pullsLock.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartAt.Before(list[j].StartAt)
+	})
+	return list
+}
@@ -0,0 +1,340 @@
+package pull
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tectiv3/edrtsp/rtsp"
+	"github.com/tectiv3/edrtsp/store"
+)
+
+// puller states
+const (
+	STATE_CONNECTING = "connecting"
+	STATE_PLAYING    = "playing"
+	STATE_RETRYING   = "retrying" // waiting for the next attempt
+	STATE_FAILED     = "failed"   // gave up after max_retries
+	STATE_IDLE       = "idle"     // on demand, waiting for a player
+)
+
+// errIdle ends pulling an on demand stream nobody plays
+var errIdle = errors.New("no players")
+
+// Puller pulls a stream into a pusher and reconnects with exponential
+// backoff when the source goes away. Players of the pusher wait for the
+// reconnect up to player_grace. On demand streams are only pulled from the
+// first player until on_demand_idle after the last one left. Streams with
+// backup urls fail over to the next one keeping the pusher when a source
+// can't be played, a lost source is tried again first, and back off only
+// after every source failed.
+type Puller struct {
+	ID      string
+	Stream  store.Stream
+	StartAt time.Time
+
+	server    *rtsp.Server
+	logger    *log.Logger
+	lock      sync.RWMutex
+	state     string
+	err       error
+	retries   int // failed attempts since the source last played
+	nextRetry time.Time
+	pusher    *rtsp.Pusher
+	lostAt    time.Time // when the pusher lost its source
+	source    int       // index of the url pulled in Stream.URLs()
+	running   bool
+	ready     chan struct{} // closed once the first attempt of a run is done
+	readyErr  error
+	quit      chan struct{}
+	stopOnce  sync.Once
+}
+
+func newPuller(server *rtsp.Server, stream store.Stream) *Puller {
+	return &Puller{
+		ID:      fmt.Sprintf("%x", time.Now().UnixNano()),
+		Stream:  stream,
+		StartAt: time.Now(),
+		server:  server,
+		logger:  log.New(os.Stdout, fmt.Sprintf("[pull %s]", stream.Path()), log.LstdFlags|log.Lshortfile),
+		state:   STATE_IDLE,
+		ready:   make(chan struct{}),
+		quit:    make(chan struct{}),
+	}
+}
+
+// start runs the puller unless it is running already
+func (puller *Puller) start() {
+	puller.lock.Lock()
+	defer puller.lock.Unlock()
+	if puller.running {
+		return
+	}
+	select {
+	case <-puller.ready:
+		puller.ready, puller.readyErr = make(chan struct{}), nil
+	default:
+	}
+	puller.running = true
+	go puller.run()
+}
+
+// Path gets the path the stream is published on
+func (puller *Puller) Path() string {
+	return puller.Stream.Path()
+}
+
+// Status gets state, last error and failed attempts of the puller, with the
+// time of the next attempt while retrying
+func (puller *Puller) Status() (state string, err error, retries int, nextRetry time.Time) {
+	puller.lock.RLock()
+	defer puller.lock.RUnlock()
+	return puller.state, puller.err, puller.retries, puller.nextRetry
+}
+
+// SourceURL gets the url pulled, or tried next while retrying
+func (puller *Puller) SourceURL() string {
+	puller.lock.RLock()
+	defer puller.lock.RUnlock()
+	return puller.Stream.URLs()[puller.source]
+}
+
+// Pusher gets the pusher of the stream, held while reconnecting, nil before
+// the first connection or after the grace period
+func (puller *Puller) Pusher() *rtsp.Pusher {
+	puller.lock.RLock()
+	defer puller.lock.RUnlock()
+	return puller.pusher
+}
+
+// WaitConnected waits for the first connection attempt of the current run
+func (puller *Puller) WaitConnected() error {
+	puller.lock.RLock()
+	ready := puller.ready
+	puller.lock.RUnlock()
+	<-ready
+	puller.lock.RLock()
+	defer puller.lock.RUnlock()
+	return puller.readyErr
+}
+
+func (puller *Puller) Stop() {
+	puller.stopOnce.Do(func() {
+		close(puller.quit)
+	})
+}
+
+func (puller *Puller) setState(state string, err error) {
+	puller.lock.Lock()
+	puller.state, puller.err = state, err
+	puller.lock.Unlock()
+	if err != nil {
+		puller.logger.Printf("%s, %v", state, err)
+	} else {
+		puller.logger.Println(state)
+	}
+}
+
+func (puller *Puller) setPusher(pusher *rtsp.Pusher) {
+	puller.lock.Lock()
+	puller.pusher = pusher
+	puller.lock.Unlock()
+}
+
+func (puller *Puller) notifyConnected(err error) {
+	puller.lock.Lock()
+	defer puller.lock.Unlock()
+	select {
+	case <-puller.ready:
+	default:
+		puller.readyErr = err
+		close(puller.ready)
+	}
+}
+
+func (puller *Puller) run() {
+	minInterval := time.Duration(key("retry_interval").MustInt(1)) * time.Second
+	maxInterval := time.Duration(key("max_retry_interval").MustInt(60)) * time.Second
+	maxRetries := key("max_retries").MustInt(0)
+	grace := time.Duration(key("player_grace").MustInt(30)) * time.Second
+	interval := minInterval
+	defer func() {
+		puller.release()
+		puller.notifyConnected(errors.New("stopped"))
+		puller.lock.Lock()
+		puller.running = false
+		puller.lock.Unlock()
+	}()
+	urls := puller.Stream.URLs()
+	for {
+		puller.setState(STATE_CONNECTING, nil)
+		err := puller.pull()
+		select {
+		case <-puller.quit:
+			return
+		default:
+		}
+		if err == errIdle {
+			puller.setState(STATE_IDLE, nil)
+			return
+		}
+		retries := 0
+		if err == nil {
+			// played until the source went away, start over quickly with
+			// the same source
+			interval = minInterval
+			err = fmt.Errorf("source %s of %s lost", puller.SourceURL(), puller.Path())
+		} else {
+			puller.lock.Lock()
+			puller.retries++
+			retries = puller.retries
+			puller.source = (puller.source + 1) % len(urls)
+			puller.lock.Unlock()
+			if retries%len(urls) != 0 {
+				// fail over to the next source right away
+				puller.setState(STATE_RETRYING, err)
+				continue
+			}
+			// every source failed
+			puller.notifyConnected(err)
+		}
+		if puller.Stream.OnDemand && puller.Pusher() == nil {
+			// no players to keep, the next one starts over
+			puller.setState(STATE_IDLE, err)
+			return
+		}
+		if maxRetries > 0 && retries > maxRetries*len(urls) {
+			puller.setState(STATE_FAILED, err)
+			return
+		}
+		puller.lock.Lock()
+		puller.nextRetry = time.Now().Add(interval)
+		puller.lock.Unlock()
+		puller.setState(STATE_RETRYING, err)
+		if !puller.wait(interval, grace) {
+			return
+		}
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+// wait sleeps interval, releasing the held pusher once grace is over
+func (puller *Puller) wait(interval, grace time.Duration) bool {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	var graceC <-chan time.Time
+	if puller.Pusher() != nil {
+		graceTimer := time.NewTimer(time.Until(puller.lostAt.Add(grace)))
+		defer graceTimer.Stop()
+		graceC = graceTimer.C
+	}
+	for {
+		select {
+		case <-puller.quit:
+			return false
+		case <-timer.C:
+			return true
+		case <-graceC:
+			puller.logger.Printf("no source for %v, dropping players", grace)
+			puller.release()
+			if puller.Stream.OnDemand {
+				puller.setState(STATE_IDLE, fmt.Errorf("source of %s lost", puller.Path()))
+				return false
+			}
+			graceC = nil
+		}
+	}
+}
+
+// release ends the held pusher with its players
+func (puller *Puller) release() {
+	if pusher := puller.Pusher(); pusher != nil {
+		puller.setPusher(nil)
+		pusher.Release()
+	}
+}
+
+// pull connects to the source and feeds the pusher until the connection
+// fails or the puller is stopped, err is only set when it never played
+func (puller *Puller) pull() (err error) {
+	stream := puller.Stream
+	url := puller.SourceURL()
+	puller.logger.Printf("pulling %s", url)
+	client, err := rtsp.NewRTSPClient(puller.server, url, int64(stream.HeartbeatInterval)*1000, puller.server.Agent)
+	if err != nil {
+		return
+	}
+	client.ID = puller.ID
+	// backups publish on the path of the primary url
+	client.CustomPath = puller.Path()
+	client.TransType, _ = rtsp.ParseTransType(stream.TransType)
+	stopped := make(chan struct{})
+	client.StopHandles = append(client.StopHandles, func() {
+		close(stopped)
+	})
+	if err = client.Start(time.Duration(stream.IdleTimeout) * time.Second); err != nil {
+		client.Stop()
+		return
+	}
+	if pusher := puller.Pusher(); pusher != nil && puller.server.GetPusher(pusher.Path()) == pusher {
+		pusher.RebindClient(client)
+	} else {
+		if puller.server.GetPusher(puller.Path()) != nil {
+			client.Stop()
+			return fmt.Errorf("path %s already has a pusher", puller.Path())
+		}
+		pusher = rtsp.NewClientPusher(client)
+		pusher.Hold()
+		if !puller.server.AddPusher(pusher) {
+			client.Stop()
+			return fmt.Errorf("add pusher %s failed", puller.Path())
+		}
+		puller.setPusher(pusher)
+	}
+	puller.lock.Lock()
+	puller.retries = 0
+	puller.lock.Unlock()
+	puller.setState(STATE_PLAYING, nil)
+	puller.notifyConnected(nil)
+
+	// sources that keep the connection but stop sending count as lost
+	readTimeout := time.Duration(key("read_timeout").MustInt(15)) * time.Second
+	idleTimeout := time.Duration(key("on_demand_idle").MustInt(10)) * time.Second
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	inBytes, readAt, playedAt := atomic.LoadInt64(&client.InBytes), time.Now(), time.Now()
+	for {
+		select {
+		case <-stopped:
+			puller.lostAt = time.Now()
+			return nil
+		case <-puller.quit:
+			client.Stop()
+			return nil
+		case now := <-ticker.C:
+			if n := atomic.LoadInt64(&client.InBytes); n != inBytes {
+				inBytes, readAt = n, now
+			} else if readTimeout > 0 && now.Sub(readAt) > readTimeout {
+				puller.logger.Printf("nothing read for %v", readTimeout)
+				client.Stop()
+			}
+			if !puller.Stream.OnDemand {
+				continue
+			}
+			if readAt := puller.Pusher().ReadAt(); readAt.After(playedAt) {
+				playedAt = readAt
+			}
+			if now.Sub(playedAt) > idleTimeout {
+				puller.logger.Printf("no viewers for %v", idleTimeout)
+				client.Stop()
+				return errIdle
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package record
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/tectiv3/edrtsp/rtsp"
+	"github.com/tectiv3/edrtsp/utils"
+)
+
+// SinkID id of recorders among pusher sinks
+const SinkID = "record"
+
+// File a recorded mp4 file
+type File struct {
+	Name    string    `json:"name"` // relative to the record dir
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+var (
+	overrides     = make(map[string]bool) // path <-> enabled by api
+	overridesLock sync.RWMutex
+)
+
+// key gets key from [record] config section
+func key(name string) *ini.Key {
+	return utils.Conf().Section("record").Key(name)
+}
+
+// Dir gets the record dir
+func Dir() string {
+	return utils.DataDir(key("dir").MustString("records"))
+}
+
+// Start records pushers of enabled paths from now on and removes expired files
+func Start(server *rtsp.Server) {
+	server.AddPusherHandles = append(server.AddPusherHandles, func(pusher *rtsp.Pusher) {
+		if Enabled(pusher.Path()) {
+			attach(pusher)
+		}
+	})
+	if hours := key("retention_hours").MustInt(0); hours > 0 {
+		go func() {
+			for {
+				cleanup(time.Duration(hours) * time.Hour)
+				time.Sleep(10 * time.Minute)
+			}
+		}()
+	}
+}
+
+// Enabled reports whether path is recorded, api overrides [record] enable and paths
+func Enabled(p string) bool {
+	overridesLock.RLock()
+	enabled, ok := overrides[p]
+	overridesLock.RUnlock()
+	if ok {
+		return enabled
+	}
+	if !key("enable").MustBool(false) {
+		return false
+	}
+	patterns := key("paths").Strings(",")
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Enable turns recording of path on or off, a running pusher is attached or detached at once
+func Enable(p string, enable bool) {
+	overridesLock.Lock()
+	overrides[p] = enable
+	overridesLock.Unlock()
+	pusher := rtsp.GetServer().GetPusher(p)
+	if pusher == nil {
+		return
+	}
+	if enable {
+		attach(pusher)
+	} else {
+		pusher.RemoveSink(SinkID)
+	}
+}
+
+// Recording reports whether the pusher of path is being recorded
+func Recording(p string) bool {
+	pusher := rtsp.GetServer().GetPusher(p)
+	return pusher != nil && pusher.GetSink(SinkID) != nil
+}
+
+func attach(pusher *rtsp.Pusher) {
+	recorder := NewRecorder(pusher, Dir(),
+		key("file_layout").MustString("{path}/{date}/{time}.mp4"),
+		time.Duration(key("segment_duration").MustInt(60))*time.Second)
+	if pusher.AddSink(SinkID, recorder) {
+		go recorder.Start()
+	}
+}
+
+// ErrOutsideDir is returned for paths that leave the record dir
+var ErrOutsideDir = errors.New("path outside record dir")
+
+// cleanPath resolves the ../ of a stream or api path, so that it can't leave
+// the record dir once joined, and trims its slashes
+func cleanPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// inDir reports whether name is dir or inside it
+func inDir(dir, name string) bool {
+	rel, err := filepath.Rel(dir, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Files lists recorded files, of the path when not empty, oldest first
+func Files(p string) (files []File, err error) {
+	files = make([]File, 0)
+	dir := Dir()
+	root := dir
+	if p = cleanPath(p); p != "" {
+		root = filepath.Join(dir, filepath.FromSlash(p))
+		if !inDir(dir, root) {
+			return nil, ErrOutsideDir
+		}
+	}
+	err = filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || filepath.Ext(name) != ".mp4" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{
+			Name:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime.Before(files[j].ModTime)
+	})
+	return
+}
+
+func cleanup(retention time.Duration) {
+	files, err := Files("")
+	if err != nil {
+		log.Printf("record cleanup failed, %v", err)
+		return
+	}
+	for _, f := range files {
+		if time.Since(f.ModTime) < retention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(Dir(), filepath.FromSlash(f.Name))); err != nil {
+			log.Printf("record cleanup failed, %v", err)
+		}
+	}
+}
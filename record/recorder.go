@@ -0,0 +1,245 @@
+package record
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tectiv3/edrtsp/codec"
+	"github.com/tectiv3/edrtsp/mp4"
+	"github.com/tectiv3/edrtsp/rtsp"
+)
+
+// Recorder a pusher sink writing the stream into fragmented mp4 files.
+// A file starts on a video keyframe and is rotated on the first keyframe
+// after SegmentDuration, audio only streams rotate on any frame.
+type Recorder struct {
+	Path            string
+	Dir             string
+	Layout          string
+	SegmentDuration time.Duration
+
+	logger   *log.Logger
+	pusher   *rtsp.Pusher
+	queue    chan *rtsp.RTPPack
+	quit     chan struct{}
+	stopOnce sync.Once
+	dropped  int
+
+	sdpRaw       string
+	depacketizer *rtsp.Depacketizer
+	muxer        *mp4.Muxer
+	video        *mp4.Track
+	audio        *mp4.Track
+	file         *os.File
+	fileStart    time.Duration
+	unsupported  bool
+}
+
+// fragments are flushed on keyframes or when this much is buffered
+const maxFragmentDuration = 2 * time.Second
+
+func NewRecorder(pusher *rtsp.Pusher, dir, layout string, segmentDuration time.Duration) *Recorder {
+	return &Recorder{
+		Path:            pusher.Path(),
+		Dir:             dir,
+		Layout:          layout,
+		SegmentDuration: segmentDuration,
+		logger:          log.New(os.Stdout, "[Recorder]", log.LstdFlags|log.Lshortfile),
+		pusher:          pusher,
+		queue:           make(chan *rtsp.RTPPack, 2048),
+		quit:            make(chan struct{}),
+	}
+}
+
+// QueueRTP queues pack to be written, drops it when the writer falls behind
+func (r *Recorder) QueueRTP(pack *rtsp.RTPPack) {
+	select {
+	case r.queue <- pack:
+	default:
+		r.dropped++
+		if r.dropped%1000 == 1 {
+			r.logger.Printf("%s recorder queue full, %d packets dropped", r.Path, r.dropped)
+		}
+	}
+}
+
+// Stop closes the current file
+func (r *Recorder) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.quit)
+	})
+}
+
+func (r *Recorder) Start() {
+	r.logger.Printf("%s record start", r.Path)
+	defer func() {
+		r.closeFile()
+		r.logger.Printf("%s record stop", r.Path)
+	}()
+	for {
+		select {
+		case pack := <-r.queue:
+			r.handleRTP(pack)
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+func (r *Recorder) handleRTP(pack *rtsp.RTPPack) {
+	if sdpRaw := r.pusher.SDPRaw(); r.depacketizer == nil || sdpRaw != r.sdpRaw {
+		// new or rebound source, codecs may have changed
+		r.closeFile()
+		r.sdpRaw = sdpRaw
+		r.depacketizer = rtsp.NewDepacketizer(sdpRaw)
+		r.unsupported = false
+	}
+	for _, frame := range r.depacketizer.Decode(pack) {
+		if err := r.writeFrame(frame); err != nil {
+			r.logger.Printf("%s record failed, %v", r.Path, err)
+			r.closeFile()
+		}
+	}
+}
+
+func (r *Recorder) hasVideo() bool {
+	v := r.depacketizer.VCodec
+	return v == "h264" || v == "h265"
+}
+
+func (r *Recorder) writeFrame(frame *rtsp.Frame) (err error) {
+	d := r.depacketizer
+	if !d.Ready() || r.unsupported {
+		return
+	}
+	isVideo := frame.Type == rtsp.RTP_TYPE_VIDEO
+	// every file starts with, and rotates at, a video keyframe when there is video
+	boundary := isVideo && frame.KeyFrame || !r.hasVideo()
+	if r.file != nil && boundary && frame.PTS-r.fileStart >= r.SegmentDuration {
+		r.closeFile()
+	}
+	if r.file == nil {
+		if !boundary {
+			return
+		}
+		if err = r.openFile(frame.PTS); err != nil || r.file == nil {
+			return
+		}
+	}
+	track := r.audio
+	data := frame.Data
+	if isVideo {
+		track = r.video
+		data = codec.AVCC(frame.NALUs)
+	}
+	if track == nil {
+		return
+	}
+	r.muxer.WriteSample(track, frame.PTS, data, frame.KeyFrame)
+	if isVideo && frame.KeyFrame || r.muxer.Buffered(track) > maxFragmentDuration {
+		err = r.writeFragment(false)
+	}
+	return
+}
+
+func (r *Recorder) openFile(pts time.Duration) (err error) {
+	d := r.depacketizer
+	r.video, r.audio = nil, nil
+	tracks := make([]*mp4.Track, 0)
+	if r.hasVideo() {
+		if r.video, err = mp4.NewVideoTrack(1, d.VCodec, d.VPS, d.SPS, d.PPS); err != nil {
+			return
+		}
+		tracks = append(tracks, r.video)
+	}
+	if d.ACodec == "aac" && d.AACConfig != nil {
+		r.audio = mp4.NewAudioTrack(2, d.AACConfig)
+		tracks = append(tracks, r.audio)
+	}
+	if len(tracks) == 0 {
+		r.unsupported = true
+		r.logger.Printf("%s record skipped, no supported codec in video[%s] audio[%s]", r.Path, d.VCodec, d.ACodec)
+		return
+	}
+	r.muxer = mp4.NewMuxer(tracks...)
+	init, err := r.muxer.InitSegment()
+	if err != nil {
+		return
+	}
+	name := filepath.Join(r.Dir, FileName(r.Layout, r.Path, time.Now()))
+	if !inDir(r.Dir, name) {
+		return ErrOutsideDir
+	}
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return
+	}
+	file, name, err := createFile(name)
+	if err != nil {
+		return
+	}
+	if _, err = file.Write(init); err != nil {
+		file.Close()
+		return
+	}
+	r.file = file
+	r.fileStart = pts
+	r.logger.Printf("%s record to %s", r.Path, name)
+	return
+}
+
+func (r *Recorder) writeFragment(final bool) (err error) {
+	fragment := r.muxer.Fragment(final)
+	if fragment == nil {
+		return
+	}
+	_, err = r.file.Write(fragment)
+	return
+}
+
+func (r *Recorder) closeFile() {
+	if r.file == nil {
+		return
+	}
+	if err := r.writeFragment(true); err != nil {
+		r.logger.Printf("%s record failed, %v", r.Path, err)
+	}
+	r.file.Close()
+	r.file = nil
+	r.muxer = nil
+}
+
+// createFile creates name, or name-1, name-2 and so on when a segment started
+// within the same second exists already
+func createFile(name string) (file *os.File, created string, err error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	created = name
+	for i := 1; ; i++ {
+		file, err = os.OpenFile(created, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+		if !os.IsExist(err) || i > 1000 {
+			return
+		}
+		created = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
+
+// FileName expands {path}, {date} and {time} of layout
+func FileName(layout, p string, t time.Time) string {
+	if p = cleanPath(p); p == "" {
+		p = "_"
+	}
+	name := strings.NewReplacer(
+		"{path}", p,
+		"{date}", t.Format("2006-01-02"),
+		"{time}", t.Format("150405"),
+	).Replace(layout)
+	if filepath.Ext(name) == "" {
+		name += ".mp4"
+	}
+	return filepath.FromSlash(name)
+}
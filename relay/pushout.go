@@ -0,0 +1,208 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tectiv3/edrtsp/rtsp"
+)
+
+// relay states
+const (
+	STATUS_WAITING    = "waiting" // no pusher on the path
+	STATUS_CONNECTING = "connecting"
+	STATUS_PUSHING    = "pushing"
+	STATUS_ERROR      = "error" // retried after retry_interval
+)
+
+var relaySeq uint64
+
+// Relay republishes a local path to a remote rtsp server with
+// ANNOUNCE/SETUP/RECORD, reconnecting until stopped
+type Relay struct {
+	ID        string
+	Path      string
+	URL       string
+	TransType rtsp.TransType
+	StartAt   time.Time
+
+	server   *rtsp.Server
+	logger   *log.Logger
+	lock     sync.RWMutex
+	status   string
+	err      error
+	outBytes int
+	wake     chan struct{}
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+func newRelay(server *rtsp.Server, path, url string, transType rtsp.TransType) *Relay {
+	return &Relay{
+		ID:        fmt.Sprintf("%d", atomic.AddUint64(&relaySeq, 1)),
+		Path:      path,
+		URL:       url,
+		TransType: transType,
+		StartAt:   time.Now(),
+		server:    server,
+		logger:    log.New(os.Stdout, fmt.Sprintf("[relay %s]", path), log.LstdFlags|log.Lshortfile),
+		status:    STATUS_WAITING,
+		wake:      make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+	}
+}
+
+// Status gets state and last error of the relay
+func (relay *Relay) Status() (status string, err error) {
+	relay.lock.RLock()
+	defer relay.lock.RUnlock()
+	return relay.status, relay.err
+}
+
+// OutBytes gets bytes pushed since the relay was added
+func (relay *Relay) OutBytes() int {
+	relay.lock.RLock()
+	defer relay.lock.RUnlock()
+	return relay.outBytes
+}
+
+func (relay *Relay) setStatus(status string, err error) {
+	relay.lock.Lock()
+	relay.status, relay.err = status, err
+	relay.lock.Unlock()
+	if err != nil {
+		relay.logger.Printf("%s, %v", status, err)
+	} else {
+		relay.logger.Println(status)
+	}
+}
+
+func (relay *Relay) Stop() {
+	relay.stopOnce.Do(func() {
+		close(relay.quit)
+	})
+}
+
+func (relay *Relay) wakeup() {
+	select {
+	case relay.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (relay *Relay) run() {
+	retry := time.Duration(key("retry_interval").MustInt(5)) * time.Second
+	for {
+		wait := retry
+		if pusher := relay.server.GetPusher(relay.Path); pusher == nil {
+			relay.setStatus(STATUS_WAITING, nil)
+			wait = time.Minute
+		} else if err := relay.push(pusher); err != nil {
+			relay.setStatus(STATUS_ERROR, err)
+		} else {
+			relay.setStatus(STATUS_WAITING, nil)
+		}
+		select {
+		case <-relay.quit:
+			return
+		case <-relay.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// push forwards packets of pusher, starting with its GOP cache, until the
+// connection fails, the pusher goes away or the relay is stopped
+func (relay *Relay) push(pusher *rtsp.Pusher) (err error) {
+	relay.setStatus(STATUS_CONNECTING, nil)
+	client, err := rtsp.NewRTSPClient(relay.server, relay.URL, 0, relay.server.Agent)
+	if err != nil {
+		return
+	}
+	client.TransType = relay.TransType
+	defer client.Stop()
+	sink := newSink()
+	// closed before the sink stops when the connection goes away
+	closed := make(chan struct{})
+	var closeOnce sync.Once
+	client.StopHandles = append(client.StopHandles, func() {
+		closeOnce.Do(func() { close(closed) })
+	}, sink.Stop)
+	sdpRaw := pusher.SDPRaw()
+	if err = client.StartPush(0, sdpRaw); err != nil {
+		return
+	}
+	if !pusher.AddSink("relay-"+relay.ID, sink) {
+		return fmt.Errorf("relay sink exists")
+	}
+	defer pusher.RemoveSink("relay-" + relay.ID)
+	relay.setStatus(STATUS_PUSHING, nil)
+	heartbeat := time.NewTicker(time.Duration(key("heartbeat_interval").MustInt(30)) * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case pack := <-sink.queue:
+			if pusher.SDPRaw() != sdpRaw {
+				return fmt.Errorf("source of %s changed", relay.Path)
+			}
+			outBytes := client.OutBytes
+			if err = client.WriteRTP(pack); err != nil {
+				return
+			}
+			relay.lock.Lock()
+			relay.outBytes += client.OutBytes - outBytes
+			relay.lock.Unlock()
+		case <-heartbeat.C:
+			if err = client.RequestNoResp("OPTIONS", map[string]string{}); err != nil {
+				return
+			}
+		case <-sink.quit:
+			select {
+			case <-closed:
+				return fmt.Errorf("connection to %s closed", relay.URL)
+			default:
+			}
+			if relay.server.GetPusher(relay.Path) == pusher {
+				return fmt.Errorf("%s can't keep up", relay.URL)
+			}
+			return
+		case <-relay.quit:
+			client.RequestNoResp("TEARDOWN", map[string]string{})
+			return
+		}
+	}
+}
+
+// sink queues packets of a pusher for the relay loop
+type sink struct {
+	queue    chan *rtsp.RTPPack
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+func newSink() *sink {
+	return &sink{
+		queue: make(chan *rtsp.RTPPack, 2048),
+		quit:  make(chan struct{}),
+	}
+}
+
+// QueueRTP queues pack, the connection is restarted when the remote server
+// can't keep up since dropping packets would corrupt the stream
+func (s *sink) QueueRTP(pack *rtsp.RTPPack) {
+	select {
+	case s.queue <- pack:
+	default:
+		s.Stop()
+	}
+}
+
+func (s *sink) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.quit)
+	})
+}
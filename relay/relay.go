@@ -0,0 +1,80 @@
+package relay
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/go-ini/ini"
+	"github.com/tectiv3/edrtsp/rtsp"
+	"github.com/tectiv3/edrtsp/utils"
+)
+
+var (
+	server     *rtsp.Server
+	relays     = make(map[string]*Relay) // ID <-> Relay
+	relaysLock sync.RWMutex
+)
+
+// key gets key from [relay] config section
+func key(name string) *ini.Key {
+	return utils.Conf().Section("relay").Key(name)
+}
+
+// Start lets relays push as soon as their path gets a pusher
+func Start(s *rtsp.Server) {
+	server = s
+	server.AddPusherHandles = append(server.AddPusherHandles, func(pusher *rtsp.Pusher) {
+		relaysLock.RLock()
+		defer relaysLock.RUnlock()
+		for _, relay := range relays {
+			if relay.Path == pusher.Path() {
+				relay.wakeup()
+			}
+		}
+	})
+}
+
+// Add starts pushing path to url, it keeps retrying until removed
+func Add(path, url string, transType rtsp.TransType) (relay *Relay, err error) {
+	if server == nil {
+		return nil, fmt.Errorf("relay not started")
+	}
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+	for _, v := range relays {
+		if v.Path == path && v.URL == url {
+			return nil, fmt.Errorf("%s is relayed to %s already", path, url)
+		}
+	}
+	relay = newRelay(server, path, url, transType)
+	relays[relay.ID] = relay
+	go relay.run()
+	return
+}
+
+// Remove stops the relay with id
+func Remove(id string) bool {
+	relaysLock.Lock()
+	relay, ok := relays[id]
+	delete(relays, id)
+	relaysLock.Unlock()
+	if ok {
+		relay.Stop()
+	}
+	return ok
+}
+
+// Relays gets relays ordered by start time
+func Relays() []*Relay {
+	relaysLock.RLock()
+	list := make([]*Relay, 0, len(relays))
+	for _, v := range relays {
+		list = append(list, v)
+	}
+	relaysLock.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartAt.Before(list[j].StartAt)
+	})
+	return list
+}
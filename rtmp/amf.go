@@ -0,0 +1,207 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	AMF0_NUMBER       = 0x00
+	AMF0_BOOLEAN      = 0x01
+	AMF0_STRING       = 0x02
+	AMF0_OBJECT       = 0x03
+	AMF0_NULL         = 0x05
+	AMF0_UNDEFINED    = 0x06
+	AMF0_ECMA_ARRAY   = 0x08
+	AMF0_OBJECT_END   = 0x09
+	AMF0_STRICT_ARRAY = 0x0a
+	AMF0_DATE         = 0x0b
+	AMF0_LONG_STRING  = 0x0c
+)
+
+// Object an amf0 object or ecma array
+type Object map[string]interface{}
+
+// String gets a string property, "" when missing
+func (o Object) String(key string) string {
+	s, _ := o[key].(string)
+	return s
+}
+
+// Number gets a number property, 0 when missing
+func (o Object) Number(key string) float64 {
+	n, _ := o[key].(float64)
+	return n
+}
+
+// DecodeAMF0 decodes all values of data, numbers are float64, objects Object
+func DecodeAMF0(data []byte) (values []interface{}, err error) {
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		var v interface{}
+		if v, err = decodeValue(r); err != nil {
+			return
+		}
+		values = append(values, v)
+	}
+	return
+}
+
+func decodeValue(r *bytes.Reader) (v interface{}, err error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	switch marker {
+	case AMF0_NUMBER:
+		var n uint64
+		err = binary.Read(r, binary.BigEndian, &n)
+		v = math.Float64frombits(n)
+	case AMF0_BOOLEAN:
+		var b byte
+		b, err = r.ReadByte()
+		v = b != 0
+	case AMF0_STRING:
+		v, err = decodeString(r, 2)
+	case AMF0_LONG_STRING:
+		v, err = decodeString(r, 4)
+	case AMF0_OBJECT:
+		v, err = decodeObject(r)
+	case AMF0_ECMA_ARRAY:
+		if _, err = r.Seek(4, io.SeekCurrent); err == nil {
+			v, err = decodeObject(r)
+		}
+	case AMF0_STRICT_ARRAY:
+		var n uint32
+		if err = binary.Read(r, binary.BigEndian, &n); err != nil {
+			return
+		}
+		list := make([]interface{}, 0)
+		for i := uint32(0); i < n; i++ {
+			var item interface{}
+			if item, err = decodeValue(r); err != nil {
+				return
+			}
+			list = append(list, item)
+		}
+		v = list
+	case AMF0_DATE:
+		var n uint64
+		err = binary.Read(r, binary.BigEndian, &n)
+		v = math.Float64frombits(n)
+		r.Seek(2, io.SeekCurrent)
+	case AMF0_NULL, AMF0_UNDEFINED:
+	default:
+		err = fmt.Errorf("amf0 marker 0x%02x not supported", marker)
+	}
+	return
+}
+
+func decodeString(r *bytes.Reader, lenSize int) (s string, err error) {
+	var n int
+	if lenSize == 2 {
+		var l uint16
+		err = binary.Read(r, binary.BigEndian, &l)
+		n = int(l)
+	} else {
+		var l uint32
+		err = binary.Read(r, binary.BigEndian, &l)
+		n = int(l)
+	}
+	if err != nil {
+		return
+	}
+	if n > r.Len() {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	s = string(b)
+	return
+}
+
+func decodeObject(r *bytes.Reader) (o Object, err error) {
+	o = make(Object)
+	for {
+		var key string
+		if key, err = decodeString(r, 2); err != nil {
+			return
+		}
+		if key == "" {
+			var marker byte
+			if marker, err = r.ReadByte(); err != nil || marker == AMF0_OBJECT_END {
+				return
+			}
+			r.UnreadByte()
+		}
+		var v interface{}
+		if v, err = decodeValue(r); err != nil {
+			return
+		}
+		o[key] = v
+	}
+}
+
+// EncodeAMF0 encodes values, supports numbers, bool, string, nil, Object and []interface{}
+func EncodeAMF0(values ...interface{}) []byte {
+	var b bytes.Buffer
+	for _, v := range values {
+		encodeValue(&b, v)
+	}
+	return b.Bytes()
+}
+
+func encodeValue(b *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case float64:
+		b.WriteByte(AMF0_NUMBER)
+		binary.Write(b, binary.BigEndian, math.Float64bits(v))
+	case int:
+		encodeValue(b, float64(v))
+	case uint32:
+		encodeValue(b, float64(v))
+	case bool:
+		b.WriteByte(AMF0_BOOLEAN)
+		if v {
+			b.WriteByte(1)
+		} else {
+			b.WriteByte(0)
+		}
+	case string:
+		if len(v) > 0xffff {
+			b.WriteByte(AMF0_LONG_STRING)
+			binary.Write(b, binary.BigEndian, uint32(len(v)))
+		} else {
+			b.WriteByte(AMF0_STRING)
+			binary.Write(b, binary.BigEndian, uint16(len(v)))
+		}
+		b.WriteString(v)
+	case Object:
+		b.WriteByte(AMF0_OBJECT)
+		// sorted keys keep the encoding stable
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			binary.Write(b, binary.BigEndian, uint16(len(k)))
+			b.WriteString(k)
+			encodeValue(b, v[k])
+		}
+		b.Write([]byte{0, 0, AMF0_OBJECT_END})
+	case []interface{}:
+		b.WriteByte(AMF0_STRICT_ARRAY)
+		binary.Write(b, binary.BigEndian, uint32(len(v)))
+		for _, item := range v {
+			encodeValue(b, item)
+		}
+	default:
+		b.WriteByte(AMF0_NULL)
+	}
+}
@@ -0,0 +1,378 @@
+package rtmp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	MSG_SET_CHUNK_SIZE     = 1
+	MSG_ABORT              = 2
+	MSG_ACK                = 3
+	MSG_USER_CONTROL       = 4
+	MSG_WINDOW_ACK_SIZE    = 5
+	MSG_SET_PEER_BANDWIDTH = 6
+	MSG_AUDIO              = 8
+	MSG_VIDEO              = 9
+	MSG_AMF3_DATA          = 15
+	MSG_AMF3_COMMAND       = 17
+	MSG_AMF0_DATA          = 18
+	MSG_AMF0_COMMAND       = 20
+)
+
+// chunk stream ids of messages we send
+const (
+	CSID_CONTROL = 2
+	CSID_COMMAND = 3
+	CSID_DATA    = 5
+	CSID_AUDIO   = 6
+	CSID_VIDEO   = 7
+)
+
+const (
+	USER_CONTROL_STREAM_BEGIN  = 0
+	USER_CONTROL_STREAM_EOF    = 1
+	USER_CONTROL_PING_REQUEST  = 6
+	USER_CONTROL_PING_RESPONSE = 7
+)
+
+const handshakeSize = 1536
+
+const (
+	MAX_MESSAGE_SIZE  = 4 << 20 // larger messages are refused, keyframes stay well below
+	MAX_CHUNK_STREAMS = 64      // chunk streams a peer may have open at once
+)
+
+// Message an rtmp message
+type Message struct {
+	Type      uint8
+	StreamID  uint32
+	Timestamp uint32
+	Payload   []byte
+}
+
+type chunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typ       uint8
+	streamID  uint32
+	extended  bool
+	payload   []byte
+}
+
+// Conn an rtmp connection speaking the chunk stream protocol
+type Conn struct {
+	net.Conn
+	r              *bufio.Reader
+	w              *bufio.Writer
+	wlock          sync.Mutex
+	readChunkSize  int
+	writeChunkSize int
+	chunks         map[uint32]*chunkStream
+
+	windowAckSize uint32 // set by the peer, acks are due every that many bytes
+	InBytes       uint64
+	OutBytes      uint64
+	lastAck       uint64
+	ReadTimeout   time.Duration // 0 for players, which may stay silent
+	WriteTimeout  time.Duration
+}
+
+func NewConn(conn net.Conn, timeout time.Duration) *Conn {
+	return &Conn{
+		Conn:           conn,
+		r:              bufio.NewReaderSize(conn, 65536),
+		w:              bufio.NewWriterSize(conn, 65536),
+		readChunkSize:  128,
+		writeChunkSize: 128,
+		chunks:         make(map[uint32]*chunkStream),
+		ReadTimeout:    timeout,
+		WriteTimeout:   timeout,
+	}
+}
+
+func (c *Conn) Read(b []byte) (n int, err error) {
+	if c.ReadTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+	}
+	n, err = c.r.Read(b)
+	c.InBytes += uint64(n)
+	return
+}
+
+// ServerHandshake answers a simple handshake, clients validating a digest
+// handshake are not supported
+func (c *Conn) ServerHandshake() (err error) {
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err = io.ReadFull(c, c0c1); err != nil {
+		return
+	}
+	if c0c1[0] != 3 {
+		return fmt.Errorf("rtmp version %d not supported", c0c1[0])
+	}
+	s0s1s2 := make([]byte, 1+2*handshakeSize)
+	s0s1s2[0] = 3
+	binary.BigEndian.PutUint32(s0s1s2[1:], uint32(time.Now().Unix()))
+	rand.Read(s0s1s2[9 : 1+handshakeSize])
+	copy(s0s1s2[1+handshakeSize:], c0c1[1:])
+	if err = c.write(s0s1s2); err != nil {
+		return
+	}
+	c2 := make([]byte, handshakeSize)
+	_, err = io.ReadFull(c, c2)
+	return
+}
+
+func (c *Conn) write(b []byte) (err error) {
+	if c.WriteTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	}
+	if _, err = c.w.Write(b); err != nil {
+		return
+	}
+	c.OutBytes += uint64(len(b))
+	return c.w.Flush()
+}
+
+// ReadMessage reads the next message, protocol control messages are handled here
+func (c *Conn) ReadMessage() (msg *Message, err error) {
+	for {
+		if msg, err = c.readChunk(); err != nil || msg == nil {
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if c.windowAckSize > 0 && c.InBytes-c.lastAck >= uint64(c.windowAckSize) {
+			c.lastAck = c.InBytes
+			if err = c.WriteControl(MSG_ACK, uint32(c.InBytes)); err != nil {
+				return
+			}
+		}
+		switch msg.Type {
+		case MSG_SET_CHUNK_SIZE:
+			if len(msg.Payload) < 4 {
+				return nil, fmt.Errorf("invalid set chunk size")
+			}
+			size := binary.BigEndian.Uint32(msg.Payload)
+			if size < 1 || size > 0x7fffffff {
+				return nil, fmt.Errorf("invalid chunk size %d", size)
+			}
+			c.readChunkSize = int(size)
+		case MSG_ABORT:
+			if len(msg.Payload) >= 4 {
+				delete(c.chunks, binary.BigEndian.Uint32(msg.Payload))
+			}
+		case MSG_WINDOW_ACK_SIZE:
+			if len(msg.Payload) >= 4 {
+				c.windowAckSize = binary.BigEndian.Uint32(msg.Payload)
+			}
+		case MSG_ACK, MSG_SET_PEER_BANDWIDTH:
+		case MSG_USER_CONTROL:
+			if len(msg.Payload) >= 6 && binary.BigEndian.Uint16(msg.Payload) == USER_CONTROL_PING_REQUEST {
+				if err = c.WriteUserControl(USER_CONTROL_PING_RESPONSE, binary.BigEndian.Uint32(msg.Payload[2:])); err != nil {
+					return
+				}
+			}
+		default:
+			return
+		}
+	}
+}
+
+// readChunk reads one chunk, returns the message it completes
+func (c *Conn) readChunk() (msg *Message, err error) {
+	b, err := c.readByte()
+	if err != nil {
+		return
+	}
+	format := b >> 6
+	csid := uint32(b & 0x3f)
+	switch csid {
+	case 0:
+		var b1 byte
+		if b1, err = c.readByte(); err != nil {
+			return
+		}
+		csid = 64 + uint32(b1)
+	case 1:
+		buf := make([]byte, 2)
+		if _, err = io.ReadFull(c, buf); err != nil {
+			return
+		}
+		csid = 64 + uint32(buf[0]) + uint32(buf[1])*256
+	}
+	cs, ok := c.chunks[csid]
+	if !ok {
+		if format != 0 {
+			return nil, fmt.Errorf("chunk stream %d starts with format %d", csid, format)
+		}
+		if len(c.chunks) >= MAX_CHUNK_STREAMS {
+			return nil, fmt.Errorf("too many chunk streams")
+		}
+		cs = &chunkStream{}
+		c.chunks[csid] = cs
+	}
+	headerSize := []int{11, 7, 3, 0}[format]
+	header := make([]byte, headerSize)
+	if _, err = io.ReadFull(c, header); err != nil {
+		return
+	}
+	var ts uint32
+	if format < 3 {
+		ts = uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+		cs.extended = ts == 0xffffff
+	}
+	if format < 2 {
+		length := uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+		if len(cs.payload) > 0 && length != cs.length {
+			// the partial payload belongs to the message of the previous length
+			return nil, fmt.Errorf("chunk stream %d length changed from %d to %d mid-message", csid, cs.length, length)
+		}
+		if length > MAX_MESSAGE_SIZE {
+			return nil, fmt.Errorf("chunk stream %d message of %d bytes too large", csid, length)
+		}
+		cs.length = length
+		cs.typ = header[6]
+	}
+	if format == 0 {
+		cs.streamID = binary.LittleEndian.Uint32(header[7:])
+	}
+	if cs.extended {
+		buf := make([]byte, 4)
+		if _, err = io.ReadFull(c, buf); err != nil {
+			return
+		}
+		if format < 3 {
+			ts = binary.BigEndian.Uint32(buf)
+		}
+	}
+	switch format {
+	case 0:
+		cs.timestamp = ts
+		cs.delta = 0
+	case 1, 2:
+		cs.delta = ts
+		cs.timestamp += ts
+	case 3:
+		if len(cs.payload) == 0 {
+			// a new message repeating the previous header
+			cs.timestamp += cs.delta
+		}
+	}
+	n := int(cs.length) - len(cs.payload)
+	if n > c.readChunkSize {
+		n = c.readChunkSize
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("chunk stream %d length mismatch", csid)
+	}
+	// grown as chunks arrive, a peer announcing a length pays for it first
+	start := len(cs.payload)
+	cs.payload = append(cs.payload, make([]byte, n)...)
+	if _, err = io.ReadFull(c, cs.payload[start:]); err != nil {
+		return
+	}
+	if len(cs.payload) < int(cs.length) {
+		return
+	}
+	msg = &Message{
+		Type:      cs.typ,
+		StreamID:  cs.streamID,
+		Timestamp: cs.timestamp,
+		Payload:   cs.payload,
+	}
+	cs.payload = nil
+	return
+}
+
+func (c *Conn) readByte() (b byte, err error) {
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(c, buf)
+	return buf[0], err
+}
+
+// WriteMessage writes msg in chunks of csid, safe for concurrent use
+func (c *Conn) WriteMessage(csid uint32, msg *Message) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	ts := msg.Timestamp
+	extended := ts >= 0xffffff
+	if extended {
+		ts = 0xffffff
+	}
+	size := len(msg.Payload)
+	buf := make([]byte, 0, 16+size+size/c.writeChunkSize*(1+4))
+	buf = append(buf, chunkBasicHeader(0, csid)...)
+	buf = append(buf, byte(ts>>16), byte(ts>>8), byte(ts))
+	buf = append(buf, byte(size>>16), byte(size>>8), byte(size), msg.Type)
+	sid := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sid, msg.StreamID)
+	buf = append(buf, sid...)
+	extTS := make([]byte, 4)
+	binary.BigEndian.PutUint32(extTS, msg.Timestamp)
+	if extended {
+		buf = append(buf, extTS...)
+	}
+	for off := 0; off < size; off += c.writeChunkSize {
+		if off > 0 {
+			buf = append(buf, chunkBasicHeader(3, csid)...)
+			if extended {
+				buf = append(buf, extTS...)
+			}
+		}
+		end := off + c.writeChunkSize
+		if end > size {
+			end = size
+		}
+		buf = append(buf, msg.Payload[off:end]...)
+	}
+	return c.write(buf)
+}
+
+func chunkBasicHeader(format byte, csid uint32) []byte {
+	switch {
+	case csid < 64:
+		return []byte{format<<6 | byte(csid)}
+	case csid < 320:
+		return []byte{format << 6, byte(csid - 64)}
+	}
+	return []byte{format<<6 | 1, byte((csid - 64) & 0xff), byte((csid - 64) >> 8)}
+}
+
+// WriteControl writes a protocol control message with a 4 byte value
+func (c *Conn) WriteControl(typ uint8, value uint32, extra ...byte) error {
+	payload := make([]byte, 4, 4+len(extra))
+	binary.BigEndian.PutUint32(payload, value)
+	return c.WriteMessage(CSID_CONTROL, &Message{Type: typ, Payload: append(payload, extra...)})
+}
+
+func (c *Conn) WriteUserControl(event uint16, value uint32) error {
+	payload := make([]byte, 6)
+	binary.BigEndian.PutUint16(payload, event)
+	binary.BigEndian.PutUint32(payload[2:], value)
+	return c.WriteMessage(CSID_CONTROL, &Message{Type: MSG_USER_CONTROL, Payload: payload})
+}
+
+// SetChunkSize tells the peer and uses size for messages written from now on
+func (c *Conn) SetChunkSize(size int) (err error) {
+	if err = c.WriteControl(MSG_SET_CHUNK_SIZE, uint32(size)); err != nil {
+		return
+	}
+	c.wlock.Lock()
+	c.writeChunkSize = size
+	c.wlock.Unlock()
+	return
+}
+
+// WriteCommand writes an amf0 command or data message
+func (c *Conn) WriteCommand(csid, streamID uint32, values ...interface{}) error {
+	return c.WriteMessage(csid, &Message{Type: MSG_AMF0_COMMAND, StreamID: streamID, Payload: EncodeAMF0(values...)})
+}
@@ -0,0 +1,256 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/tectiv3/edrtsp/codec"
+	"github.com/tectiv3/edrtsp/flv"
+	"github.com/tectiv3/edrtsp/rtsp"
+)
+
+// messages kept while waiting for sequence headers announced by metadata
+const MAX_PENDING_MESSAGES = 300
+
+// publisher converts flv audio and video of an rtmp stream to rtp, the
+// pusher is added once the codecs are known
+type publisher struct {
+	session     *rtsp.Session
+	expectVideo bool
+	expectAudio bool
+	vcodec      string
+	vps         []byte
+	sps         []byte
+	pps         []byte
+	aacConfig   *codec.AACConfig
+	video       *rtsp.Packetizer
+	audio       *rtsp.Packetizer
+	pending     []*Message
+	started     bool
+}
+
+func newPublisher(session *rtsp.Session) *publisher {
+	return &publisher{session: session}
+}
+
+func (p *publisher) handle(msg *Message) (err error) {
+	switch msg.Type {
+	case MSG_AMF0_DATA:
+		p.onData(msg.Payload)
+		return
+	case MSG_VIDEO:
+		if isHeader, err := p.videoHeader(msg.Payload); isHeader || err != nil {
+			return err
+		}
+	case MSG_AUDIO:
+		if isHeader, err := p.audioHeader(msg.Payload); isHeader || err != nil {
+			return err
+		}
+	}
+	if p.started {
+		return p.feed(msg)
+	}
+	p.pending = append(p.pending, msg)
+	if !p.ready() && len(p.pending) < MAX_PENDING_MESSAGES {
+		return
+	}
+	if err = p.start(); err != nil {
+		return
+	}
+	pending := p.pending
+	p.pending = nil
+	for _, msg := range pending {
+		if err = p.feed(msg); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// onData reads codec ids of onMetaData to know which headers to wait for
+func (p *publisher) onData(payload []byte) {
+	values, err := DecodeAMF0(payload)
+	if err != nil {
+		return
+	}
+	for _, v := range values {
+		if meta, ok := v.(Object); ok {
+			if _, ok := meta["videocodecid"]; ok {
+				p.expectVideo = true
+			}
+			if _, ok := meta["audiocodecid"]; ok {
+				p.expectAudio = true
+			}
+		}
+	}
+}
+
+func (p *publisher) ready() bool {
+	if p.expectVideo && p.vcodec == "" || p.expectAudio && p.aacConfig == nil {
+		return false
+	}
+	return p.vcodec != "" || p.aacConfig != nil
+}
+
+// videoHeader handles avc and hevc sequence headers
+func (p *publisher) videoHeader(payload []byte) (isHeader bool, err error) {
+	if len(payload) < 5 || payload[1] != flv.PACKET_TYPE_SEQUENCE_HEADER {
+		return
+	}
+	isHeader = true
+	var vcodec string
+	var vps, sps, pps []byte
+	switch payload[0] & 0x0f {
+	case flv.VIDEO_CODEC_AVC:
+		vcodec = "h264"
+		sps, pps, err = codec.ParseAVCDecoderConfigurationRecord(payload[5:])
+	case flv.VIDEO_CODEC_HEVC:
+		vcodec = "h265"
+		vps, sps, pps, err = codec.ParseHEVCDecoderConfigurationRecord(payload[5:])
+	default:
+		return
+	}
+	if err == nil && len(sps) < 4 {
+		err = fmt.Errorf("sps too short")
+	}
+	if err != nil {
+		return isHeader, fmt.Errorf("invalid %s sequence header, %v", vcodec, err)
+	}
+	if p.vcodec == vcodec && bytes.Equal(p.vps, vps) && bytes.Equal(p.sps, sps) && bytes.Equal(p.pps, pps) {
+		return
+	}
+	if p.started && p.vcodec != vcodec {
+		return isHeader, fmt.Errorf("video codec changed from %s to %s", p.vcodec, vcodec)
+	}
+	p.vcodec, p.vps, p.sps, p.pps = vcodec, vps, sps, pps
+	if p.started {
+		p.updateSDP()
+	}
+	return
+}
+
+// audioHeader handles aac sequence headers
+func (p *publisher) audioHeader(payload []byte) (isHeader bool, err error) {
+	if len(payload) < 2 || payload[0]>>4 != flv.SOUND_FORMAT_AAC || payload[1] != flv.PACKET_TYPE_SEQUENCE_HEADER {
+		return
+	}
+	isHeader = true
+	config, err := codec.ParseAACConfig(payload[2:])
+	if err != nil {
+		return isHeader, fmt.Errorf("invalid aac sequence header, %v", err)
+	}
+	if p.aacConfig != nil && bytes.Equal(p.aacConfig.Bytes(), config.Bytes()) {
+		return
+	}
+	if p.started && p.audio == nil {
+		return isHeader, fmt.Errorf("audio added after publish started")
+	}
+	p.aacConfig = config
+	if p.started {
+		p.updateSDP()
+	}
+	return
+}
+
+// sdp describes the stream for rtsp players
+func (p *publisher) sdp() string {
+	var buf bytes.Buffer
+	buf.WriteString("v=0\r\n")
+	buf.WriteString("o=- 0 0 IN IP4 127.0.0.1\r\n")
+	buf.WriteString("s=" + p.session.Path + "\r\n")
+	buf.WriteString("c=IN IP4 0.0.0.0\r\n")
+	buf.WriteString("t=0 0\r\n")
+	switch p.vcodec {
+	case "h264":
+		buf.WriteString("m=video 0 RTP/AVP 96\r\n")
+		buf.WriteString("a=rtpmap:96 H264/90000\r\n")
+		buf.WriteString(fmt.Sprintf("a=fmtp:96 packetization-mode=1;profile-level-id=%s;sprop-parameter-sets=%s,%s\r\n",
+			hex.EncodeToString(p.sps[1:4]), base64.StdEncoding.EncodeToString(p.sps), base64.StdEncoding.EncodeToString(p.pps)))
+		buf.WriteString("a=control:streamid=0\r\n")
+	case "h265":
+		buf.WriteString("m=video 0 RTP/AVP 96\r\n")
+		buf.WriteString("a=rtpmap:96 H265/90000\r\n")
+		buf.WriteString(fmt.Sprintf("a=fmtp:96 sprop-vps=%s;sprop-sps=%s;sprop-pps=%s\r\n",
+			base64.StdEncoding.EncodeToString(p.vps), base64.StdEncoding.EncodeToString(p.sps), base64.StdEncoding.EncodeToString(p.pps)))
+		buf.WriteString("a=control:streamid=0\r\n")
+	}
+	if p.aacConfig != nil {
+		buf.WriteString("m=audio 0 RTP/AVP 97\r\n")
+		buf.WriteString(fmt.Sprintf("a=rtpmap:97 MPEG4-GENERIC/%d/%d\r\n", p.aacConfig.SampleRate, p.aacConfig.Channels))
+		buf.WriteString(fmt.Sprintf("a=fmtp:97 streamtype=5;profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=%s\r\n",
+			hex.EncodeToString(p.aacConfig.Bytes())))
+		buf.WriteString("a=control:streamid=1\r\n")
+	}
+	return buf.String()
+}
+
+func (p *publisher) updateSDP() {
+	session := p.session
+	session.SDPRaw = p.sdp()
+	session.SDPMap = rtsp.ParseSDP(session.SDPRaw)
+	if sdp, ok := session.SDPMap["video"]; ok {
+		session.VControl = sdp.Control
+		session.VCodec = sdp.Codec
+	}
+	if sdp, ok := session.SDPMap["audio"]; ok {
+		session.AControl = sdp.Control
+		session.ACodec = sdp.Codec
+	}
+}
+
+// start adds the pusher to the rtsp server
+func (p *publisher) start() error {
+	if p.vcodec == "" && p.aacConfig == nil {
+		return fmt.Errorf("no supported audio or video in %s", p.session.Path)
+	}
+	p.updateSDP()
+	if p.vcodec != "" {
+		p.video = rtsp.NewPacketizer(rtsp.RTP_TYPE_VIDEO, p.vcodec, 96)
+	}
+	if p.aacConfig != nil {
+		p.audio = rtsp.NewPacketizer(rtsp.RTP_TYPE_AUDIO, "aac", 97)
+	}
+	session := p.session
+	session.Pusher = rtsp.NewPusher(session)
+	if !session.Server.AddPusher(session.Pusher) {
+		return fmt.Errorf("add pusher %s failed", session.Path)
+	}
+	p.started = true
+	return nil
+}
+
+// feed converts a coded frame to rtp packets of the pusher
+func (p *publisher) feed(msg *Message) (err error) {
+	var packs []*rtsp.RTPPack
+	payload := msg.Payload
+	switch msg.Type {
+	case MSG_VIDEO:
+		if p.video == nil || len(payload) < 5 || payload[1] != flv.PACKET_TYPE_NALU {
+			return
+		}
+		cts := int32(uint32(payload[2])<<16|uint32(payload[3])<<8|uint32(payload[4])) << 8 >> 8
+		nalus, err := codec.SplitAVCC(payload[5:])
+		if err != nil {
+			return fmt.Errorf("invalid video frame, %v", err)
+		}
+		keyFrame := payload[0]>>4 == 1
+		ts := uint32(int64(msg.Timestamp)+int64(cts)) * 90
+		packs = p.video.Video(ts, nalus, keyFrame, p.vps, p.sps, p.pps)
+	case MSG_AUDIO:
+		if p.audio == nil || len(payload) < 2 || payload[0]>>4 != flv.SOUND_FORMAT_AAC || payload[1] != flv.PACKET_TYPE_RAW {
+			return
+		}
+		ts := uint32(uint64(msg.Timestamp) * uint64(p.aacConfig.SampleRate) / 1000)
+		packs = append(packs, p.audio.AAC(ts, payload[2:]))
+	}
+	session := p.session
+	for _, pack := range packs {
+		session.InBytes += pack.Buffer.Len()
+		for _, h := range session.RTPHandles {
+			h(pack)
+		}
+	}
+	return
+}
@@ -0,0 +1,75 @@
+package rtmp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/tectiv3/edrtsp/rtsp"
+	"github.com/tectiv3/edrtsp/utils"
+)
+
+// Server rtmp server, published streams become pushers of the rtsp server
+// and its pushers can be played
+type Server struct {
+	logger     *log.Logger
+	Listener   net.Listener
+	Port       int
+	RTSPServer *rtsp.Server
+	Stoped     bool
+}
+
+var instance = &Server{
+	logger:     log.New(os.Stdout, "[RTMPServer]", log.LstdFlags|log.Lshortfile),
+	Port:       1935,
+	RTSPServer: rtsp.GetServer(),
+	Stoped:     true,
+}
+
+// GetServer get instance
+func GetServer() *Server {
+	return instance
+}
+
+// key gets key from [rtmp] config section
+func key(name string) *ini.Key {
+	return utils.Conf().Section("rtmp").Key(name)
+}
+
+// Start server
+func (server *Server) Start() (err error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", server.Port))
+	if err != nil {
+		return
+	}
+	server.Stoped = false
+	server.Listener = listener
+	server.logger.Println("started on", server.Port)
+	timeout := time.Duration(key("timeout").MustInt(30000)) * time.Millisecond
+	for !server.Stoped {
+		conn, err := listener.Accept()
+		if err != nil {
+			if server.Stoped {
+				break
+			}
+			server.logger.Println(err)
+			continue
+		}
+		session := newSession(server, NewConn(conn, timeout))
+		go session.serve()
+	}
+	return
+}
+
+// Stop server
+func (server *Server) Stop() {
+	server.logger.Println("rtmp server stop on", server.Port)
+	server.Stoped = true
+	if server.Listener != nil {
+		server.Listener.Close()
+		server.Listener = nil
+	}
+}
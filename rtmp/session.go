@@ -0,0 +1,263 @@
+package rtmp
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/tectiv3/edrtsp/flv"
+	"github.com/tectiv3/edrtsp/rtsp"
+)
+
+// session an rtmp connection, it publishes or plays a single stream
+type session struct {
+	server    *Server
+	conn      *Conn
+	logger    *log.Logger
+	app       string
+	tcURL     string
+	publisher *publisher
+	sink      *flv.Sink
+}
+
+func newSession(server *Server, conn *Conn) *session {
+	return &session{
+		server: server,
+		conn:   conn,
+		logger: log.New(os.Stdout, fmt.Sprintf("[RTMP %s]", conn.RemoteAddr()), log.LstdFlags|log.Lshortfile),
+	}
+}
+
+func (s *session) serve() {
+	defer func() {
+		if p := recover(); p != nil {
+			s.logger.Printf("rtmp session panic, %v", p)
+		}
+		if s.publisher != nil {
+			s.publisher.session.Stop()
+		}
+		if s.sink != nil {
+			s.sink.Stop()
+		}
+		s.conn.Close()
+		s.logger.Println("closed")
+	}()
+	if err := s.conn.ServerHandshake(); err != nil {
+		s.logger.Printf("handshake failed, %v", err)
+		return
+	}
+	for {
+		msg, err := s.conn.ReadMessage()
+		if err != nil {
+			s.logger.Println(err)
+			return
+		}
+		switch msg.Type {
+		case MSG_AMF0_COMMAND, MSG_AMF3_COMMAND:
+			payload := msg.Payload
+			if msg.Type == MSG_AMF3_COMMAND && len(payload) > 0 {
+				payload = payload[1:]
+			}
+			if err = s.handleCommand(msg, payload); err != nil {
+				s.logger.Println(err)
+				return
+			}
+		case MSG_AMF0_DATA, MSG_AUDIO, MSG_VIDEO:
+			if s.publisher == nil {
+				continue
+			}
+			if err = s.publisher.handle(msg); err != nil {
+				s.logger.Println(err)
+				return
+			}
+		}
+	}
+}
+
+func (s *session) handleCommand(msg *Message, payload []byte) (err error) {
+	values, err := DecodeAMF0(payload)
+	if err != nil {
+		return
+	}
+	if len(values) < 2 {
+		return
+	}
+	name, _ := values[0].(string)
+	txID, _ := values[1].(float64)
+	s.logger.Printf("command %s", name)
+	switch name {
+	case "connect":
+		if len(values) > 2 {
+			if obj, ok := values[2].(Object); ok {
+				s.app = strings.Trim(obj.String("app"), "/")
+				s.tcURL = obj.String("tcUrl")
+			}
+		}
+		if err = s.conn.WriteControl(MSG_WINDOW_ACK_SIZE, 2500000); err != nil {
+			return
+		}
+		if err = s.conn.WriteControl(MSG_SET_PEER_BANDWIDTH, 2500000, 2); err != nil {
+			return
+		}
+		if err = s.conn.SetChunkSize(4096); err != nil {
+			return
+		}
+		return s.conn.WriteCommand(CSID_COMMAND, 0, "_result", txID,
+			Object{"fmsVer": "FMS/3,0,1,123", "capabilities": 31},
+			Object{"level": "status", "code": "NetConnection.Connect.Success", "description": "Connection succeeded.", "objectEncoding": 0})
+	case "createStream":
+		return s.conn.WriteCommand(CSID_COMMAND, 0, "_result", txID, nil, 1)
+	case "publish":
+		if len(values) < 4 {
+			return fmt.Errorf("publish without stream name")
+		}
+		streamName, _ := values[3].(string)
+		return s.publish(msg.StreamID, streamName)
+	case "play":
+		if len(values) < 4 {
+			return fmt.Errorf("play without stream name")
+		}
+		streamName, _ := values[3].(string)
+		return s.play(msg.StreamID, streamName)
+	case "deleteStream", "closeStream", "FCUnpublish":
+		if s.publisher != nil {
+			return fmt.Errorf("%s unpublished", s.publisher.session.Path)
+		}
+		if s.sink != nil {
+			return fmt.Errorf("play stopped")
+		}
+	}
+	return
+}
+
+// streamURL gets path and query of stream name under the connected app
+func (s *session) streamURL(streamName string) (path string, query url.Values) {
+	query = url.Values{}
+	if u, err := url.Parse(s.tcURL); err == nil {
+		query = u.Query()
+	}
+	if i := strings.Index(streamName, "?"); i >= 0 {
+		if q, err := url.ParseQuery(streamName[i+1:]); err == nil {
+			for k, v := range q {
+				query[k] = v
+			}
+		}
+		streamName = streamName[:i]
+	}
+	if i := strings.Index(s.app, "?"); i >= 0 {
+		s.app = s.app[:i]
+	}
+	path = "/" + strings.Trim(s.app+"/"+strings.Trim(streamName, "/"), "/")
+	return
+}
+
+func (s *session) onStatus(streamID uint32, level, code, description string) error {
+	return s.conn.WriteCommand(CSID_DATA, streamID, "onStatus", 0, nil,
+		Object{"level": level, "code": code, "description": description})
+}
+
+// authenticate checks user and pass query parameters, "" for anonymous
+func (s *session) authenticate(query url.Values) (user string, err error) {
+	user = query.Get("user")
+	err = s.server.RTSPServer.Authenticate(user, query.Get("pass"))
+	return
+}
+
+func (s *session) publish(streamID uint32, streamName string) (err error) {
+	if s.publisher != nil || s.sink != nil {
+		return fmt.Errorf("publish on a busy connection")
+	}
+	path, query := s.streamURL(streamName)
+	user, err := s.authenticate(query)
+	rtspSession := rtsp.NewSession(s.server.RTSPServer, s.conn.Conn)
+	rtspSession.Type = rtsp.SESSION_TYPE_PUSHER
+	rtspSession.Path = path
+	rtspSession.URL = fmt.Sprintf("rtmp://%s%s", s.conn.LocalAddr(), path)
+	rtspSession.User = user
+	if err == nil {
+		err = s.server.RTSPServer.AuthorizeSession("on_publish", rtspSession)
+	}
+	if err != nil {
+		s.onStatus(streamID, "error", "NetStream.Publish.BadName", err.Error())
+		return fmt.Errorf("publish %s denied, %v", path, err)
+	}
+	s.logger.Printf("publish %s", path)
+	s.publisher = newPublisher(rtspSession)
+	if err = s.conn.WriteUserControl(USER_CONTROL_STREAM_BEGIN, streamID); err != nil {
+		return
+	}
+	return s.onStatus(streamID, "status", "NetStream.Publish.Start", fmt.Sprintf("%s is now published.", path))
+}
+
+// play attaches a flv sink to the pusher of the stream as a player, it writes
+// tags starting with the GOP cache while serve keeps reading control messages
+func (s *session) play(streamID uint32, streamName string) (err error) {
+	if s.publisher != nil || s.sink != nil {
+		return fmt.Errorf("play on a busy connection")
+	}
+	path, query := s.streamURL(streamName)
+	user, err := s.authenticate(query)
+	rtspSession := rtsp.NewSession(s.server.RTSPServer, s.conn.Conn)
+	rtspSession.Type = rtsp.SESSION_TYPE_PLAYER
+	rtspSession.Path = path
+	rtspSession.URL = fmt.Sprintf("rtmp://%s%s", s.conn.LocalAddr(), path)
+	rtspSession.User = user
+	if err == nil {
+		err = s.server.RTSPServer.AuthorizeSession("on_play", rtspSession)
+	}
+	if err != nil {
+		s.onStatus(streamID, "error", "NetStream.Play.Failed", err.Error())
+		return fmt.Errorf("play %s denied, %v", path, err)
+	}
+	pusher, err := s.server.RTSPServer.DemandPusher(path)
+	if err != nil {
+		s.onStatus(streamID, "error", "NetStream.Play.Failed", err.Error())
+		return fmt.Errorf("pull %s on demand failed, %v", path, err)
+	}
+	if pusher == nil {
+		s.onStatus(streamID, "error", "NetStream.Play.StreamNotFound", fmt.Sprintf("%s not found.", path))
+		return fmt.Errorf("play %s not found", path)
+	}
+	s.logger.Printf("play %s", path)
+	s.conn.ReadTimeout = 0
+	if err = s.conn.WriteUserControl(USER_CONTROL_STREAM_BEGIN, streamID); err != nil {
+		return
+	}
+	if err = s.onStatus(streamID, "status", "NetStream.Play.Reset", fmt.Sprintf("Playing and resetting %s.", path)); err != nil {
+		return
+	}
+	if err = s.onStatus(streamID, "status", "NetStream.Play.Start", fmt.Sprintf("Started playing %s.", path)); err != nil {
+		return
+	}
+	s.sink = flv.NewSink(pusher)
+	// listed and kicked like rtsp players
+	s.sink.Player = rtsp.NewSinkPlayer(rtspSession, pusher, s.sink)
+	go func() {
+		err := s.sink.Serve(func(hasVideo, hasAudio bool) error {
+			return s.conn.WriteMessage(CSID_DATA, &Message{
+				Type:     MSG_AMF0_DATA,
+				StreamID: streamID,
+				Payload:  EncodeAMF0("onMetaData", Object{"hasVideo": hasVideo, "hasAudio": hasAudio}),
+			})
+		}, func(tag *flv.Tag) error {
+			csid := uint32(CSID_VIDEO)
+			if tag.Type == flv.TAG_TYPE_AUDIO {
+				csid = CSID_AUDIO
+			}
+			return s.conn.WriteMessage(csid, &Message{
+				Type:      tag.Type,
+				StreamID:  streamID,
+				Timestamp: tag.Timestamp,
+				Payload:   tag.Data,
+			})
+		})
+		if err != nil {
+			s.logger.Println(err)
+		}
+		s.sink.Stop()
+		s.conn.Close()
+	}()
+	return
+}
@@ -0,0 +1,170 @@
+package rtsp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ACL per path publish/read rules, loaded from a json file like
+//
+//	{
+//	  "ipAllow": ["192.168.0.0/16"],
+//	  "ipDeny": ["192.168.1.13"],
+//	  "rules": [
+//	    {"user": "+", "path": "/live/${user}", "publish": true},
+//	    {"user": "*", "path": "/live/*", "read": true},
+//	    {"user": "admin", "path": "~^/.*$", "publish": true, "read": true}
+//	  ]
+//	}
+//
+// user "*" matches anyone, "+" any authenticated user. path is a glob,
+// or a regexp when prefixed with "~", ${user} is replaced by the username.
+// Both must match the whole path, "/cam" matches neither "/camera2" nor
+// "/x/cam/y".
+// The first rule matching user and path decides, nothing matched is denied.
+type ACL struct {
+	IPAllow []string   `json:"ipAllow"`
+	IPDeny  []string   `json:"ipDeny"`
+	Rules   []*ACLRule `json:"rules"`
+
+	ipAllow []*net.IPNet
+	ipDeny  []*net.IPNet
+}
+
+type ACLRule struct {
+	User    string `json:"user"`
+	Path    string `json:"path"`
+	Publish bool   `json:"publish"`
+	Read    bool   `json:"read"`
+}
+
+type ACLAction int
+
+const (
+	ACL_ACTION_PUBLISH ACLAction = iota
+	ACL_ACTION_READ
+)
+
+func (a ACLAction) String() string {
+	switch a {
+	case ACL_ACTION_PUBLISH:
+		return "publish"
+	case ACL_ACTION_READ:
+		return "read"
+	}
+	return "unknown"
+}
+
+func LoadACL(file string) (acl *ACL, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	acl = &ACL{}
+	if err = json.Unmarshal(data, acl); err != nil {
+		err = fmt.Errorf("parse acl file %s failed, %v", file, err)
+		return
+	}
+	if acl.ipAllow, err = parseCIDRs(acl.IPAllow); err != nil {
+		return
+	}
+	if acl.ipDeny, err = parseCIDRs(acl.IPDeny); err != nil {
+		return
+	}
+	for _, rule := range acl.Rules {
+		if strings.HasPrefix(rule.Path, "~") {
+			if _, err = compilePath(rule.Path[1:]); err != nil {
+				err = fmt.Errorf("acl rule path %s invalid, %v", rule.Path, err)
+				return
+			}
+		} else if _, err = path.Match(rule.Path, "/"); err != nil {
+			err = fmt.Errorf("acl rule path %s invalid, %v", rule.Path, err)
+			return
+		}
+	}
+	return
+}
+
+func parseCIDRs(list []string) (nets []*net.IPNet, err error) {
+	for _, v := range list {
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		var ipnet *net.IPNet
+		if _, ipnet, err = net.ParseCIDR(v); err != nil {
+			return
+		}
+		nets = append(nets, ipnet)
+	}
+	return
+}
+
+// AllowIP checks ip against deny and allow lists, deny wins
+func (acl *ACL) AllowIP(ip net.IP) bool {
+	for _, n := range acl.ipDeny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(acl.ipAllow) == 0 {
+		return true
+	}
+	for _, n := range acl.ipAllow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow checks whether user, "" for anonymous, may do action on path
+func (acl *ACL) Allow(user string, action ACLAction, p string) bool {
+	for _, rule := range acl.Rules {
+		if !rule.matchUser(user) || !rule.matchPath(user, p) {
+			continue
+		}
+		if action == ACL_ACTION_PUBLISH {
+			return rule.Publish
+		}
+		return rule.Read
+	}
+	return false
+}
+
+func (rule *ACLRule) matchUser(user string) bool {
+	switch rule.User {
+	case "*":
+		return true
+	case "+":
+		return user != ""
+	}
+	return user != "" && rule.User == user
+}
+
+func (rule *ACLRule) matchPath(user, p string) bool {
+	if strings.HasPrefix(rule.Path, "~") {
+		re, err := compilePath(strings.Replace(rule.Path[1:], "${user}", regexp.QuoteMeta(user), -1))
+		return err == nil && re.MatchString(p)
+	}
+	ok, _ := path.Match(strings.Replace(rule.Path, "${user}", globQuote(user), -1), p)
+	return ok
+}
+
+// compilePath compiles a path regexp anchored at both ends
+func compilePath(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// globQuote escapes the path.Match metacharacters of s
+func globQuote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`).Replace(s)
+}
@@ -0,0 +1,132 @@
+package rtsp
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadTestACL(t *testing.T, content string) (*ACL, error) {
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "acl.json")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadACL(file)
+}
+
+func TestACLAllowIP(t *testing.T) {
+	tests := []struct {
+		name  string
+		acl   string
+		ip    string
+		allow bool
+	}{
+		{"no lists", `{}`, "10.0.0.1", true},
+		{"denied ip", `{"ipDeny": ["10.0.0.1"]}`, "10.0.0.1", false},
+		{"other ip than denied", `{"ipDeny": ["10.0.0.1"]}`, "10.0.0.2", true},
+		{"denied cidr", `{"ipDeny": ["10.0.0.0/8"]}`, "10.20.30.40", false},
+		{"allowed cidr", `{"ipAllow": ["192.168.0.0/16"]}`, "192.168.1.2", true},
+		{"outside allowed cidr", `{"ipAllow": ["192.168.0.0/16"]}`, "192.169.0.1", false},
+		{"deny wins over allow", `{"ipAllow": ["192.168.0.0/16"], "ipDeny": ["192.168.1.13"]}`, "192.168.1.13", false},
+		{"allowed next to denied", `{"ipAllow": ["192.168.0.0/16"], "ipDeny": ["192.168.1.13"]}`, "192.168.1.14", true},
+		{"allowed ipv6", `{"ipAllow": ["::1"]}`, "::1", true},
+		{"ipv4 with ipv6 allowed", `{"ipAllow": ["::1"]}`, "127.0.0.1", false},
+		{"denied ipv6 cidr", `{"ipDeny": ["fd00::/8"]}`, "fd00::5", false},
+		{"mapped ipv4", `{"ipDeny": ["10.0.0.1"]}`, "::ffff:10.0.0.1", false},
+	}
+	for _, test := range tests {
+		acl, err := loadTestACL(t, test.acl)
+		if err != nil {
+			t.Errorf("%s: LoadACL() = %v", test.name, err)
+			continue
+		}
+		if allow := acl.AllowIP(net.ParseIP(test.ip)); allow != test.allow {
+			t.Errorf("%s: AllowIP(%s) = %v, want %v", test.name, test.ip, allow, test.allow)
+		}
+	}
+}
+
+func TestACLAllow(t *testing.T) {
+	acl, err := loadTestACL(t, `{
+		"rules": [
+			{"user": "*", "path": "/blocked/*"},
+			{"user": "+", "path": "/live/${user}", "publish": true, "read": true},
+			{"user": "*", "path": "/live/*", "read": true},
+			{"user": "cam", "path": "/cam", "publish": true},
+			{"user": "+", "path": "~/users/${user}/.+", "read": true},
+			{"user": "admin", "path": "~/.*", "publish": true, "read": true},
+			{"user": "*", "path": "~/vod/[0-9]+", "read": true}
+		]
+	}`)
+	if err != nil {
+		t.Fatalf("LoadACL() = %v", err)
+	}
+	tests := []struct {
+		user   string
+		action ACLAction
+		path   string
+		allow  bool
+	}{
+		// the first rule matching decides, later ones can't override it
+		{"admin", ACL_ACTION_READ, "/blocked/x", false},
+		{"admin", ACL_ACTION_PUBLISH, "/other", true},
+		{"bob", ACL_ACTION_PUBLISH, "/live/bob", true},
+		{"bob", ACL_ACTION_PUBLISH, "/live/alice", false},
+		{"bob", ACL_ACTION_READ, "/live/alice", true},
+		{"", ACL_ACTION_READ, "/live/alice", true},
+		{"", ACL_ACTION_PUBLISH, "/live/", false},
+		{"", ACL_ACTION_PUBLISH, "/cam", false},
+		{"cam", ACL_ACTION_PUBLISH, "/cam", true},
+		{"cam", ACL_ACTION_READ, "/cam", false},
+		// globs don't cross path separators
+		{"", ACL_ACTION_READ, "/live/a/b", false},
+		// both forms match the whole path
+		{"cam", ACL_ACTION_PUBLISH, "/camera2", false},
+		{"cam", ACL_ACTION_PUBLISH, "/x/cam", false},
+		{"", ACL_ACTION_READ, "/vod/12", true},
+		{"", ACL_ACTION_READ, "/vod/12x", false},
+		{"", ACL_ACTION_READ, "/x/vod/12", false},
+		{"bob", ACL_ACTION_READ, "/users/bob/1", true},
+		{"bob", ACL_ACTION_READ, "/users/bobby/1", false},
+		{"", ACL_ACTION_READ, "/users//1", false},
+		// ${user} is matched literally
+		{"a.b", ACL_ACTION_READ, "/users/a.b/1", true},
+		{"a.b", ACL_ACTION_READ, "/users/axb/1", false},
+		{"*", ACL_ACTION_PUBLISH, "/live/*", true},
+		{"*", ACL_ACTION_PUBLISH, "/live/x", false},
+		{"", ACL_ACTION_READ, "/nothing", false},
+	}
+	for _, test := range tests {
+		if allow := acl.Allow(test.user, test.action, test.path); allow != test.allow {
+			t.Errorf("Allow(%q, %v, %s) = %v, want %v", test.user, test.action, test.path, allow, test.allow)
+		}
+	}
+}
+
+func TestLoadACLInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		acl  string
+	}{
+		{"json", `{"rules": [}`},
+		{"ip", `{"ipAllow": ["10.0.0.256"]}`},
+		{"cidr", `{"ipDeny": ["10.0.0.0/33"]}`},
+		{"glob", `{"rules": [{"user": "*", "path": "/live/["}]}`},
+		{"regexp", `{"rules": [{"user": "*", "path": "~/live/(x"}]}`},
+	}
+	for _, test := range tests {
+		if _, err := loadTestACL(t, test.acl); err == nil {
+			t.Errorf("%s: LoadACL(%s) = nil, want error", test.name, test.acl)
+		}
+	}
+	if _, err := LoadACL(filepath.Join(os.TempDir(), "no-such-acl.json")); err == nil {
+		t.Error("missing file: LoadACL() = nil, want error")
+	}
+}
@@ -0,0 +1,139 @@
+package rtsp
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// setupSource gets a pulling client ready for the media answered by a SETUP
+// response, udp clients open the way for the server, multicast ones join
+// its group
+func (client *RTSPClient) setupSource(media string, resp *Response) error {
+	switch client.TransType {
+	case TRANS_TYPE_UDP:
+		client.setupReportTarget(media, resp)
+		client.punch(media)
+	case TRANS_TYPE_MULTICAST:
+		transport, _ := resp.Header["Transport"].(string)
+		return client.joinMulticast(media, transport)
+	}
+	return nil
+}
+
+// punch sends a packet from both udp ports of media to the server, so that
+// NATs on the way let its packets back in
+func (client *RTSPClient) punch(media string) {
+	udp := client.UDPServer
+	conn, controlConn, addr, controlAddr := udp.VConn, udp.VControlConn, client.vRTPAddr, client.vRTPControlAddr
+	if media == "audio" {
+		conn, controlConn, addr, controlAddr = udp.AConn, udp.AControlConn, client.aRTPAddr, client.aRTPControlAddr
+	}
+	if addr == nil || conn == nil || controlConn == nil {
+		return
+	}
+	// a bare rtp header and an empty receiver report, servers drop both
+	conn.WriteToUDP([]byte{0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, addr)
+	controlConn.WriteToUDP(receiverReport(0, nil, client.ID), controlAddr)
+}
+
+var (
+	destinationRex = regexp.MustCompile(`destination=([^;]+)`)
+	portRex        = regexp.MustCompile(`(?:^|;)port=(\d+)(-(\d+))?`)
+)
+
+// joinMulticast joins the group of a multicast SETUP answered with transport
+func (client *RTSPClient) joinMulticast(media, transport string) (err error) {
+	if !strings.Contains(strings.ToLower(transport), "multicast") {
+		return fmt.Errorf("no multicast in transport %q", transport)
+	}
+	dest := destinationRex.FindStringSubmatch(transport)
+	ports := portRex.FindStringSubmatch(transport)
+	if dest == nil || ports == nil {
+		return fmt.Errorf("no destination or port in transport %q", transport)
+	}
+	group := net.ParseIP(dest[1])
+	if group == nil || !group.IsMulticast() {
+		return fmt.Errorf("no multicast destination in transport %q", transport)
+	}
+	port, _ := strconv.Atoi(ports[1])
+	controlPort := port + 1
+	if ports[3] != "" {
+		controlPort, _ = strconv.Atoi(ports[3])
+	}
+	if client.UDPServer == nil {
+		client.UDPServer = &UDPServer{RTSPClient: client}
+	}
+	typ := RTP_TYPE_VIDEO
+	if media == "audio" {
+		typ = RTP_TYPE_AUDIO
+	}
+	if err = client.UDPServer.SetupMulticast(typ, group, port, controlPort); err != nil {
+		return
+	}
+	// receiver reports go to the group as well
+	controlAddr := &net.UDPAddr{IP: group, Port: controlPort}
+	if media == "audio" {
+		client.aRTPControlAddr = controlAddr
+	} else {
+		client.vRTPControlAddr = controlAddr
+	}
+	return
+}
+
+// startAuto pulls over udp and falls back to tcp when the SETUP fails or
+// nothing arrives within udp_fallback_timeout
+func (client *RTSPClient) startAuto(timeout time.Duration) (err error) {
+	wait := time.Duration(key("udp_fallback_timeout").MustInt(5)) * time.Second
+	client.TransType = TRANS_TYPE_UDP
+	if err = client.requestStream(timeout); err == nil {
+		// rtsps sources are pulled over tcp anyway
+		if client.TransType != TRANS_TYPE_UDP || client.receivedUDP(wait) {
+			go client.startStream()
+			return
+		}
+		err = fmt.Errorf("nothing received for %v", wait)
+	}
+	if client.Stoped {
+		return
+	}
+	client.logger.Printf("udp failed, %v, falling back to tcp", err)
+	client.reset()
+	client.TransType = TRANS_TYPE_TCP
+	if err = client.requestStream(timeout); err != nil {
+		return
+	}
+	go client.startStream()
+	return
+}
+
+// receivedUDP waits up to wait for the first udp packet
+func (client *RTSPClient) receivedUDP(wait time.Duration) bool {
+	inBytes := atomic.LoadInt64(&client.InBytes)
+	for deadline := time.Now().Add(wait); time.Now().Before(deadline) && !client.Stoped; {
+		time.Sleep(100 * time.Millisecond)
+		if atomic.LoadInt64(&client.InBytes) != inBytes {
+			return true
+		}
+	}
+	return false
+}
+
+// reset drops the connection and udp ports of a failed attempt, unlike Stop
+// it leaves the client ready to start over
+func (client *RTSPClient) reset() {
+	if client.Conn != nil {
+		client.Conn.Close()
+		client.Conn = nil
+	}
+	if client.UDPServer != nil {
+		client.UDPServer.Stop()
+		client.UDPServer = nil
+	}
+	client.pushTarget = pushTarget{}
+	client.AControl, client.VControl = "", ""
+}
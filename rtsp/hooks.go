@@ -0,0 +1,179 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/tectiv3/edrtsp/utils"
+)
+
+// Hooks posts json events to http callbacks configured in [hooks].
+// on_publish and on_play ask whether a pusher or player is allowed, any 2xx
+// answer allows it. The others are notifications and are sent async.
+type Hooks struct {
+	SessionLogger
+	OnPublish     string
+	OnPlay        string
+	OnPusherStart string
+	OnPusherStop  string
+	OnPlayerStart string
+	OnPlayerStop  string
+	// FailOpen allows publish/play when the callback can't be reached
+	FailOpen bool
+	Client   *http.Client
+}
+
+// HookEvent payload of a callback
+type HookEvent struct {
+	Event      string `json:"event"`
+	ID         string `json:"id"`
+	Path       string `json:"path"`
+	URL        string `json:"url"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	User       string `json:"user,omitempty"`
+	VCodec     string `json:"vcodec,omitempty"`
+	ACodec     string `json:"acodec,omitempty"`
+	TransType  string `json:"transType"`
+	InBytes    int    `json:"inBytes"`
+	OutBytes   int    `json:"outBytes"`
+	Time       int64  `json:"time"`
+}
+
+func LoadHooks() *Hooks {
+	section := utils.Conf().Section("hooks")
+	return &Hooks{
+		SessionLogger: SessionLogger{log.New(os.Stdout, "[Hooks]", log.LstdFlags|log.Lshortfile)},
+		OnPublish:     section.Key("on_publish").String(),
+		OnPlay:        section.Key("on_play").String(),
+		OnPusherStart: section.Key("on_pusher_start").String(),
+		OnPusherStop:  section.Key("on_pusher_stop").String(),
+		OnPlayerStart: section.Key("on_player_start").String(),
+		OnPlayerStop:  section.Key("on_player_stop").String(),
+		FailOpen:      section.Key("fail_open").MustBool(false),
+		Client: &http.Client{
+			Timeout: time.Duration(section.Key("timeout").MustInt(3000)) * time.Millisecond,
+		},
+	}
+}
+
+func (hooks *Hooks) post(url string, event *HookEvent) (err error) {
+	event.Time = time.Now().Unix()
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	resp, err := hooks.Client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = &hookDenied{resp.StatusCode}
+	}
+	return
+}
+
+type hookDenied struct {
+	statusCode int
+}
+
+func (e *hookDenied) Error() string {
+	return fmt.Sprintf("hook denied with status %d", e.statusCode)
+}
+
+// Authorize asks on_publish or on_play callback, nil when allowed
+func (hooks *Hooks) Authorize(event *HookEvent) error {
+	if hooks == nil {
+		return nil
+	}
+	url := ""
+	switch event.Event {
+	case "on_publish":
+		url = hooks.OnPublish
+	case "on_play":
+		url = hooks.OnPlay
+	}
+	if url == "" {
+		return nil
+	}
+	err := hooks.post(url, event)
+	if err == nil {
+		return nil
+	}
+	if _, denied := err.(*hookDenied); !denied && hooks.FailOpen {
+		hooks.logger.Printf("%s callback failed, allowed by fail_open, %v", event.Event, err)
+		return nil
+	}
+	return err
+}
+
+// Notify sends event to its callback in background
+func (hooks *Hooks) Notify(event *HookEvent) {
+	if hooks == nil {
+		return
+	}
+	url := ""
+	switch event.Event {
+	case "on_pusher_start":
+		url = hooks.OnPusherStart
+	case "on_pusher_stop":
+		url = hooks.OnPusherStop
+	case "on_player_start":
+		url = hooks.OnPlayerStart
+	case "on_player_stop":
+		url = hooks.OnPlayerStop
+	}
+	if url == "" {
+		return
+	}
+	go func() {
+		if err := hooks.post(url, event); err != nil {
+			hooks.logger.Printf("%s callback failed, %v", event.Event, err)
+		}
+	}()
+}
+
+func pusherEvent(name string, pusher *Pusher) *HookEvent {
+	event := &HookEvent{
+		Event:     name,
+		ID:        pusher.ID(),
+		Path:      pusher.Path(),
+		URL:       pusher.URL(),
+		VCodec:    pusher.VCodec(),
+		ACodec:    pusher.ACodec(),
+		TransType: pusher.TransType(),
+		InBytes:   pusher.InBytes(),
+		OutBytes:  pusher.OutBytes(),
+	}
+	if pusher.Session != nil {
+		event.User = pusher.Session.User
+		if conn := pusher.Session.Conn; conn != nil {
+			event.RemoteAddr = conn.RemoteAddr().String()
+		}
+	}
+	return event
+}
+
+func sessionEvent(name string, session *Session) *HookEvent {
+	event := &HookEvent{
+		Event:     name,
+		ID:        session.ID,
+		Path:      session.Path,
+		URL:       session.URL,
+		User:      session.User,
+		VCodec:    session.VCodec,
+		ACodec:    session.ACodec,
+		TransType: session.TransType.String(),
+		InBytes:   session.InBytes,
+		OutBytes:  session.OutBytes,
+	}
+	if conn := session.Conn; conn != nil {
+		event.RemoteAddr = conn.RemoteAddr().String()
+	}
+	return event
+}
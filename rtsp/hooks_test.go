@@ -0,0 +1,144 @@
+package rtsp
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestHooks(url string, failOpen bool) *Hooks {
+	return &Hooks{
+		SessionLogger: SessionLogger{log.New(os.Stdout, "[Hooks]", log.LstdFlags|log.Lshortfile)},
+		OnPublish:     url,
+		OnPlay:        url,
+		OnPlayerStart: url,
+		FailOpen:      failOpen,
+		Client:        &http.Client{Timeout: 100 * time.Millisecond},
+	}
+}
+
+func testEvent(name string) *HookEvent {
+	return &HookEvent{
+		Event:      name,
+		ID:         "session-1",
+		Path:       "/live/cam",
+		URL:        "rtsp://127.0.0.1/live/cam",
+		RemoteAddr: "127.0.0.1:50000",
+		User:       "bob",
+		VCodec:     "H264",
+		ACodec:     "MPEG4-GENERIC",
+		TransType:  "TCP",
+		InBytes:    1,
+		OutBytes:   2,
+	}
+}
+
+func TestHooksAuthorizeAllow(t *testing.T) {
+	events := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		payload := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decode payload, %v", err)
+		}
+		events <- payload
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	if err := newTestHooks(server.URL, false).Authorize(testEvent("on_play")); err != nil {
+		t.Fatalf("Authorize() = %v, want allowed", err)
+	}
+	payload := <-events
+	want := map[string]interface{}{
+		"event":      "on_play",
+		"id":         "session-1",
+		"path":       "/live/cam",
+		"url":        "rtsp://127.0.0.1/live/cam",
+		"remoteAddr": "127.0.0.1:50000",
+		"user":       "bob",
+		"vcodec":     "H264",
+		"acodec":     "MPEG4-GENERIC",
+		"transType":  "TCP",
+		"inBytes":    float64(1),
+		"outBytes":   float64(2),
+	}
+	for k, v := range want {
+		if payload[k] != v {
+			t.Errorf("payload %s = %v, want %v", k, payload[k], v)
+		}
+	}
+	if ts, _ := payload["time"].(float64); ts <= 0 {
+		t.Errorf("payload time = %v, want unix time", payload["time"])
+	}
+}
+
+func TestHooksAuthorizeDeny(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	// fail_open only covers unreachable callbacks, never an answer
+	for _, failOpen := range []bool{false, true} {
+		err := newTestHooks(server.URL, failOpen).Authorize(testEvent("on_publish"))
+		if denied, ok := err.(*hookDenied); !ok || denied.statusCode != http.StatusForbidden {
+			t.Errorf("fail_open %v: Authorize() = %v, want denied with 403", failOpen, err)
+		}
+	}
+}
+
+func TestHooksAuthorizeTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// answers only after the client gave up
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	if err := newTestHooks(server.URL, false).Authorize(testEvent("on_play")); err == nil {
+		t.Error("fail closed: Authorize() = nil, want timeout error")
+	} else if _, denied := err.(*hookDenied); denied {
+		t.Errorf("fail closed: Authorize() = %v, want timeout error", err)
+	}
+	if err := newTestHooks(server.URL, true).Authorize(testEvent("on_play")); err != nil {
+		t.Errorf("fail open: Authorize() = %v, want allowed", err)
+	}
+}
+
+func TestHooksAuthorizeUnset(t *testing.T) {
+	var hooks *Hooks
+	if err := hooks.Authorize(testEvent("on_play")); err != nil {
+		t.Errorf("nil hooks: Authorize() = %v, want allowed", err)
+	}
+	if err := newTestHooks("", false).Authorize(testEvent("on_play")); err != nil {
+		t.Errorf("no callback: Authorize() = %v, want allowed", err)
+	}
+}
+
+func TestHooksNotify(t *testing.T) {
+	events := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event HookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event.Event
+	}))
+	defer server.Close()
+
+	newTestHooks(server.URL, false).Notify(testEvent("on_player_start"))
+	select {
+	case name := <-events:
+		if name != "on_player_start" {
+			t.Errorf("notified %s, want on_player_start", name)
+		}
+	case <-time.After(time.Second):
+		t.Error("on_player_start not posted")
+	}
+}
@@ -0,0 +1,256 @@
+package rtsp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RTSP over HTTP, the QuickTime tunnel. The client opens a GET connection
+// that gets everything the server sends, then POSTs base64 encoded requests
+// and interleaved data on one or more other connections. Both carry the same
+// x-sessioncookie header, which joins them to one session when they come
+// from the same host.
+
+const TUNNEL_CONTENT_TYPE = "application/x-rtsp-tunnelled"
+
+// FIRST_REQUEST_TIMEOUT the first rtsp or http request of a connection must
+// arrive within, until then it isn't known to be a session or a tunnel
+const FIRST_REQUEST_TIMEOUT = 10 * time.Second
+
+// peekedConn reads what was peeked from a connection before the rest of it
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (conn *peekedConn) Read(b []byte) (int, error) {
+	return conn.r.Read(b)
+}
+
+// tunnelConn is the connection a tunneled session reads and writes, reads
+// come from a pipe fed with the decoded posts, writes go to the GET connection
+type tunnelConn struct {
+	net.Conn // session end of the pipe
+	server   *Server
+	cookie   string
+	get      net.Conn
+	feed     net.Conn // post end of the pipe
+	posts    map[net.Conn]bool
+	lock     sync.Mutex
+	closed   bool
+}
+
+func (conn *tunnelConn) Write(b []byte) (int, error) {
+	return conn.get.Write(b)
+}
+
+func (conn *tunnelConn) SetDeadline(t time.Time) error {
+	conn.Conn.SetReadDeadline(t)
+	return conn.get.SetWriteDeadline(t)
+}
+
+func (conn *tunnelConn) SetWriteDeadline(t time.Time) error {
+	return conn.get.SetWriteDeadline(t)
+}
+
+func (conn *tunnelConn) LocalAddr() net.Addr {
+	return conn.get.LocalAddr()
+}
+
+func (conn *tunnelConn) RemoteAddr() net.Addr {
+	return conn.get.RemoteAddr()
+}
+
+// Close closes the tunnel with all its connections
+func (conn *tunnelConn) Close() error {
+	conn.lock.Lock()
+	if conn.closed {
+		conn.lock.Unlock()
+		return nil
+	}
+	conn.closed = true
+	posts := conn.posts
+	conn.posts = nil
+	conn.lock.Unlock()
+
+	conn.server.tunnelsLock.Lock()
+	if conn.server.tunnels[conn.cookie] == conn {
+		delete(conn.server.tunnels, conn.cookie)
+	}
+	conn.server.tunnelsLock.Unlock()
+	conn.server.logger.Printf("http tunnel %s closed", conn.cookie)
+	for post := range posts {
+		post.Close()
+	}
+	conn.feed.Close()
+	conn.get.Close()
+	return conn.Conn.Close()
+}
+
+// addPost keeps post to be closed with the tunnel
+func (conn *tunnelConn) addPost(post net.Conn) bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.closed {
+		return false
+	}
+	conn.posts[post] = true
+	return true
+}
+
+// removePost forgets post, false once the tunnel is closed
+func (conn *tunnelConn) removePost(post net.Conn) bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	delete(conn.posts, post)
+	return !conn.closed
+}
+
+// decode feeds the base64 read from r to the session. Clients encode each
+// message on its own, padding may show up in the middle of the stream.
+func (conn *tunnelConn) decode(r io.Reader) error {
+	buf := make([]byte, 4096)
+	pending := make([]byte, 0, 4096)
+	for {
+		n, err := r.Read(buf)
+		for _, c := range buf[:n] {
+			if isBase64(c) {
+				pending = append(pending, c)
+			}
+		}
+		whole := len(pending) / 4 * 4
+		start := 0
+		for i := 0; i < whole; i += 4 {
+			if pending[i+3] != '=' && i+4 < whole {
+				continue
+			}
+			data := make([]byte, base64.StdEncoding.DecodedLen(i+4-start))
+			m, derr := base64.StdEncoding.Decode(data, pending[start:i+4])
+			if derr != nil {
+				return derr
+			}
+			if _, werr := conn.feed.Write(data[:m]); werr != nil {
+				return werr
+			}
+			start = i + 4
+		}
+		pending = append(pending[:0], pending[whole:]...)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func isBase64(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '+' || c == '/' || c == '='
+}
+
+// serveConn starts a session on conn, or joins conn to an http tunnel
+func (server *Server) serveConn(conn net.Conn) {
+	if key("http_tunnel_enable").MustInt(1) == 0 {
+		NewSession(server, conn).Start()
+		return
+	}
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(FIRST_REQUEST_TIMEOUT))
+	head, err := r.Peek(4)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	switch string(head) {
+	case "GET ", "POST":
+		server.serveTunnel(conn, r)
+	default:
+		// sessions set their own deadlines
+		conn.SetReadDeadline(time.Time{})
+		NewSession(server, &peekedConn{conn, r}).Start()
+	}
+}
+
+// sameHost reports whether a and b are addresses of the same host
+func sameHost(a, b net.Addr) bool {
+	hostA, _, errA := net.SplitHostPort(a.String())
+	hostB, _, errB := net.SplitHostPort(b.String())
+	return errA == nil && errB == nil && hostA == hostB
+}
+
+func (server *Server) serveTunnel(conn net.Conn, r *bufio.Reader) {
+	logger := server.logger
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		logger.Printf("http tunnel request from %s failed, %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	// GETs wait for the session to write, posts for the client
+	conn.SetReadDeadline(time.Time{})
+	cookie := req.Header.Get("x-sessioncookie")
+	if cookie == "" {
+		fmt.Fprintf(conn, "HTTP/1.0 400 Bad Request\r\nConnection: close\r\n\r\n")
+		conn.Close()
+		return
+	}
+	switch req.Method {
+	case "GET":
+		server.tunnelsLock.Lock()
+		if _, ok := server.tunnels[cookie]; ok {
+			server.tunnelsLock.Unlock()
+			fmt.Fprintf(conn, "HTTP/1.0 400 Bad Request\r\nConnection: close\r\n\r\n")
+			conn.Close()
+			return
+		}
+		sessionEnd, feed := net.Pipe()
+		tunnel := &tunnelConn{
+			Conn:   sessionEnd,
+			server: server,
+			cookie: cookie,
+			get:    conn,
+			feed:   feed,
+			posts:  make(map[net.Conn]bool),
+		}
+		server.tunnels[cookie] = tunnel
+		server.tunnelsLock.Unlock()
+		logger.Printf("http tunnel %s opened from %s", cookie, conn.RemoteAddr())
+		if _, err := fmt.Fprintf(conn, "HTTP/1.0 200 OK\r\nConnection: close\r\nCache-Control: no-store\r\nPragma: no-cache\r\nContent-Type: %s\r\n\r\n", TUNNEL_CONTENT_TYPE); err != nil {
+			tunnel.Close()
+			return
+		}
+		// clients send nothing more on GET, a read ends once they hang up
+		go func() {
+			io.Copy(ioutil.Discard, r)
+			tunnel.Close()
+		}()
+		NewSession(server, tunnel).Start()
+	case "POST":
+		server.tunnelsLock.RLock()
+		tunnel := server.tunnels[cookie]
+		server.tunnelsLock.RUnlock()
+		// the cookie alone would let anyone knowing it inject requests
+		if tunnel != nil && !sameHost(conn.RemoteAddr(), tunnel.get.RemoteAddr()) {
+			logger.Printf("http tunnel %s post from %s refused, the tunnel is from %s", cookie, conn.RemoteAddr(), tunnel.get.RemoteAddr())
+			tunnel = nil
+		}
+		if tunnel == nil || !tunnel.addPost(conn) {
+			fmt.Fprintf(conn, "HTTP/1.0 404 Not Found\r\nConnection: close\r\n\r\n")
+			conn.Close()
+			return
+		}
+		// no response, posts may come and go while the GET is kept
+		err := tunnel.decode(r)
+		if open := tunnel.removePost(conn); open && err != nil && err != io.EOF {
+			logger.Printf("http tunnel %s post failed, %v", cookie, err)
+		}
+		conn.Close()
+	default:
+		fmt.Fprintf(conn, "HTTP/1.0 405 Method Not Allowed\r\nConnection: close\r\n\r\n")
+		conn.Close()
+	}
+}
@@ -0,0 +1,217 @@
+package rtsp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// group addresses handed out to pushers
+var (
+	multicastGroups     = make(map[string]bool)
+	multicastGroupsLock sync.Mutex
+)
+
+// allocMulticastGroup gets a free address of multicast_range
+func allocMulticastGroup() (net.IP, error) {
+	cidr := key("multicast_range").MustString("239.255.42.0/24")
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if !ip.IsMulticast() {
+		return nil, fmt.Errorf("multicast_range %s is no multicast range", cidr)
+	}
+	multicastGroupsLock.Lock()
+	defer multicastGroupsLock.Unlock()
+	for ip := ip.Mask(ipNet.Mask).To4(); ip != nil && ipNet.Contains(ip); ip = nextIP(ip) {
+		if ip[3] == 0 || ip[3] == 255 || multicastGroups[ip.String()] {
+			continue
+		}
+		multicastGroups[ip.String()] = true
+		return ip, nil
+	}
+	return nil, fmt.Errorf("no free group in multicast_range %s", cidr)
+}
+
+func freeMulticastGroup(ip net.IP) {
+	multicastGroupsLock.Lock()
+	delete(multicastGroups, ip.String())
+	multicastGroupsLock.Unlock()
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		if next[i]++; next[i] != 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+// multicastTrack sends one track of a pusher to the group
+type multicastTrack struct {
+	port        int // rtp, rtcp on port+1
+	conn        *net.UDPConn
+	controlConn *net.UDPConn
+	rewriter    *rtpRewriter
+	sender      *rtpSender
+}
+
+// Multicast sends the tracks of a pusher once to a multicast group, however
+// many players joined it
+type Multicast struct {
+	IP      net.IP
+	TTL     int
+	pusher  *Pusher
+	tracks  map[RTPType]*multicastTrack
+	members map[string]bool // IDs of the players joined
+	lock    sync.Mutex
+	rtcpAt  time.Time
+}
+
+// Multicast gets the group of the pusher, nil while no player joined
+func (pusher *Pusher) Multicast() *Multicast {
+	pusher.multicastLock.Lock()
+	defer pusher.multicastLock.Unlock()
+	return pusher.multicast
+}
+
+// JoinMulticast adds player to the group of the pusher, allocating the group
+// for the first one
+func (pusher *Pusher) JoinMulticast(player *Player) (m *Multicast, err error) {
+	pusher.multicastLock.Lock()
+	defer pusher.multicastLock.Unlock()
+	if m = pusher.multicast; m == nil {
+		ip, err := allocMulticastGroup()
+		if err != nil {
+			return nil, err
+		}
+		m = &Multicast{
+			IP:      ip,
+			TTL:     key("multicast_ttl").MustInt(16),
+			pusher:  pusher,
+			tracks:  make(map[RTPType]*multicastTrack),
+			members: make(map[string]bool),
+		}
+		pusher.multicast = m
+		pusher.Logger().Printf("multicast to %v", ip)
+	}
+	m.lock.Lock()
+	m.members[player.ID] = true
+	m.lock.Unlock()
+	return
+}
+
+// LeaveMulticast removes player from the group, the last one closes it
+func (pusher *Pusher) LeaveMulticast(player *Player) {
+	pusher.multicastLock.Lock()
+	defer pusher.multicastLock.Unlock()
+	m := pusher.multicast
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	delete(m.members, player.ID)
+	empty := len(m.members) == 0
+	m.lock.Unlock()
+	if empty {
+		pusher.multicast = nil
+		m.close()
+		pusher.Logger().Printf("multicast to %v closed", m.IP)
+	}
+}
+
+// Setup opens the ports of track typ, video and audio get a pair each
+func (m *Multicast) Setup(typ RTPType) (port int, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if track, ok := m.tracks[typ]; ok {
+		return track.port, nil
+	}
+	port = key("multicast_port").MustInt(26000)
+	if typ == RTP_TYPE_AUDIO {
+		port += 2
+	}
+	track := &multicastTrack{
+		port:     port,
+		rewriter: newRTPRewriter(m.pusher.clockRate(typ)),
+		sender:   newRTPSender(m.pusher.clockRate(typ)),
+	}
+	if track.conn, err = m.dial(port); err != nil {
+		return
+	}
+	if track.controlConn, err = m.dial(port + 1); err != nil {
+		track.conn.Close()
+		return
+	}
+	m.tracks[typ] = track
+	return
+}
+
+func (m *Multicast) dial(port int) (conn *net.UDPConn, err error) {
+	if conn, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: m.IP, Port: port}); err != nil {
+		return
+	}
+	if err = setMulticastTTL(conn, m.TTL); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("set multicast ttl failed, %v", err)
+	}
+	networkBuffer := key("network_buffer").MustInt(1048576)
+	if err := conn.SetWriteBuffer(networkBuffer); err != nil {
+		m.pusher.Logger().Printf("multicast conn set write buffer error, %v", err)
+	}
+	return
+}
+
+// Transport gets the Transport header answering a multicast SETUP of the track on port
+func (m *Multicast) Transport(port int) string {
+	return fmt.Sprintf("RTP/AVP;multicast;destination=%s;port=%d-%d;ttl=%d", m.IP, port, port+1, m.TTL)
+}
+
+// send sends a media pack of the pusher to the group, with sender reports
+// every RTCP_INTERVAL
+func (m *Multicast) send(pack *RTPPack) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	track, ok := m.tracks[pack.Type]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	pack = track.rewriter.rewrite(pack, now)
+	n, err := track.conn.Write(pack.Buffer.Bytes())
+	if err != nil {
+		return
+	}
+	m.pusher.AddOutputBytes(n)
+	if rtp := ParseRTP(pack.Buffer.Bytes()); rtp != nil {
+		track.sender.onRTP(rtp)
+	}
+	if now.Sub(m.rtcpAt) < RTCP_INTERVAL {
+		return
+	}
+	m.rtcpAt = now
+	for typ, track := range m.tracks {
+		ntp, ts, ok := m.pusher.srcWallclock(typ, now)
+		if !ok {
+			continue
+		}
+		report := track.sender.senderReport(ntp, track.rewriter.timestamp(ts), now)
+		track.controlConn.Write(report)
+	}
+}
+
+func (m *Multicast) close() {
+	m.lock.Lock()
+	for _, track := range m.tracks {
+		track.conn.Close()
+		track.controlConn.Close()
+	}
+	m.tracks = make(map[RTPType]*multicastTrack)
+	m.lock.Unlock()
+	freeMulticastGroup(m.IP)
+}
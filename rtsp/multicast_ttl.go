@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package rtsp
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticastTTL sets the time to live of multicast packets sent on conn
+func setMulticastTTL(conn *net.UDPConn, ttl int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
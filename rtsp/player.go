@@ -1,6 +1,7 @@
 package rtsp
 
 import (
+	"bytes"
 	"sync"
 	"time"
 )
@@ -13,11 +14,16 @@ type Player struct {
 	queueLimit           int
 	dropPacketWhenPaused bool
 	paused               bool
+	senders              map[RTPType]*rtpSender
+	sendersLock          sync.Mutex
+	rtcpAt               time.Time
+	rewriters            map[RTPType]*rtpRewriter
+	sink                 Sink // gets the packets instead of the session, see NewSinkPlayer
 }
 
 func NewPlayer(session *Session, pusher *Pusher) (player *Player) {
-	queueLimit := 0           //Key("player_queue_limit").MustInt(0)
-	dropPacketWhenPaused := 0 //Key("drop_packet_when_paused").MustInt(0)
+	queueLimit := key("player_queue_limit").MustInt(0)
+	dropPacketWhenPaused := key("drop_packet_when_paused").MustInt(0)
 	player = &Player{
 		Session:              session,
 		Pusher:               pusher,
@@ -26,7 +32,11 @@ func NewPlayer(session *Session, pusher *Pusher) (player *Player) {
 		queueLimit:           queueLimit,
 		dropPacketWhenPaused: dropPacketWhenPaused != 0,
 		paused:               false,
+		senders:              make(map[RTPType]*rtpSender),
+		rewriters:            make(map[RTPType]*rtpRewriter),
 	}
+	// receiver reports of the player
+	session.RTPHandles = append(session.RTPHandles, player.onRTCP)
 	session.StopHandles = append(session.StopHandles, func() {
 		pusher.RemovePlayer(player)
 		player.cond.Broadcast()
@@ -34,6 +44,16 @@ func NewPlayer(session *Session, pusher *Pusher) (player *Player) {
 	return
 }
 
+// NewSinkPlayer makes a player handing packets to sink, for viewers served
+// by other protocols like rtmp. They are listed, kicked and counted like rtsp
+// players, session only carries their details.
+func NewSinkPlayer(session *Session, pusher *Pusher, sink Sink) (player *Player) {
+	player = NewPlayer(session, pusher)
+	player.sink = sink
+	session.StopHandles = append(session.StopHandles, sink.Stop)
+	return
+}
+
 func (player *Player) QueueRTP(pack *RTPPack) *Player {
 	logger := player.logger
 	if pack == nil {
@@ -43,6 +63,14 @@ func (player *Player) QueueRTP(pack *RTPPack) *Player {
 	if player.paused && player.dropPacketWhenPaused {
 		return player
 	}
+	if player.TransType == TRANS_TYPE_MULTICAST {
+		// the pusher sends to the group
+		return player
+	}
+	if player.sink != nil {
+		player.sink.QueueRTP(pack)
+		return player
+	}
 	player.cond.L.Lock()
 	player.queue = append(player.queue, pack)
 	if oldLen := len(player.queue); player.queueLimit > 0 && oldLen > player.queueLimit {
@@ -58,6 +86,10 @@ func (player *Player) QueueRTP(pack *RTPPack) *Player {
 }
 
 func (player *Player) Start() {
+	if player.sink != nil {
+		// the sink serves the viewer
+		return
+	}
 	logger := player.logger
 	timer := time.Unix(0, 0)
 	for !player.Stoped {
@@ -81,8 +113,11 @@ func (player *Player) Start() {
 			}
 			continue
 		}
+		pack = player.rewrite(pack)
 		if err := player.SendRTP(pack); err != nil {
 			logger.Println(err)
+		} else {
+			player.onSent(pack)
 		}
 		elapsed := time.Now().Sub(timer)
 		if player.debugLogEnable && elapsed >= 30*time.Second {
@@ -92,6 +127,120 @@ func (player *Player) Start() {
 	}
 }
 
+// rewrite keeps the rtp headers sent to the player continuous when the
+// source of the pusher changes
+func (player *Player) rewrite(pack *RTPPack) *RTPPack {
+	if pack.Type != RTP_TYPE_AUDIO && pack.Type != RTP_TYPE_VIDEO {
+		return pack
+	}
+	rewriter, ok := player.rewriters[pack.Type]
+	if !ok {
+		rewriter = newRTPRewriter(player.Pusher.clockRate(pack.Type))
+		player.rewriters[pack.Type] = rewriter
+	}
+	return rewriter.rewrite(pack, time.Now())
+}
+
+// onSent counts a sent media pack and sends sender reports every RTCP_INTERVAL
+func (player *Player) onSent(pack *RTPPack) {
+	if pack.Type != RTP_TYPE_AUDIO && pack.Type != RTP_TYPE_VIDEO {
+		return
+	}
+	rtp := ParseRTP(pack.Buffer.Bytes())
+	if rtp == nil {
+		return
+	}
+	player.sender(pack.Type, true).onRTP(rtp)
+	now := time.Now()
+	if now.Sub(player.rtcpAt) < RTCP_INTERVAL {
+		return
+	}
+	player.rtcpAt = now
+	for typ, control := range map[RTPType]RTPType{RTP_TYPE_AUDIO: RTP_TYPE_AUDIOCONTROL, RTP_TYPE_VIDEO: RTP_TYPE_VIDEOCONTROL} {
+		sender := player.sender(typ, false)
+		if sender == nil || !player.hasControl(control) {
+			continue
+		}
+		ntp, ts, ok := player.Pusher.srcWallclock(typ, now)
+		if !ok {
+			continue
+		}
+		if rewriter, ok := player.rewriters[typ]; ok {
+			ts = rewriter.timestamp(ts)
+		}
+		report := sender.senderReport(ntp, ts, now)
+		if err := player.SendRTP(&RTPPack{Type: control, Buffer: bytes.NewBuffer(report)}); err != nil {
+			player.logger.Printf("send sender report failed, %v", err)
+		}
+	}
+}
+
+// sender gets statistics of the track typ sent to the player, created when asked to
+func (player *Player) sender(typ RTPType, create bool) *rtpSender {
+	player.sendersLock.Lock()
+	defer player.sendersLock.Unlock()
+	sender, ok := player.senders[typ]
+	if !ok && create {
+		sender = newRTPSender(player.Pusher.clockRate(typ))
+		player.senders[typ] = sender
+	}
+	return sender
+}
+
+// onRTCP keeps report blocks of the player about the tracks it receives
+func (player *Player) onRTCP(pack *RTPPack) {
+	typ := RTP_TYPE_VIDEO
+	switch pack.Type {
+	case RTP_TYPE_AUDIOCONTROL:
+		typ = RTP_TYPE_AUDIO
+	case RTP_TYPE_VIDEOCONTROL:
+	default:
+		return
+	}
+	sender := player.sender(typ, false)
+	if sender == nil {
+		return
+	}
+	now := time.Now()
+	for _, info := range ParseRTCP(pack.Buffer.Bytes()) {
+		if info.PacketType != RTCP_SR && info.PacketType != RTCP_RR {
+			continue
+		}
+		for _, block := range info.Reports {
+			sender.onReport(block, now)
+		}
+	}
+}
+
+// Stats gets link quality of the player by media, from its receiver reports
+func (player *Player) Stats() map[string]TrackStats {
+	now := time.Now()
+	stats := make(map[string]TrackStats)
+	for typ, media := range map[RTPType]string{RTP_TYPE_AUDIO: "audio", RTP_TYPE_VIDEO: "video"} {
+		if sender := player.sender(typ, false); sender != nil {
+			stats[media] = sender.stats(now)
+		}
+	}
+	return stats
+}
+
+// hasControl tells if the player set up the rtcp channel of typ
+func (player *Player) hasControl(typ RTPType) bool {
+	if player.TransType == TRANS_TYPE_UDP {
+		if player.UDPClient == nil {
+			return false
+		}
+		if typ == RTP_TYPE_AUDIOCONTROL {
+			return player.UDPClient.AControlConn != nil
+		}
+		return player.UDPClient.VControlConn != nil
+	}
+	if typ == RTP_TYPE_AUDIOCONTROL {
+		return player.aRTPControlChannel >= 0
+	}
+	return player.vRTPControlChannel >= 0
+}
+
 func (player *Player) Pause(paused bool) {
 	if paused {
 		player.logger.Printf("Player %s, Pause\n", player.String())
@@ -1,17 +1,35 @@
 package rtsp
 
 import (
+	"bytes"
 	"log"
+	"math/rand"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Sink consumes rtp packets of a pusher like a player without a session,
+// QueueRTP must not block
+type Sink interface {
+	QueueRTP(pack *RTPPack)
+	Stop()
+}
+
+// sinks implementing ReadAt are attached to every pusher, like hls muxers,
+// and consume it only while read
+type readAtSink interface {
+	ReadAt() time.Time
+}
+
 type Pusher struct {
 	*Session
 	*RTSPClient
 	players           map[string]*Player //SessionID <-> Player
 	playersLock       sync.RWMutex
+	sinks             map[string]Sink
+	sinksLock         sync.RWMutex
 	gopCacheEnable    bool
 	gopCache          []*RTPPack
 	gopCacheLock      sync.RWMutex
@@ -19,6 +37,14 @@ type Pusher struct {
 	spsppsInSTAPaPack bool
 	cond              *sync.Cond
 	queue             []*RTPPack
+	receivers         map[RTPType]*rtpReceiver // reception statistics of the source tracks
+	receiversLock     sync.Mutex
+	rtcpSSRC          uint32
+	rtcpAt            time.Time
+	generation        uint32 // bumped for each session or client bound as source
+	held              int32
+	multicast         *Multicast // nil while no player joined
+	multicastLock     sync.Mutex
 }
 
 func (pusher *Pusher) String() string {
@@ -46,9 +72,36 @@ func (pusher *Pusher) Stoped() bool {
 	if pusher.Session != nil {
 		return pusher.Session.Stoped
 	}
+	if pusher.Held() {
+		return false
+	}
 	return pusher.RTSPClient.Stoped
 }
 
+// Hold keeps a client pusher with its players and sinks when the client
+// stops, until Release or a RebindClient to a reconnected one
+func (pusher *Pusher) Hold() {
+	atomic.StoreInt32(&pusher.held, 1)
+}
+
+func (pusher *Pusher) Held() bool {
+	return atomic.LoadInt32(&pusher.held) == 1
+}
+
+// Release ends a held pusher like a client stop would have
+func (pusher *Pusher) Release() {
+	if !atomic.CompareAndSwapInt32(&pusher.held, 1, 0) {
+		pusher.Stop()
+		return
+	}
+	client := pusher.RTSPClient
+	if !client.Stoped {
+		client.Stop()
+		return
+	}
+	pusher.teardown()
+}
+
 func (pusher *Pusher) Path() string {
 	if pusher.Session != nil {
 		return pusher.Session.Path
@@ -120,7 +173,7 @@ func (pusher *Pusher) InBytes() int {
 	if pusher.Session != nil {
 		return pusher.Session.InBytes
 	}
-	return pusher.RTSPClient.InBytes
+	return int(atomic.LoadInt64(&pusher.RTSPClient.InBytes))
 }
 
 func (pusher *Pusher) OutBytes() int {
@@ -156,21 +209,43 @@ func NewClientPusher(client *RTSPClient) (pusher *Pusher) {
 		RTSPClient:     client,
 		Session:        nil,
 		players:        make(map[string]*Player),
-		gopCacheEnable: true, //Key("gop_cache_enable").MustBool(true),
+		sinks:          make(map[string]Sink),
+		gopCacheEnable: key("gop_cache_enable").MustBool(true),
 		gopCache:       make([]*RTPPack, 0),
 
-		cond:  sync.NewCond(&sync.Mutex{}),
-		queue: make([]*RTPPack, 0),
+		cond:      sync.NewCond(&sync.Mutex{}),
+		queue:     make([]*RTPPack, 0),
+		receivers: make(map[RTPType]*rtpReceiver),
+		rtcpSSRC:  rand.Uint32(),
 	}
+	pusher.bindClient(client)
+	return
+}
+
+func (pusher *Pusher) bindClient(client *RTSPClient) {
+	pusher.RTSPClient = client
+	generation := atomic.AddUint32(&pusher.generation, 1)
 	client.RTPHandles = append(client.RTPHandles, func(pack *RTPPack) {
+		if client != pusher.RTSPClient {
+			return
+		}
+		pack.generation = generation
 		pusher.QueueRTP(pack)
 	})
 	client.StopHandles = append(client.StopHandles, func() {
-		pusher.ClearPlayer()
-		pusher.Server().RemovePusher(pusher)
-		pusher.cond.Broadcast()
+		if client != pusher.RTSPClient || pusher.Held() {
+			return
+		}
+		pusher.teardown()
 	})
-	return
+}
+
+// teardown drops players and sinks of a client pusher and removes it
+func (pusher *Pusher) teardown() {
+	pusher.ClearPlayer()
+	pusher.ClearSink()
+	pusher.Server().RemovePusher(pusher)
+	pusher.cond.Broadcast()
 }
 
 func NewPusher(session *Session) (pusher *Pusher) {
@@ -178,11 +253,14 @@ func NewPusher(session *Session) (pusher *Pusher) {
 		Session:        session,
 		RTSPClient:     nil,
 		players:        make(map[string]*Player),
-		gopCacheEnable: true, //Key("gop_cache_enable").MustBool(true),
+		sinks:          make(map[string]Sink),
+		gopCacheEnable: key("gop_cache_enable").MustBool(true),
 		gopCache:       make([]*RTPPack, 0),
 
-		cond:  sync.NewCond(&sync.Mutex{}),
-		queue: make([]*RTPPack, 0),
+		cond:      sync.NewCond(&sync.Mutex{}),
+		queue:     make([]*RTPPack, 0),
+		receivers: make(map[RTPType]*rtpReceiver),
+		rtcpSSRC:  rand.Uint32(),
 	}
 	pusher.bindSession(session)
 	return
@@ -191,11 +269,13 @@ func NewPusher(session *Session) (pusher *Pusher) {
 func (pusher *Pusher) bindSession(session *Session) {
 	pusher.Logger().Println("bindSession")
 	pusher.Session = session
+	generation := atomic.AddUint32(&pusher.generation, 1)
 	session.RTPHandles = append(session.RTPHandles, func(pack *RTPPack) {
 		if session != pusher.Session {
 			session.logger.Printf("Session recv rtp to pusher.but pusher got a new session[%v].", pusher.Session.ID)
 			return
 		}
+		pack.generation = generation
 		pusher.QueueRTP(pack)
 	})
 	session.StopHandles = append(session.StopHandles, func() {
@@ -204,6 +284,7 @@ func (pusher *Pusher) bindSession(session *Session) {
 			return
 		}
 		pusher.ClearPlayer()
+		pusher.ClearSink()
 		pusher.Server().RemovePusher(pusher)
 		pusher.cond.Broadcast()
 		if pusher.UDPServer != nil {
@@ -219,8 +300,10 @@ func (pusher *Pusher) RebindSession(session *Session) bool {
 		return false
 	}
 	sess := pusher.Session
+	sdpRaw := pusher.SDPRaw()
 	pusher.bindSession(session)
 	session.Pusher = pusher
+	pusher.announce(sdpRaw)
 
 	pusher.gopCacheLock.Lock()
 	pusher.gopCache = make([]*RTPPack, 0)
@@ -237,13 +320,49 @@ func (pusher *Pusher) RebindClient(client *RTSPClient) bool {
 		return false
 	}
 	sess := pusher.RTSPClient
-	pusher.RTSPClient = client
+	sdpRaw := pusher.SDPRaw()
+	pusher.bindClient(client)
+	pusher.announce(sdpRaw)
+
+	pusher.gopCacheLock.Lock()
+	pusher.gopCache = make([]*RTPPack, 0)
+	pusher.gopCacheLock.Unlock()
 	if sess != nil {
 		sess.Stop()
 	}
 	return true
 }
 
+// announce sends the sdp to players when it differs from oldSDP in more
+// than the origin, players go on with the rewritten stream either way
+func (pusher *Pusher) announce(oldSDP string) {
+	sdpRaw := pusher.SDPRaw()
+	if !sdpChanged(oldSDP, sdpRaw) {
+		return
+	}
+	for _, player := range pusher.GetPlayers() {
+		if player.sink != nil {
+			// sinks follow source changes themselves
+			continue
+		}
+		if err := player.Announce(sdpRaw); err != nil {
+			player.logger.Printf("announce sdp change failed, %v", err)
+		}
+	}
+}
+
+func sdpChanged(a, b string) bool {
+	strip := func(sdpRaw string) (lines []string) {
+		for _, line := range strings.Split(strings.TrimSpace(sdpRaw), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "o=") {
+				lines = append(lines, line)
+			}
+		}
+		return
+	}
+	return strings.Join(strip(a), "\n") != strings.Join(strip(b), "\n")
+}
+
 func (pusher *Pusher) QueueRTP(pack *RTPPack) *Pusher {
 	pusher.cond.L.Lock()
 	pusher.queue = append(pusher.queue, pack)
@@ -273,9 +392,22 @@ func (pusher *Pusher) Start() {
 			continue
 		}
 
+		switch pack.Type {
+		case RTP_TYPE_AUDIOCONTROL, RTP_TYPE_VIDEOCONTROL:
+			// reports of the source end here, players get sender reports of the server
+			pusher.onRTCP(pack)
+			continue
+		}
+		rtp := ParseRTP(pack.Buffer.Bytes())
+		if rtp != nil {
+			pusher.onRTP(pack.Type, rtp)
+		}
+		if pack.Type == RTP_TYPE_VIDEO && rtp != nil && pusher.shouldSequenceStart(rtp) {
+			pack.SequenceStart = true
+		}
 		if pusher.gopCacheEnable && pack.Type == RTP_TYPE_VIDEO {
 			pusher.gopCacheLock.Lock()
-			if rtp := ParseRTP(pack.Buffer.Bytes()); rtp != nil && pusher.shouldSequenceStart(rtp) {
+			if pack.SequenceStart {
 				pusher.gopCache = make([]*RTPPack, 0)
 			}
 			pusher.gopCache = append(pusher.gopCache, pack)
@@ -285,6 +417,112 @@ func (pusher *Pusher) Start() {
 	}
 }
 
+// receiver gets reception statistics of the source track typ, created when asked to
+func (pusher *Pusher) receiver(typ RTPType, create bool) *rtpReceiver {
+	pusher.receiversLock.Lock()
+	defer pusher.receiversLock.Unlock()
+	r, ok := pusher.receivers[typ]
+	if !ok && create {
+		r = newRTPReceiver(pusher.clockRate(typ))
+		pusher.receivers[typ] = r
+	}
+	return r
+}
+
+// clockRate gets the rtp clock rate of track typ from the sdp, 0 if unknown
+func (pusher *Pusher) clockRate(typ RTPType) int {
+	media := "video"
+	if typ == RTP_TYPE_AUDIO {
+		media = "audio"
+	}
+	if info, ok := ParseSDP(pusher.SDPRaw())[media]; ok {
+		return info.TimeScale
+	}
+	return 0
+}
+
+func (pusher *Pusher) onRTP(typ RTPType, rtp *RTPInfo) {
+	now := time.Now()
+	pusher.receiver(typ, true).onRTP(rtp, now)
+	if now.Sub(pusher.rtcpAt) < RTCP_INTERVAL {
+		return
+	}
+	pusher.rtcpAt = now
+	for typ, control := range map[RTPType]RTPType{RTP_TYPE_AUDIO: RTP_TYPE_AUDIOCONTROL, RTP_TYPE_VIDEO: RTP_TYPE_VIDEOCONTROL} {
+		if r := pusher.receiver(typ, false); r != nil {
+			r.sample(now)
+			report := receiverReport(pusher.rtcpSSRC, r.reportBlock(now), RTCP_CNAME)
+			if err := pusher.sendRTCP(control, report); err != nil {
+				pusher.Logger().Printf("send receiver report failed, %v", err)
+			}
+		}
+	}
+}
+
+func (pusher *Pusher) onRTCP(pack *RTPPack) {
+	typ := RTP_TYPE_VIDEO
+	if pack.Type == RTP_TYPE_AUDIOCONTROL {
+		typ = RTP_TYPE_AUDIO
+	}
+	for _, info := range ParseRTCP(pack.Buffer.Bytes()) {
+		if info.PacketType == RTCP_SR {
+			pusher.receiver(typ, true).onSR(info.NTPTime, info.RTPTime, time.Now())
+		}
+	}
+}
+
+// Stats gets link quality of the source by media, rtt is only known for
+// pulled streams that send keepalives
+func (pusher *Pusher) Stats() map[string]TrackStats {
+	now := time.Now()
+	stats := make(map[string]TrackStats)
+	for typ, media := range map[RTPType]string{RTP_TYPE_AUDIO: "audio", RTP_TYPE_VIDEO: "video"} {
+		if r := pusher.receiver(typ, false); r != nil {
+			track := r.stats(now)
+			udpServer := pusher.UDPServer
+			if pusher.RTSPClient != nil {
+				track.RTT = float64(pusher.RTSPClient.RTT) / float64(time.Millisecond)
+				udpServer = pusher.RTSPClient.UDPServer
+			}
+			if udpServer != nil {
+				if reorder, ok := udpServer.ReorderStats(typ); ok {
+					track.Reorder = &reorder
+				}
+			}
+			stats[media] = track
+		}
+	}
+	return stats
+}
+
+// sendRTCP sends a report to the source over its transport
+func (pusher *Pusher) sendRTCP(typ RTPType, data []byte) error {
+	pack := &RTPPack{Type: typ, Buffer: bytes.NewBuffer(data)}
+	if client := pusher.RTSPClient; client != nil {
+		return client.WriteRTP(pack)
+	}
+	session := pusher.Session
+	if session.TransType == TRANS_TYPE_UDP {
+		if pusher.UDPServer == nil {
+			return nil
+		}
+		return pusher.UDPServer.SendRTCP(pack)
+	}
+	// sessions without interleaved control channels, like rtmp publishers
+	if typ == RTP_TYPE_AUDIOCONTROL && session.aRTPControlChannel < 0 || typ == RTP_TYPE_VIDEOCONTROL && session.vRTPControlChannel < 0 {
+		return nil
+	}
+	return session.SendRTP(pack)
+}
+
+// srcWallclock maps the source track typ to ntp and rtp timestamps at now
+func (pusher *Pusher) srcWallclock(typ RTPType, now time.Time) (ntp uint64, rtp uint32, ok bool) {
+	if r := pusher.receiver(typ, false); r != nil {
+		return r.wallclock(now)
+	}
+	return
+}
+
 func (pusher *Pusher) Stop() {
 	if pusher.Session != nil {
 		pusher.Session.Stop()
@@ -295,12 +533,44 @@ func (pusher *Pusher) Stop() {
 
 func (pusher *Pusher) BroadcastRTP(pack *RTPPack) *Pusher {
 	for _, player := range pusher.GetPlayers() {
+		if player.TransType == TRANS_TYPE_MULTICAST {
+			// sent once to the group below
+			continue
+		}
 		player.QueueRTP(pack)
 		pusher.AddOutputBytes(pack.Buffer.Len())
 	}
+	if m := pusher.Multicast(); m != nil {
+		m.send(pack)
+	}
+	pusher.sinksLock.RLock()
+	for _, sink := range pusher.sinks {
+		sink.QueueRTP(pack)
+	}
+	pusher.sinksLock.RUnlock()
 	return pusher
 }
 
+// ReadAt gets when the pusher was last consumed, now while it has players or
+// sinks reading it, zero when nobody ever did
+func (pusher *Pusher) ReadAt() (readAt time.Time) {
+	if len(pusher.GetPlayers()) > 0 {
+		return time.Now()
+	}
+	pusher.sinksLock.RLock()
+	defer pusher.sinksLock.RUnlock()
+	for _, sink := range pusher.sinks {
+		s, ok := sink.(readAtSink)
+		if !ok {
+			return time.Now()
+		}
+		if t := s.ReadAt(); t.After(readAt) {
+			readAt = t
+		}
+	}
+	return
+}
+
 func (pusher *Pusher) GetPlayers() (players map[string]*Player) {
 	players = make(map[string]*Player)
 	pusher.playersLock.RLock()
@@ -335,6 +605,7 @@ func (pusher *Pusher) AddPlayer(player *Player) *Pusher {
 		pusher.players[player.ID] = player
 		go player.Start()
 		logger.Printf("%v start, now player size[%d]", player, len(pusher.players))
+		pusher.Server().Hooks.Notify(sessionEvent("on_player_start", player.Session))
 	}
 	pusher.playersLock.Unlock()
 	return pusher
@@ -347,9 +618,13 @@ func (pusher *Pusher) RemovePlayer(player *Player) *Pusher {
 		pusher.playersLock.Unlock()
 		return pusher
 	}
+	_, ok := pusher.players[player.ID]
 	delete(pusher.players, player.ID)
 	logger.Printf("%v end, now player size[%d]\n", player, len(pusher.players))
 	pusher.playersLock.Unlock()
+	if ok {
+		pusher.Server().Hooks.Notify(sessionEvent("on_player_stop", player.Session))
+	}
 	return pusher
 }
 
@@ -366,10 +641,59 @@ func (pusher *Pusher) ClearPlayer() {
 	go func() { // do not block
 		for _, v := range players {
 			v.Stop()
+			pusher.Server().Hooks.Notify(sessionEvent("on_player_stop", v.Session))
 		}
 	}()
 }
 
+// AddSink attaches sink with id, it gets the cached GOP first
+func (pusher *Pusher) AddSink(id string, sink Sink) bool {
+	pusher.sinksLock.Lock()
+	defer pusher.sinksLock.Unlock()
+	if _, ok := pusher.sinks[id]; ok {
+		return false
+	}
+	if pusher.gopCacheEnable {
+		pusher.gopCacheLock.RLock()
+		for _, pack := range pusher.gopCache {
+			sink.QueueRTP(pack)
+		}
+		pusher.gopCacheLock.RUnlock()
+	}
+	pusher.sinks[id] = sink
+	pusher.Logger().Printf("sink[%s] added, now sink size[%d]", id, len(pusher.sinks))
+	return true
+}
+
+// RemoveSink detaches and stops sink with id
+func (pusher *Pusher) RemoveSink(id string) bool {
+	pusher.sinksLock.Lock()
+	sink, ok := pusher.sinks[id]
+	delete(pusher.sinks, id)
+	pusher.sinksLock.Unlock()
+	if ok {
+		sink.Stop()
+		pusher.Logger().Printf("sink[%s] removed", id)
+	}
+	return ok
+}
+
+func (pusher *Pusher) GetSink(id string) Sink {
+	pusher.sinksLock.RLock()
+	defer pusher.sinksLock.RUnlock()
+	return pusher.sinks[id]
+}
+
+func (pusher *Pusher) ClearSink() {
+	pusher.sinksLock.Lock()
+	sinks := pusher.sinks
+	pusher.sinks = make(map[string]Sink)
+	pusher.sinksLock.Unlock()
+	for _, sink := range sinks {
+		sink.Stop()
+	}
+}
+
 func (pusher *Pusher) shouldSequenceStart(rtp *RTPInfo) bool {
 	if strings.EqualFold(pusher.VCodec(), "h264") {
 		var realNALU uint8
@@ -0,0 +1,180 @@
+package rtsp
+
+import (
+	"sync"
+	"time"
+)
+
+// sequence jumps beyond this restart the buffer instead of waiting for a gap, RFC 3550 A.1
+const MAX_DROPOUT = 3000
+
+// packets held at most, older gaps are given up early past it
+const REORDER_BUFFER_SIZE = 500
+
+// ReorderStats counters of a reorder buffer
+type ReorderStats struct {
+	Lost      uint64 `json:"lost"`      // never arrived within the latency
+	Duplicate uint64 `json:"duplicate"` // dropped, seen already
+	Late      uint64 `json:"late"`      // dropped, arrived after its gap was given up
+	Reordered uint64 `json:"reordered"` // arrived out of order and put back in place
+}
+
+type pendingPack struct {
+	pack *RTPPack
+	at   time.Time
+}
+
+// reorderBuffer puts udp packets of one track back in sequence order, holding
+// them up to latency while waiting for a missing one
+type reorderBuffer struct {
+	lock    sync.Mutex
+	latency time.Duration
+	out     func(*RTPPack)
+	started bool
+	nextSeq uint16
+	pending map[uint16]pendingPack
+	emitted [1024]int32 // seq+1 of recently handed out packets by seq%1024
+	stats   ReorderStats
+	quit    chan struct{}
+}
+
+// newReorderBuffer hands ordered packets to out, a goroutine gives up gaps
+// while no packets arrive until stop is called
+func newReorderBuffer(latency time.Duration, out func(*RTPPack)) *reorderBuffer {
+	b := &reorderBuffer{
+		latency: latency,
+		out:     out,
+		pending: make(map[uint16]pendingPack),
+		quit:    make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(latency / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.quit:
+				return
+			case now := <-ticker.C:
+				b.lock.Lock()
+				b.flush(now)
+				b.lock.Unlock()
+			}
+		}
+	}()
+	return b
+}
+
+func (b *reorderBuffer) stop() {
+	close(b.quit)
+}
+
+// push queues pack, packets that can't be parsed pass through
+func (b *reorderBuffer) push(pack *RTPPack) {
+	rtp := ParseRTP(pack.Buffer.Bytes())
+	if rtp == nil {
+		b.out(pack)
+		return
+	}
+	seq := uint16(rtp.SequenceNumber)
+	now := time.Now()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.started {
+		b.started, b.nextSeq = true, seq
+	}
+	diff := int16(seq - b.nextSeq)
+	switch {
+	case diff < 0 && -int(diff) <= MAX_DROPOUT:
+		if b.emitted[seq%1024] == int32(seq)+1 {
+			b.stats.Duplicate++
+		} else {
+			b.stats.Late++
+		}
+		return
+	case diff < 0 || int(diff) > MAX_DROPOUT:
+		// the source restarted or jumped, what is held can't be completed
+		b.drain()
+		b.nextSeq = seq
+	case diff > 0:
+		if _, ok := b.pending[seq]; ok {
+			b.stats.Duplicate++
+			return
+		}
+		b.pending[seq] = pendingPack{pack: pack, at: now}
+		if len(b.pending) > REORDER_BUFFER_SIZE {
+			b.skip()
+		}
+		b.flush(now)
+		return
+	}
+	if len(b.pending) > 0 {
+		b.stats.Reordered++
+	}
+	b.emit(seq, pack)
+	b.release()
+	b.flush(now)
+}
+
+// emit hands out pack as the next in sequence
+func (b *reorderBuffer) emit(seq uint16, pack *RTPPack) {
+	b.emitted[seq%1024] = int32(seq) + 1
+	b.nextSeq = seq + 1
+	b.out(pack)
+}
+
+// release hands out held packets following the last one in sequence
+func (b *reorderBuffer) release() {
+	for {
+		p, ok := b.pending[b.nextSeq]
+		if !ok {
+			return
+		}
+		delete(b.pending, b.nextSeq)
+		b.emit(b.nextSeq, p.pack)
+	}
+}
+
+// skip gives up the gap before the first held packet
+func (b *reorderBuffer) skip() {
+	next := b.nextSeq
+	for i := 1; i <= MAX_DROPOUT; i++ {
+		next++
+		if _, ok := b.pending[next]; ok {
+			b.stats.Lost += uint64(i)
+			b.nextSeq = next
+			b.release()
+			return
+		}
+	}
+	// held packets are always within MAX_DROPOUT, never expected here
+	b.pending = make(map[uint16]pendingPack)
+}
+
+// flush gives up gaps while the first held packet waited longer than latency
+func (b *reorderBuffer) flush(now time.Time) {
+	for len(b.pending) > 0 {
+		oldest := now
+		for _, p := range b.pending {
+			if p.at.Before(oldest) {
+				oldest = p.at
+			}
+		}
+		if now.Sub(oldest) < b.latency {
+			return
+		}
+		b.skip()
+	}
+}
+
+// drain gives up every gap and hands out all held packets
+func (b *reorderBuffer) drain() {
+	for len(b.pending) > 0 {
+		b.skip()
+	}
+}
+
+func (b *reorderBuffer) Stats() ReorderStats {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.stats
+}
@@ -0,0 +1,112 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testRTPPack(seq uint16, timestamp, ssrc uint32) *RTPPack {
+	// a payload byte, ParseRTP rejects empty packets
+	header := make([]byte, RTP_FIXED_HEADER_LENGTH+1)
+	header[0] = 0x80
+	header[1] = 96
+	binary.BigEndian.PutUint16(header[2:], seq)
+	binary.BigEndian.PutUint32(header[4:], timestamp)
+	binary.BigEndian.PutUint32(header[8:], ssrc)
+	return &RTPPack{Type: RTP_TYPE_VIDEO, Buffer: bytes.NewBuffer(header)}
+}
+
+// newTestReorderBuffer without the flushing goroutine, tests call flush themselves
+func newTestReorderBuffer(latency time.Duration) (*reorderBuffer, *[]uint16) {
+	out := []uint16{}
+	b := &reorderBuffer{
+		latency: latency,
+		pending: make(map[uint16]pendingPack),
+		quit:    make(chan struct{}),
+	}
+	b.out = func(pack *RTPPack) {
+		out = append(out, uint16(ParseRTP(pack.Buffer.Bytes()).SequenceNumber))
+	}
+	return b, &out
+}
+
+func seqRange(from uint16, n int) []uint16 {
+	seqs := make([]uint16, n)
+	for i := range seqs {
+		seqs[i] = from + uint16(i)
+	}
+	return seqs
+}
+
+func TestReorderBufferPush(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    []uint16
+		want  []uint16
+		stats ReorderStats
+	}{
+		{"in order", []uint16{1, 2, 3}, []uint16{1, 2, 3}, ReorderStats{}},
+		{"swapped", []uint16{1, 3, 2, 4}, []uint16{1, 2, 3, 4}, ReorderStats{Reordered: 1}},
+		{"wraparound", []uint16{65534, 65535, 0, 1}, []uint16{65534, 65535, 0, 1}, ReorderStats{}},
+		{"swapped across wraparound", []uint16{65535, 1, 0}, []uint16{65535, 0, 1}, ReorderStats{Reordered: 1}},
+		{"duplicate emitted", []uint16{1, 2, 2, 3}, []uint16{1, 2, 3}, ReorderStats{Duplicate: 1}},
+		{"duplicate held", []uint16{1, 3, 3, 2}, []uint16{1, 2, 3}, ReorderStats{Duplicate: 1, Reordered: 1}},
+		{"duplicate across wraparound", []uint16{65535, 0, 65535}, []uint16{65535, 0}, ReorderStats{Duplicate: 1}},
+		{"old packet", []uint16{1000, 10}, []uint16{1000}, ReorderStats{Late: 1}},
+		{"jump ahead", []uint16{1, 3, 5000, 5001}, []uint16{1, 3, 5000, 5001}, ReorderStats{Lost: 1}},
+		{"restart behind", []uint16{10000, 10, 11}, []uint16{10000, 10, 11}, ReorderStats{}},
+		{"buffer full", append([]uint16{1}, seqRange(3, REORDER_BUFFER_SIZE+1)...),
+			append([]uint16{1}, seqRange(3, REORDER_BUFFER_SIZE+1)...), ReorderStats{Lost: 1}},
+	}
+	for _, test := range tests {
+		b, out := newTestReorderBuffer(time.Hour)
+		for _, seq := range test.in {
+			b.push(testRTPPack(seq, 0, 1))
+		}
+		if !reflect.DeepEqual(*out, test.want) {
+			t.Errorf("%s: push(%v) handed out %v, want %v", test.name, test.in, *out, test.want)
+		}
+		if stats := b.Stats(); stats != test.stats {
+			t.Errorf("%s: Stats() = %+v, want %+v", test.name, stats, test.stats)
+		}
+	}
+}
+
+func TestReorderBufferFlush(t *testing.T) {
+	latency := 100 * time.Millisecond
+	tests := []struct {
+		name  string
+		in    []uint16
+		after time.Duration
+		late  []uint16
+		want  []uint16
+		stats ReorderStats
+	}{
+		{"within latency", []uint16{1, 3, 4}, latency / 2, nil, []uint16{1}, ReorderStats{}},
+		{"gap given up", []uint16{1, 3, 4}, latency, []uint16{2}, []uint16{1, 3, 4}, ReorderStats{Lost: 1, Late: 1}},
+		{"several gaps", []uint16{1, 3, 6}, latency, []uint16{2, 4, 5}, []uint16{1, 3, 6}, ReorderStats{Lost: 3, Late: 3}},
+		{"gap across wraparound", []uint16{65534, 0, 1}, latency, []uint16{65535}, []uint16{65534, 0, 1}, ReorderStats{Lost: 1, Late: 1}},
+		{"continues after flush", []uint16{1, 3}, latency, []uint16{4, 5}, []uint16{1, 3, 4, 5}, ReorderStats{Lost: 1}},
+	}
+	for _, test := range tests {
+		b, out := newTestReorderBuffer(latency)
+		for _, seq := range test.in {
+			b.push(testRTPPack(seq, 0, 1))
+		}
+		b.lock.Lock()
+		b.flush(time.Now().Add(test.after))
+		b.lock.Unlock()
+		for _, seq := range test.late {
+			b.push(testRTPPack(seq, 0, 1))
+		}
+		if !reflect.DeepEqual(*out, test.want) {
+			t.Errorf("%s: handed out %v, want %v", test.name, *out, test.want)
+		}
+		if stats := b.Stats(); stats != test.stats {
+			t.Errorf("%s: Stats() = %+v, want %+v", test.name, stats, test.stats)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package rtsp
+
+import (
+	"encoding/binary"
+)
+
+// SDES item types
+const (
+	RTCP_SDES_END   = 0
+	RTCP_SDES_CNAME = 1
+	RTCP_SDES_NAME  = 2
+	RTCP_SDES_EMAIL = 3
+	RTCP_SDES_PHONE = 4
+	RTCP_SDES_LOC   = 5
+	RTCP_SDES_TOOL  = 6
+	RTCP_SDES_NOTE  = 7
+	RTCP_SDES_PRIV  = 8
+)
+
+// RTCPReportBlock reception report about one source, in SR and RR
+type RTCPReportBlock struct {
+	SSRC         uint32
+	FractionLost uint8 // fixed point, lost/256 since the previous report
+	PacketsLost  int32 // cumulative, 24 bit signed
+	HighestSeq   uint32
+	Jitter       uint32 // timestamp units
+	LSR          uint32 // middle 32 bits of the ntp time of the last SR
+	DLSR         uint32 // 1/65536 seconds since the last SR
+}
+
+// RTCPSDESChunk items describing one source
+type RTCPSDESChunk struct {
+	SSRC  uint32
+	Items map[int]string
+}
+
+type RTCPInfo struct {
+	Version    int
+	Padding    bool
+	Count      int // reports, chunks or sources, subtype of APP
+	PacketType int
+	Length     int // bytes of the packet including its header
+
+	SSRC uint32 // sender of SR, RR and APP
+
+	// SR sender info
+	NTPTime     uint64
+	RTPTime     uint32
+	PacketCount uint32
+	OctetCount  uint32
+
+	Reports []RTCPReportBlock // SR and RR
+	Chunks  []RTCPSDESChunk   // SDES
+	Sources []uint32          // BYE
+	Reason  string            // BYE
+	Name    string            // APP
+	Data    []byte            // APP
+}
+
+// ParseRTCP splits a compound rtcp packet, parsing stops at the first
+// malformed packet
+func ParseRTCP(rtcpBytes []byte) []*RTCPInfo {
+	infos := make([]*RTCPInfo, 0, 2)
+	for len(rtcpBytes) >= 4 {
+		length := 4 * (int(binary.BigEndian.Uint16(rtcpBytes[2:])) + 1)
+		if length > len(rtcpBytes) {
+			break
+		}
+		info := parseRTCPPacket(rtcpBytes[:length])
+		if info == nil {
+			break
+		}
+		infos = append(infos, info)
+		rtcpBytes = rtcpBytes[length:]
+	}
+	return infos
+}
+
+func parseRTCPPacket(packet []byte) *RTCPInfo {
+	firstByte := packet[0]
+	info := &RTCPInfo{
+		Version:    int(firstByte >> 6),
+		Padding:    (firstByte>>5)&1 == 1,
+		Count:      int(firstByte & 0x1f),
+		PacketType: int(packet[1]),
+		Length:     len(packet),
+	}
+	if info.Version != 2 {
+		return nil
+	}
+	body := packet[4:]
+	if info.Padding && len(body) > 0 {
+		paddingLen := int(body[len(body)-1])
+		if paddingLen > len(body) {
+			return nil
+		}
+		body = body[:len(body)-paddingLen]
+	}
+	switch info.PacketType {
+	case RTCP_SR:
+		if len(body) < 24 {
+			return nil
+		}
+		info.SSRC = binary.BigEndian.Uint32(body)
+		info.NTPTime = binary.BigEndian.Uint64(body[4:])
+		info.RTPTime = binary.BigEndian.Uint32(body[12:])
+		info.PacketCount = binary.BigEndian.Uint32(body[16:])
+		info.OctetCount = binary.BigEndian.Uint32(body[20:])
+		info.Reports = parseReportBlocks(body[24:], info.Count)
+	case RTCP_RR:
+		if len(body) < 4 {
+			return nil
+		}
+		info.SSRC = binary.BigEndian.Uint32(body)
+		info.Reports = parseReportBlocks(body[4:], info.Count)
+	case RTCP_SDES:
+		info.Chunks = parseSDESChunks(body, info.Count)
+	case RTCP_BYE:
+		for i := 0; i < info.Count && len(body) >= 4; i++ {
+			info.Sources = append(info.Sources, binary.BigEndian.Uint32(body))
+			body = body[4:]
+		}
+		if len(body) > 0 && int(body[0]) < len(body) {
+			info.Reason = string(body[1 : 1+int(body[0])])
+		}
+	case RTCP_APP:
+		if len(body) < 8 {
+			return nil
+		}
+		info.SSRC = binary.BigEndian.Uint32(body)
+		info.Name = string(body[4:8])
+		info.Data = body[8:]
+	}
+	return info
+}
+
+func parseReportBlocks(data []byte, count int) []RTCPReportBlock {
+	blocks := make([]RTCPReportBlock, 0, count)
+	for i := 0; i < count && len(data) >= 24; i++ {
+		lost := binary.BigEndian.Uint32(data[4:]) & 0xffffff
+		blocks = append(blocks, RTCPReportBlock{
+			SSRC:         binary.BigEndian.Uint32(data),
+			FractionLost: data[4],
+			PacketsLost:  int32(lost<<8) >> 8,
+			HighestSeq:   binary.BigEndian.Uint32(data[8:]),
+			Jitter:       binary.BigEndian.Uint32(data[12:]),
+			LSR:          binary.BigEndian.Uint32(data[16:]),
+			DLSR:         binary.BigEndian.Uint32(data[20:]),
+		})
+		data = data[24:]
+	}
+	return blocks
+}
+
+func parseSDESChunks(data []byte, count int) []RTCPSDESChunk {
+	chunks := make([]RTCPSDESChunk, 0, count)
+	for i := 0; i < count && len(data) >= 4; i++ {
+		chunk := RTCPSDESChunk{SSRC: binary.BigEndian.Uint32(data), Items: make(map[int]string)}
+		offset := 4
+		for offset < len(data) && data[offset] != RTCP_SDES_END {
+			if offset+2 > len(data) || offset+2+int(data[offset+1]) > len(data) {
+				return append(chunks, chunk)
+			}
+			itemLen := int(data[offset+1])
+			chunk.Items[int(data[offset])] = string(data[offset+2 : offset+2+itemLen])
+			offset += 2 + itemLen
+		}
+		chunks = append(chunks, chunk)
+		// the null item ends the chunk, padded to 32 bits
+		offset = (offset + 4) &^ 3
+		if offset > len(data) {
+			break
+		}
+		data = data[offset:]
+	}
+	return chunks
+}
@@ -0,0 +1,152 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func testReportBlock(ssrc uint32, fraction uint8, lost int32) []byte {
+	block := make([]byte, 24)
+	binary.BigEndian.PutUint32(block, ssrc)
+	binary.BigEndian.PutUint32(block[4:], uint32(fraction)<<24|uint32(lost)&0xffffff)
+	binary.BigEndian.PutUint32(block[8:], 0x10005)
+	binary.BigEndian.PutUint32(block[12:], 42)
+	binary.BigEndian.PutUint32(block[16:], 0xaabbccdd)
+	binary.BigEndian.PutUint32(block[20:], 0x8000)
+	return block
+}
+
+func joinPackets(packets ...[]byte) []byte {
+	data := []byte{}
+	for _, packet := range packets {
+		data = append(data, packet...)
+	}
+	return data
+}
+
+func TestParseRTCP(t *testing.T) {
+	sr := senderReport(0x1234, 0x0102030405060708, 90000, 10, 1000, "cam")
+	rr := receiverReport(0x5678, testReportBlock(0x1234, 0, 0), "viewer")
+	// an RR claiming 3 blocks with room for 1
+	rrShort := joinPackets(rtcpHeader(3, RTCP_RR, 7), []byte{0, 0, 0x56, 0x78}, testReportBlock(0x1234, 0, 0))
+	longLength := joinPackets(rr)
+	binary.BigEndian.PutUint16(longLength[2:], 100)
+	shortLength := joinPackets(sr)
+	binary.BigEndian.PutUint16(shortLength[2:], 1)
+	badVersion := joinPackets(sr)
+	badVersion[0] = 0x40
+	badPadding := joinPackets(rtcpHeader(0, RTCP_RR, 2), []byte{0, 0, 0x56, 0x78, 0, 0, 0, 9})
+	badPadding[0] |= 0x20
+
+	tests := []struct {
+		name   string
+		data   []byte
+		types  []int
+		blocks int // report blocks of all packets
+	}{
+		{"sender report", sr, []int{RTCP_SR, RTCP_SDES}, 0},
+		{"receiver report", rr, []int{RTCP_RR, RTCP_SDES}, 1},
+		{"receiver report without blocks", receiverReport(0x5678, nil, "viewer"), []int{RTCP_RR, RTCP_SDES}, 0},
+		{"compound of several reports", joinPackets(sr, rr), []int{RTCP_SR, RTCP_SDES, RTCP_RR, RTCP_SDES}, 1},
+		{"empty", nil, []int{}, 0},
+		{"truncated header", sr[:3], []int{}, 0},
+		{"truncated sender info", sr[:20], []int{}, 0},
+		{"truncated second packet", sr[:len(sr)-1], []int{RTCP_SR}, 0},
+		{"trailing bytes", joinPackets(rr, []byte{0x80, RTCP_RR}), []int{RTCP_RR, RTCP_SDES}, 1},
+		{"length beyond the data", longLength, []int{}, 0},
+		{"length short of the sender info", shortLength, []int{}, 0},
+		{"more blocks counted than sent", rrShort, []int{RTCP_RR}, 1},
+		{"version 1", badVersion, []int{}, 0},
+		{"malformed after a valid packet", joinPackets(rr, badVersion), []int{RTCP_RR, RTCP_SDES}, 1},
+		{"padding longer than the packet", badPadding, []int{}, 0},
+		{"unknown type", joinPackets(rtcpHeader(0, 210, 0)), []int{210}, 0},
+	}
+	for _, test := range tests {
+		infos := ParseRTCP(test.data)
+		types, blocks := []int{}, 0
+		for _, info := range infos {
+			types = append(types, info.PacketType)
+			blocks += len(info.Reports)
+		}
+		if !reflect.DeepEqual(types, test.types) {
+			t.Errorf("%s: ParseRTCP() packet types = %v, want %v", test.name, types, test.types)
+		}
+		if blocks != test.blocks {
+			t.Errorf("%s: ParseRTCP() report blocks = %d, want %d", test.name, blocks, test.blocks)
+		}
+	}
+}
+
+func TestParseRTCPSenderReport(t *testing.T) {
+	infos := ParseRTCP(senderReport(0x1234, 0x0102030405060708, 90000, 10, 1000, "cam"))
+	if len(infos) != 2 {
+		t.Fatalf("ParseRTCP() = %d packets, want 2", len(infos))
+	}
+	sr, sdes := infos[0], infos[1]
+	if sr.Version != 2 || sr.Length != 28 || sr.SSRC != 0x1234 || sr.NTPTime != 0x0102030405060708 ||
+		sr.RTPTime != 90000 || sr.PacketCount != 10 || sr.OctetCount != 1000 {
+		t.Errorf("sender report = %+v", sr)
+	}
+	want := []RTCPSDESChunk{{SSRC: 0x1234, Items: map[int]string{RTCP_SDES_CNAME: "cam"}}}
+	if !reflect.DeepEqual(sdes.Chunks, want) {
+		t.Errorf("sdes chunks = %+v, want %+v", sdes.Chunks, want)
+	}
+}
+
+func TestParseRTCPReportBlocks(t *testing.T) {
+	tests := []struct {
+		fraction uint8
+		lost     int32
+	}{
+		{0, 0},
+		{64, 5},
+		{255, 0x7fffff},
+		{0, -5},
+		{0, -0x800000},
+	}
+	for _, test := range tests {
+		infos := ParseRTCP(receiverReport(0x5678, testReportBlock(0x1234, test.fraction, test.lost), "viewer"))
+		if len(infos) == 0 || len(infos[0].Reports) != 1 {
+			t.Errorf("fraction %d lost %d: ParseRTCP() = %v, want one report block", test.fraction, test.lost, infos)
+			continue
+		}
+		want := RTCPReportBlock{
+			SSRC:         0x1234,
+			FractionLost: test.fraction,
+			PacketsLost:  test.lost,
+			HighestSeq:   0x10005,
+			Jitter:       42,
+			LSR:          0xaabbccdd,
+			DLSR:         0x8000,
+		}
+		if block := infos[0].Reports[0]; block != want {
+			t.Errorf("report block = %+v, want %+v", block, want)
+		}
+	}
+}
+
+func TestParseRTCPPacketTypes(t *testing.T) {
+	bye := joinPackets(rtcpHeader(1, RTCP_BYE, 3), []byte{0, 0, 0x12, 0x34, 4}, []byte("gone"), []byte{0, 0, 0})
+	byeLongReason := joinPackets(rtcpHeader(1, RTCP_BYE, 2), []byte{0, 0, 0x12, 0x34, 10, 'g', 'o', 'n'})
+	app := joinPackets(rtcpHeader(3, RTCP_APP, 3), []byte{0, 0, 0x12, 0x34}, []byte("TEST"), []byte{1, 2, 3, 4})
+	padded := joinPackets(rtcpHeader(0, RTCP_RR, 2), []byte{0, 0, 0x56, 0x78, 0, 0, 0, 4})
+	padded[0] |= 0x20
+
+	infos := ParseRTCP(joinPackets(bye, byeLongReason, app, padded))
+	if len(infos) != 4 {
+		t.Fatalf("ParseRTCP() = %d packets, want 4", len(infos))
+	}
+	if info := infos[0]; !reflect.DeepEqual(info.Sources, []uint32{0x1234}) || info.Reason != "gone" {
+		t.Errorf("bye = %+v, want source 0x1234 leaving with gone", info)
+	}
+	if info := infos[1]; !reflect.DeepEqual(info.Sources, []uint32{0x1234}) || info.Reason != "" {
+		t.Errorf("bye with a reason past the packet = %+v, want no reason", info)
+	}
+	if info := infos[2]; info.Count != 3 || info.SSRC != 0x1234 || info.Name != "TEST" || !reflect.DeepEqual(info.Data, []byte{1, 2, 3, 4}) {
+		t.Errorf("app = %+v", info)
+	}
+	if info := infos[3]; !info.Padding || info.SSRC != 0x5678 || info.Length != 12 || len(info.Reports) != 0 {
+		t.Errorf("padded receiver report = %+v", info)
+	}
+}
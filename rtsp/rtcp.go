@@ -0,0 +1,309 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	RTCP_SR   = 200
+	RTCP_RR   = 201
+	RTCP_SDES = 202
+	RTCP_BYE  = 203
+	RTCP_APP  = 204
+)
+
+// RTCP_INTERVAL between reports the server sends to sources and players
+const RTCP_INTERVAL = 5 * time.Second
+
+// RTCP_CNAME the server reports with
+const RTCP_CNAME = "edrtsp"
+
+// ntpEpochOffset seconds from 1900 to 1970
+const ntpEpochOffset = 2208988800
+
+// NTPTime converts t to a 64 bit ntp timestamp
+func NTPTime(t time.Time) uint64 {
+	nanos := uint64(t.UnixNano())
+	secs := nanos/1e9 + ntpEpochOffset
+	frac := (nanos % 1e9) << 32 / 1e9
+	return secs<<32 | frac
+}
+
+// rtpReceiver reception statistics of a source track, RFC 3550 A.1, A.3 and A.8.
+// It also keeps the rtp <-> wallclock mapping of the track for sender reports.
+type rtpReceiver struct {
+	lock      sync.Mutex
+	clockRate int
+	ssrc      uint32
+	started   bool
+	baseSeq   uint32
+	maxSeq    uint16
+	cycles    uint32
+	received  uint32
+	base      time.Time // arrival of the first packet
+	transit   int64
+	jitter    float64
+
+	expectedPrior uint32
+	receivedPrior uint32
+
+	lastRTP uint32 // timestamp of the latest packet
+	lastAt  time.Time
+	srNTP   uint64 // last sender report of the source
+	srRTP   uint32
+	srAt    time.Time
+
+	fraction uint8 // as in the latest report block
+	lost     int32
+	rate     rateMeter
+}
+
+func newRTPReceiver(clockRate int) *rtpReceiver {
+	if clockRate <= 0 {
+		clockRate = 90000
+	}
+	return &rtpReceiver{clockRate: clockRate}
+}
+
+// onRTP updates sequence and jitter statistics with a packet arrived at now
+func (r *rtpReceiver) onRTP(rtp *RTPInfo, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	seq := uint16(rtp.SequenceNumber)
+	ts := uint32(rtp.Timestamp)
+	if !r.started || uint32(rtp.SSRC) != r.ssrc {
+		// a new source restarts the statistics, the sender report belongs to the old one
+		r.ssrc, r.started, r.baseSeq, r.maxSeq, r.base = uint32(rtp.SSRC), true, uint32(seq), seq, now
+		r.cycles, r.received, r.jitter, r.expectedPrior, r.receivedPrior = 0, 0, 0, 0, 0
+		r.srAt, r.fraction, r.lost = time.Time{}, 0, 0
+	} else if delta := seq - r.maxSeq; delta > 0 && delta < 0x8000 {
+		if seq < r.maxSeq {
+			r.cycles += 1 << 16
+		}
+		r.maxSeq = seq
+	}
+	r.received++
+	arrival := int64(now.Sub(r.base).Seconds() * float64(r.clockRate))
+	transit := arrival - int64(ts)
+	if r.received > 1 {
+		d := transit - r.transit
+		if d < 0 {
+			d = -d
+		}
+		r.jitter += (float64(d) - r.jitter) / 16
+	}
+	r.transit = transit
+	r.lastRTP, r.lastAt = ts, now
+	r.rate.add(len(rtp.Payload), ts)
+}
+
+// onSR keeps the timestamps of a sender report of the source
+func (r *rtpReceiver) onSR(ntp uint64, rtp uint32, now time.Time) {
+	r.lock.Lock()
+	r.srNTP, r.srRTP, r.srAt = ntp, rtp, now
+	r.lock.Unlock()
+}
+
+// reportBlock builds the reception report block of the track, nil before any packet
+func (r *rtpReceiver) reportBlock(now time.Time) []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.started {
+		return nil
+	}
+	extendedMax := r.cycles + uint32(r.maxSeq)
+	expected := extendedMax - r.baseSeq + 1
+	lost := int64(expected) - int64(r.received)
+	if lost > 0x7fffff {
+		lost = 0x7fffff
+	} else if lost < -0x800000 {
+		lost = -0x800000
+	}
+	expectedInterval := expected - r.expectedPrior
+	receivedInterval := r.received - r.receivedPrior
+	r.expectedPrior, r.receivedPrior = expected, r.received
+	fraction := uint32(0)
+	if lostInterval := int64(expectedInterval) - int64(receivedInterval); expectedInterval > 0 && lostInterval > 0 {
+		fraction = uint32(lostInterval<<8) / expectedInterval
+	}
+	r.fraction, r.lost = uint8(fraction), int32(lost)
+	var lsr, dlsr uint32
+	if !r.srAt.IsZero() {
+		lsr = ntpMiddle(r.srNTP)
+		dlsr = uint32(now.Sub(r.srAt) * 65536 / time.Second)
+	}
+	block := make([]byte, 24)
+	binary.BigEndian.PutUint32(block, r.ssrc)
+	binary.BigEndian.PutUint32(block[4:], fraction<<24|uint32(lost)&0xffffff)
+	binary.BigEndian.PutUint32(block[8:], extendedMax)
+	binary.BigEndian.PutUint32(block[12:], uint32(r.jitter))
+	binary.BigEndian.PutUint32(block[16:], lsr)
+	binary.BigEndian.PutUint32(block[20:], dlsr)
+	return block
+}
+
+// sample updates bitrate and framerate of the track
+func (r *rtpReceiver) sample(now time.Time) {
+	r.lock.Lock()
+	r.rate.sample(now)
+	r.lock.Unlock()
+}
+
+func (r *rtpReceiver) stats(now time.Time) (stats TrackStats) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	stats.PacketsLost = int64(r.lost)
+	stats.FractionLost = float64(r.fraction) / 256
+	stats.Jitter = r.jitter * 1000 / float64(r.clockRate)
+	stats.Bitrate, stats.Framerate = r.rate.rates(now)
+	if !r.srAt.IsZero() {
+		lastSR := ntpToTime(r.srNTP)
+		stats.LastSR = &lastSR
+	}
+	return
+}
+
+// wallclock maps the track to ntp and rtp timestamps at now, from the last
+// sender report of the source or else from the arrival of the latest packet
+func (r *rtpReceiver) wallclock(now time.Time) (ntp uint64, rtp uint32, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.srAt.IsZero() {
+		elapsed := now.Sub(r.srAt)
+		ntp = r.srNTP + uint64(elapsed/time.Second)<<32 + uint64(elapsed%time.Second)<<32/uint64(time.Second)
+		rtp = r.srRTP + uint32(int64(elapsed)*int64(r.clockRate)/int64(time.Second))
+		return ntp, rtp, true
+	}
+	if !r.started {
+		return
+	}
+	rtp = r.lastRTP + uint32(int64(now.Sub(r.lastAt))*int64(r.clockRate)/int64(time.Second))
+	return NTPTime(now), rtp, true
+}
+
+// rtpSender counts packets sent to a player on one track and keeps what
+// the receiver reports of the player tell about them
+type rtpSender struct {
+	lock      sync.Mutex
+	clockRate int
+	ssrc      uint32
+	packets   uint32
+	octets    uint32
+	rate      rateMeter
+
+	report *RTCPReportBlock // latest of the player
+	rtt    time.Duration
+	srNTP  uint64 // last sender report sent
+	srSent bool
+}
+
+func newRTPSender(clockRate int) *rtpSender {
+	if clockRate <= 0 {
+		clockRate = 90000
+	}
+	return &rtpSender{clockRate: clockRate}
+}
+
+func (s *rtpSender) onRTP(rtp *RTPInfo) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ssrc = uint32(rtp.SSRC)
+	s.packets++
+	s.octets += uint32(len(rtp.Payload))
+	s.rate.add(len(rtp.Payload), uint32(rtp.Timestamp))
+}
+
+// senderReport builds the next sender report and samples rates of the track
+func (s *rtpSender) senderReport(ntp uint64, rtp uint32, now time.Time) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rate.sample(now)
+	s.srNTP, s.srSent = ntp, true
+	return senderReport(s.ssrc, ntp, rtp, s.packets, s.octets, RTCP_CNAME)
+}
+
+// onReport keeps a report block of the player about the track, the round
+// trip follows from the sender report it refers to
+func (s *rtpSender) onReport(block RTCPReportBlock, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if block.SSRC != s.ssrc {
+		return
+	}
+	s.report = &block
+	if block.LSR != 0 {
+		// 1/65536 seconds, wraps like the middle bits of ntp time
+		delay := ntpMiddle(NTPTime(now)) - block.LSR - block.DLSR
+		if delay < 0x80000000 {
+			s.rtt = time.Duration(delay) * time.Second / 65536
+		}
+	}
+}
+
+func (s *rtpSender) stats(now time.Time) (stats TrackStats) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.report != nil {
+		stats.PacketsLost = int64(s.report.PacketsLost)
+		stats.FractionLost = float64(s.report.FractionLost) / 256
+		stats.Jitter = float64(s.report.Jitter) * 1000 / float64(s.clockRate)
+	}
+	stats.RTT = float64(s.rtt) / float64(time.Millisecond)
+	stats.Bitrate, stats.Framerate = s.rate.rates(now)
+	if s.srSent {
+		lastSR := ntpToTime(s.srNTP)
+		stats.LastSR = &lastSR
+	}
+	return
+}
+
+func rtcpHeader(count int, pt uint8, words int) []byte {
+	header := make([]byte, 4)
+	header[0] = 0x80 | byte(count&0x1f)
+	header[1] = pt
+	binary.BigEndian.PutUint16(header[2:], uint16(words))
+	return header
+}
+
+// sdesCNAME builds an SDES packet with the CNAME of ssrc, required in every
+// compound rtcp packet
+func sdesCNAME(ssrc uint32, cname string) []byte {
+	chunk := make([]byte, 4, 8+len(cname))
+	binary.BigEndian.PutUint32(chunk, ssrc)
+	chunk = append(chunk, 1, byte(len(cname)))
+	chunk = append(chunk, cname...)
+	// items end with a null octet, padded to 32 bits
+	chunk = append(chunk, 0)
+	for len(chunk)%4 != 0 {
+		chunk = append(chunk, 0)
+	}
+	return append(rtcpHeader(1, RTCP_SDES, len(chunk)/4), chunk...)
+}
+
+// receiverReport builds a compound RR + SDES packet reporting block
+func receiverReport(ssrc uint32, block []byte, cname string) []byte {
+	count := 0
+	if block != nil {
+		count = 1
+	}
+	packet := rtcpHeader(count, RTCP_RR, 1+len(block)/4)
+	packet = append(packet, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(packet[4:], ssrc)
+	packet = append(packet, block...)
+	return append(packet, sdesCNAME(ssrc, cname)...)
+}
+
+// senderReport builds a compound SR + SDES packet without report blocks
+func senderReport(ssrc uint32, ntp uint64, rtp uint32, packets, octets uint32, cname string) []byte {
+	packet := rtcpHeader(0, RTCP_SR, 6)
+	body := make([]byte, 24)
+	binary.BigEndian.PutUint32(body, ssrc)
+	binary.BigEndian.PutUint64(body[4:], ntp)
+	binary.BigEndian.PutUint32(body[12:], rtp)
+	binary.BigEndian.PutUint32(body[16:], packets)
+	binary.BigEndian.PutUint32(body[20:], octets)
+	packet = append(packet, body...)
+	return append(packet, sdesCNAME(ssrc, cname)...)
+}
@@ -0,0 +1,324 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/tectiv3/edrtsp/codec"
+)
+
+// Frame an access unit rebuilt from rtp packets
+type Frame struct {
+	Type     RTPType // RTP_TYPE_VIDEO or RTP_TYPE_AUDIO
+	Codec    string
+	PTS      time.Duration
+	KeyFrame bool
+	// SequenceStart the frame starts a GOP as detected by the pusher
+	SequenceStart bool
+	NALUs         [][]byte // h264/h265 NAL units without parameter sets
+	Data          []byte   // raw aac frame
+}
+
+// Depacketizer rebuilds h264/h265/aac frames from a pusher's rtp packets.
+// Timestamps of both tracks start from the arrival of the first packet so
+// they stay roughly in sync without RTCP.
+type Depacketizer struct {
+	VCodec string
+	ACodec string
+	VPS    []byte
+	SPS    []byte
+	PPS    []byte
+	// AAC AudioSpecificConfig
+	AACConfig  *codec.AACConfig
+	VideoClock int
+	AudioClock int
+
+	start    time.Time
+	video    trackClock
+	audio    trackClock
+	nalus    [][]byte
+	fu       []byte
+	vTS      uint32
+	lastSeq  int
+	aacFrag  []byte
+	seqStart bool
+}
+
+type trackClock struct {
+	started bool
+	offset  time.Duration
+	last    uint32
+	ext     int64
+}
+
+func (c *trackClock) pts(ts uint32, clock int, start time.Time) time.Duration {
+	if !c.started {
+		c.started = true
+		c.offset = time.Since(start)
+		c.last = ts
+	}
+	c.ext += int64(int32(ts - c.last))
+	c.last = ts
+	// whole seconds apart, ext*time.Second overflows after about a day at 90kHz
+	sec, rem := c.ext/int64(clock), c.ext%int64(clock)
+	return c.offset + time.Duration(sec)*time.Second + time.Duration(rem)*time.Second/time.Duration(clock)
+}
+
+func NewDepacketizer(sdpRaw string) *Depacketizer {
+	d := &Depacketizer{
+		start:      time.Now(),
+		VideoClock: 90000,
+		AudioClock: 44100,
+		lastSeq:    -1,
+	}
+	sdpMap := ParseSDP(sdpRaw)
+	if info, ok := sdpMap["video"]; ok {
+		d.VCodec = strings.ToLower(info.Codec)
+		if info.TimeScale > 0 {
+			d.VideoClock = info.TimeScale
+		}
+		for _, v := range info.SpropParameterSets {
+			d.updateParameterSet(v)
+		}
+		for _, v := range [][]byte{info.SpropVPS, info.SpropSPS, info.SpropPPS} {
+			d.updateParameterSet(v)
+		}
+	}
+	if info, ok := sdpMap["audio"]; ok {
+		d.ACodec = strings.ToLower(info.Codec)
+		if info.TimeScale > 0 {
+			d.AudioClock = info.TimeScale
+		}
+		if d.ACodec == "aac" {
+			if config, err := codec.ParseAACConfig(info.Config); err == nil {
+				d.AACConfig = config
+				d.AudioClock = config.SampleRate
+			}
+		}
+	}
+	return d
+}
+
+// Ready reports whether codec configs needed by muxers are known
+func (d *Depacketizer) Ready() bool {
+	switch d.VCodec {
+	case "h264":
+		return d.SPS != nil && d.PPS != nil
+	case "h265":
+		return d.VPS != nil && d.SPS != nil && d.PPS != nil
+	}
+	return true
+}
+
+func (d *Depacketizer) updateParameterSet(nalu []byte) bool {
+	if len(nalu) == 0 {
+		return false
+	}
+	if d.VCodec == "h265" {
+		switch codec.H265NALType(nalu) {
+		case codec.H265_NAL_VPS:
+			d.VPS = nalu
+		case codec.H265_NAL_SPS:
+			d.SPS = nalu
+		case codec.H265_NAL_PPS:
+			d.PPS = nalu
+		case codec.H265_NAL_AUD:
+		default:
+			return false
+		}
+		return true
+	}
+	switch codec.H264NALType(nalu) {
+	case codec.H264_NAL_SPS:
+		d.SPS = nalu
+	case codec.H264_NAL_PPS:
+		d.PPS = nalu
+	case codec.H264_NAL_AUD:
+	default:
+		return false
+	}
+	return true
+}
+
+// Decode feeds a packet, returns frames completed by it
+func (d *Depacketizer) Decode(pack *RTPPack) []*Frame {
+	switch pack.Type {
+	case RTP_TYPE_VIDEO:
+		if d.VCodec != "h264" && d.VCodec != "h265" {
+			return nil
+		}
+		rtp := ParseRTP(pack.Buffer.Bytes())
+		if rtp == nil {
+			return nil
+		}
+		return d.decodeVideo(rtp, pack.SequenceStart)
+	case RTP_TYPE_AUDIO:
+		if d.ACodec != "aac" || d.AACConfig == nil {
+			return nil
+		}
+		rtp := ParseRTP(pack.Buffer.Bytes())
+		if rtp == nil {
+			return nil
+		}
+		return d.decodeAAC(rtp)
+	}
+	return nil
+}
+
+func (d *Depacketizer) decodeVideo(rtp *RTPInfo, sequenceStart bool) (frames []*Frame) {
+	ts := uint32(rtp.Timestamp)
+	if len(d.nalus) > 0 && ts != d.vTS {
+		// marker lost, timestamp change ends the access unit
+		frames = append(frames, d.flushVideo())
+	}
+	if sequenceStart {
+		d.seqStart = true
+	}
+	d.vTS = ts
+	lost := d.lastSeq >= 0 && uint16(d.lastSeq+1) != uint16(rtp.SequenceNumber)
+	d.lastSeq = rtp.SequenceNumber
+	if lost {
+		d.fu = nil
+	}
+	payload := rtp.Payload
+	if d.VCodec == "h264" {
+		d.depacketizeH264(payload)
+	} else {
+		d.depacketizeH265(payload)
+	}
+	if rtp.Marker && len(d.nalus) > 0 {
+		frames = append(frames, d.flushVideo())
+	}
+	return
+}
+
+func (d *Depacketizer) depacketizeH264(payload []byte) {
+	switch naluType := payload[0] & 0x1f; {
+	case naluType >= 1 && naluType <= 23:
+		d.addNALU(payload)
+	case naluType == 24: // STAP-A
+		for off := 1; off+2 <= len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[off:]))
+			off += 2
+			if size == 0 || off+size > len(payload) {
+				return
+			}
+			d.addNALU(payload[off : off+size])
+			off += size
+		}
+	case naluType == 28: // FU-A
+		if len(payload) < 2 {
+			return
+		}
+		header := payload[1]
+		if header&0x80 != 0 {
+			d.fu = append([]byte{payload[0]&0xe0 | header&0x1f}, payload[2:]...)
+		} else if d.fu != nil {
+			d.fu = append(d.fu, payload[2:]...)
+		}
+		if header&0x40 != 0 && d.fu != nil {
+			d.addNALU(d.fu)
+			d.fu = nil
+		}
+	}
+}
+
+func (d *Depacketizer) depacketizeH265(payload []byte) {
+	if len(payload) < 3 {
+		return
+	}
+	switch naluType := codec.H265NALType(payload); {
+	case naluType == codec.H265_NAL_AP:
+		for off := 2; off+2 <= len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[off:]))
+			off += 2
+			if size == 0 || off+size > len(payload) {
+				return
+			}
+			d.addNALU(payload[off : off+size])
+			off += size
+		}
+	case naluType == codec.H265_NAL_FU:
+		header := payload[2]
+		if header&0x80 != 0 {
+			d.fu = append([]byte{payload[0]&0x81 | (header&0x3f)<<1, payload[1]}, payload[3:]...)
+		} else if d.fu != nil {
+			d.fu = append(d.fu, payload[3:]...)
+		}
+		if header&0x40 != 0 && d.fu != nil {
+			d.addNALU(d.fu)
+			d.fu = nil
+		}
+	case naluType < 48:
+		d.addNALU(payload)
+	}
+}
+
+func (d *Depacketizer) addNALU(nalu []byte) {
+	if d.updateParameterSet(nalu) {
+		return
+	}
+	d.nalus = append(d.nalus, nalu)
+}
+
+func (d *Depacketizer) flushVideo() *Frame {
+	frame := &Frame{
+		Type:          RTP_TYPE_VIDEO,
+		Codec:         d.VCodec,
+		PTS:           d.video.pts(d.vTS, d.VideoClock, d.start),
+		NALUs:         d.nalus,
+		SequenceStart: d.seqStart,
+	}
+	for _, nalu := range d.nalus {
+		if d.VCodec == "h264" && codec.H264NALType(nalu) == codec.H264_NAL_IDR ||
+			d.VCodec == "h265" && codec.H265IsKeyFrame(codec.H265NALType(nalu)) {
+			frame.KeyFrame = true
+		}
+	}
+	d.nalus = nil
+	d.seqStart = false
+	return frame
+}
+
+// decodeAAC splits RFC 3640 AU headers, sizelength 13 and indexlength 3
+func (d *Depacketizer) decodeAAC(rtp *RTPInfo) (frames []*Frame) {
+	payload := rtp.Payload
+	if len(payload) < 2 {
+		return
+	}
+	headersLen := (int(binary.BigEndian.Uint16(payload)) + 7) / 8
+	if 2+headersLen > len(payload) {
+		return
+	}
+	headers := payload[2 : 2+headersLen]
+	data := payload[2+headersLen:]
+	ts := uint32(rtp.Timestamp)
+	for i := 0; i+2 <= len(headers); i += 2 {
+		size := int(binary.BigEndian.Uint16(headers[i:]) >> 3)
+		if size > len(data) {
+			// fragmented AU, every fragment carries the full size
+			d.aacFrag = append(d.aacFrag, data...)
+			if len(d.aacFrag) >= size {
+				frames = append(frames, d.aacFrame(ts, d.aacFrag[:size]))
+				d.aacFrag = nil
+			}
+			return
+		}
+		d.aacFrag = nil
+		frames = append(frames, d.aacFrame(ts, data[:size]))
+		data = data[size:]
+		ts += 1024
+	}
+	return
+}
+
+func (d *Depacketizer) aacFrame(ts uint32, data []byte) *Frame {
+	return &Frame{
+		Type:     RTP_TYPE_AUDIO,
+		Codec:    d.ACodec,
+		PTS:      d.audio.pts(ts, d.AudioClock, d.start),
+		KeyFrame: true,
+		Data:     data,
+	}
+}
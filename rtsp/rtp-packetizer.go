@@ -0,0 +1,123 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+
+	"github.com/tectiv3/edrtsp/codec"
+)
+
+// RTP_MAX_PAYLOAD keeps packets of generated streams under a common MTU
+const RTP_MAX_PAYLOAD = 1400
+
+// Packetizer builds rtp packets of one track for streams ingested without
+// rtp, like rtmp. H.264 uses single NAL units, STAP-A for SPS/PPS and FU-A,
+// H.265 single NAL units and FUs, AAC RFC 3640 AAC-hbr with one AU a packet.
+type Packetizer struct {
+	Type        RTPType
+	Codec       string
+	PayloadType int
+	SSRC        uint32
+	seq         uint16
+}
+
+func NewPacketizer(typ RTPType, codecName string, payloadType int) *Packetizer {
+	return &Packetizer{
+		Type:        typ,
+		Codec:       codecName,
+		PayloadType: payloadType,
+		SSRC:        rand.Uint32(),
+		seq:         uint16(rand.Uint32()),
+	}
+}
+
+func (p *Packetizer) packet(ts uint32, marker bool, payload ...[]byte) *RTPPack {
+	header := make([]byte, RTP_FIXED_HEADER_LENGTH)
+	header[0] = 0x80
+	header[1] = byte(p.PayloadType & 0x7f)
+	if marker {
+		header[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(header[2:], p.seq)
+	binary.BigEndian.PutUint32(header[4:], ts)
+	binary.BigEndian.PutUint32(header[8:], p.SSRC)
+	p.seq++
+	buf := bytes.NewBuffer(header)
+	for _, b := range payload {
+		buf.Write(b)
+	}
+	return &RTPPack{Type: p.Type, Buffer: buf}
+}
+
+// Video packetizes an access unit, parameter sets are sent in band before keyframes
+func (p *Packetizer) Video(ts uint32, nalus [][]byte, keyFrame bool, vps, sps, pps []byte) (packs []*RTPPack) {
+	if keyFrame {
+		if p.Codec == "h264" && sps != nil && pps != nil {
+			// STAP-A lets the pusher keep SPS/PPS at the head of its GOP cache
+			stap := []byte{sps[0]&0x60 | 24}
+			for _, nalu := range [][]byte{sps, pps} {
+				stap = append(stap, byte(len(nalu)>>8), byte(len(nalu)))
+				stap = append(stap, nalu...)
+			}
+			packs = append(packs, p.packet(ts, false, stap))
+		} else if p.Codec == "h265" {
+			for _, nalu := range [][]byte{vps, sps, pps} {
+				if nalu != nil {
+					packs = append(packs, p.packet(ts, false, nalu))
+				}
+			}
+		}
+	}
+	for i, nalu := range nalus {
+		last := i == len(nalus)-1
+		if len(nalu) == 0 {
+			continue
+		}
+		if len(nalu) <= RTP_MAX_PAYLOAD {
+			packs = append(packs, p.packet(ts, last, nalu))
+			continue
+		}
+		packs = append(packs, p.fragment(ts, nalu, last)...)
+	}
+	return
+}
+
+func (p *Packetizer) fragment(ts uint32, nalu []byte, last bool) (packs []*RTPPack) {
+	var header []byte
+	var data []byte
+	if p.Codec == "h265" {
+		header = []byte{nalu[0]&0x81 | codec.H265_NAL_FU<<1, nalu[1], byte(codec.H265NALType(nalu))}
+		data = nalu[2:]
+	} else {
+		header = []byte{nalu[0]&0xe0 | 28, nalu[0] & 0x1f}
+		data = nalu[1:]
+	}
+	fuIndex := len(header) - 1
+	fuType := header[fuIndex]
+	max := RTP_MAX_PAYLOAD - len(header)
+	for start := true; len(data) > 0; start = false {
+		n := len(data)
+		if n > max {
+			n = max
+		}
+		h := append([]byte{}, header...)
+		h[fuIndex] = fuType
+		if start {
+			h[fuIndex] |= 0x80
+		}
+		end := n == len(data)
+		if end {
+			h[fuIndex] |= 0x40
+		}
+		packs = append(packs, p.packet(ts, end && last, h, data[:n]))
+		data = data[n:]
+	}
+	return
+}
+
+// AAC packetizes a raw aac frame with a 13 bit size AU header
+func (p *Packetizer) AAC(ts uint32, frame []byte) *RTPPack {
+	header := []byte{0x00, 0x10, byte(len(frame) >> 5), byte(len(frame) << 3)}
+	return p.packet(ts, true, header, frame)
+}
@@ -0,0 +1,73 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// rtpRewriter keeps ssrc, sequence numbers and timestamps of one track
+// continuous for a player when the source of the pusher changes
+type rtpRewriter struct {
+	clockRate  int
+	started    bool
+	ssrc       uint32 // the player only ever sees this one
+	srcSSRC    uint32
+	generation uint32 // of the pusher source
+	seqOffset  uint16
+	tsOffset   uint32
+	lastSeq    uint16 // last sequence number of the source
+	lastTS     uint32 // last timestamp sent
+	lastAt     time.Time
+}
+
+func newRTPRewriter(clockRate int) *rtpRewriter {
+	if clockRate <= 0 {
+		clockRate = 90000
+	}
+	return &rtpRewriter{clockRate: clockRate}
+}
+
+// rewrite gets pack with the header continuing what the player got so far.
+// Packs are shared with other players and the gop cache, a rewritten one is
+// a copy.
+func (w *rtpRewriter) rewrite(pack *RTPPack, now time.Time) *RTPPack {
+	rtp := ParseRTP(pack.Buffer.Bytes())
+	if rtp == nil {
+		return pack
+	}
+	ssrc, seq, ts := uint32(rtp.SSRC), uint16(rtp.SequenceNumber), uint32(rtp.Timestamp)
+	if !w.started {
+		w.started, w.ssrc, w.srcSSRC, w.generation = true, ssrc, ssrc, pack.generation
+	} else if diff := int16(seq - w.lastSeq); pack.generation != w.generation || ssrc != w.srcSSRC || diff > MAX_DROPOUT || -int(diff) > MAX_DROPOUT {
+		// a new source, continue right after the last packet sent with the
+		// timestamp advanced by the time that passed meanwhile
+		elapsed := uint32(int64(now.Sub(w.lastAt)) * int64(w.clockRate) / int64(time.Second))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		w.srcSSRC, w.generation = ssrc, pack.generation
+		w.seqOffset = w.lastSeq + w.seqOffset + 1 - seq
+		w.tsOffset = w.lastTS + elapsed - ts
+	}
+	w.lastSeq, w.lastTS, w.lastAt = seq, ts+w.tsOffset, now
+	if ssrc == w.ssrc && w.seqOffset == 0 && w.tsOffset == 0 {
+		return pack
+	}
+	data := make([]byte, pack.Buffer.Len())
+	copy(data, pack.Buffer.Bytes())
+	binary.BigEndian.PutUint16(data[2:], seq+w.seqOffset)
+	binary.BigEndian.PutUint32(data[4:], ts+w.tsOffset)
+	binary.BigEndian.PutUint32(data[8:], w.ssrc)
+	return &RTPPack{
+		Type:          pack.Type,
+		Buffer:        bytes.NewBuffer(data),
+		SequenceStart: pack.SequenceStart,
+		generation:    pack.generation,
+	}
+}
+
+// timestamp maps a timestamp of the source to what the player sees
+func (w *rtpRewriter) timestamp(ts uint32) uint32 {
+	return ts + w.tsOffset
+}
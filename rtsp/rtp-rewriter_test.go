@@ -0,0 +1,104 @@
+package rtsp
+
+import (
+	"testing"
+	"time"
+)
+
+type testRTPHeader struct {
+	seq  uint16
+	ts   uint32
+	ssrc uint32
+}
+
+type testSourcePack struct {
+	testRTPHeader
+	generation uint32
+	at         time.Duration // since the first packet
+}
+
+func TestRTPRewriter(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name string
+		in   []testSourcePack
+		want []testRTPHeader
+	}{
+		{
+			"one source passes through",
+			[]testSourcePack{{testRTPHeader{100, 1000, 7}, 1, 0}, {testRTPHeader{101, 4000, 7}, 1, 33 * ms}},
+			[]testRTPHeader{{100, 1000, 7}, {101, 4000, 7}},
+		},
+		{
+			"sequence wraparound of one source",
+			[]testSourcePack{{testRTPHeader{65535, 1000, 7}, 1, 0}, {testRTPHeader{0, 4000, 7}, 1, 33 * ms}},
+			[]testRTPHeader{{65535, 1000, 7}, {0, 4000, 7}},
+		},
+		{
+			"new ssrc continues after the last packet",
+			[]testSourcePack{
+				{testRTPHeader{65000, 1000, 7}, 1, 0},
+				{testRTPHeader{65001, 4000, 7}, 1, 33 * ms},
+				{testRTPHeader{10, 500000, 9}, 2, 133 * ms},
+				{testRTPHeader{11, 503000, 9}, 2, 166 * ms},
+			},
+			[]testRTPHeader{{65000, 1000, 7}, {65001, 4000, 7}, {65002, 13000, 7}, {65003, 16000, 7}},
+		},
+		{
+			"new source wraps the sequence of the player",
+			[]testSourcePack{
+				{testRTPHeader{65535, 1000, 7}, 1, 0},
+				{testRTPHeader{5, 90000, 9}, 2, 10 * ms},
+				{testRTPHeader{6, 93000, 9}, 2, 43 * ms},
+			},
+			[]testRTPHeader{{65535, 1000, 7}, {0, 1900, 7}, {1, 4900, 7}},
+		},
+		{
+			"new source wraps the timestamp of the player",
+			[]testSourcePack{
+				{testRTPHeader{100, 0xffffff00, 7}, 1, 0},
+				{testRTPHeader{500, 100, 9}, 2, 10 * ms},
+			},
+			[]testRTPHeader{{100, 0xffffff00, 7}, {101, 644, 7}},
+		},
+		{
+			"republish with the same ssrc at once",
+			[]testSourcePack{{testRTPHeader{100, 1000, 7}, 1, 0}, {testRTPHeader{101, 1000, 7}, 2, 0}},
+			[]testRTPHeader{{100, 1000, 7}, {101, 1001, 7}},
+		},
+		{
+			"sequence jump of one source",
+			[]testSourcePack{{testRTPHeader{100, 1000, 7}, 1, 0}, {testRTPHeader{100 + MAX_DROPOUT + 1, 2000, 7}, 1, 10 * ms}},
+			[]testRTPHeader{{100, 1000, 7}, {101, 1900, 7}},
+		},
+		{
+			"back to the first source",
+			[]testSourcePack{
+				{testRTPHeader{100, 1000, 7}, 1, 0},
+				{testRTPHeader{5000, 50000, 9}, 2, 10 * ms},
+				{testRTPHeader{200, 9000, 7}, 3, 20 * ms},
+			},
+			[]testRTPHeader{{100, 1000, 7}, {101, 1900, 7}, {102, 2800, 7}},
+		},
+	}
+	start := time.Now()
+	for _, test := range tests {
+		w := newRTPRewriter(90000)
+		for i, in := range test.in {
+			pack := testRTPPack(in.seq, in.ts, in.ssrc)
+			pack.generation = in.generation
+			rtp := ParseRTP(w.rewrite(pack, start.Add(in.at)).Buffer.Bytes())
+			got := testRTPHeader{uint16(rtp.SequenceNumber), uint32(rtp.Timestamp), uint32(rtp.SSRC)}
+			if got != test.want[i] {
+				t.Errorf("%s: packet %d rewritten to %+v, want %+v", test.name, i, got, test.want[i])
+			}
+			if ts := w.timestamp(in.ts); ts != test.want[i].ts {
+				t.Errorf("%s: packet %d timestamp(%d) = %d, want %d", test.name, i, in.ts, ts, test.want[i].ts)
+			}
+			// packs are shared, the original must stay as the source sent it
+			if orig := ParseRTP(pack.Buffer.Bytes()); uint16(orig.SequenceNumber) != in.seq || uint32(orig.Timestamp) != in.ts || uint32(orig.SSRC) != in.ssrc {
+				t.Errorf("%s: packet %d modified in place", test.name, i)
+			}
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
@@ -16,6 +17,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pixelbender/go-sdp/sdp"
@@ -34,7 +37,8 @@ type RTSPClient struct {
 	Session              string
 	Seq                  int
 	connRW               *bufio.ReadWriter
-	InBytes              int
+	connWLock            sync.Mutex
+	InBytes              int64 // updated atomically, pullers watch it from their own goroutine
 	OutBytes             int
 	TransType            TransType
 	StartAt              time.Time
@@ -45,6 +49,7 @@ type RTSPClient struct {
 	VCodec               string
 	OptionIntervalMillis int64
 	SDPRaw               string
+	RTT                  time.Duration // of the latest keepalive
 
 	debugLogEnable bool
 	lastRtpSN      uint16
@@ -61,6 +66,8 @@ type RTSPClient struct {
 	UDPServer   *UDPServer
 	RTPHandles  []func(*RTPPack)
 	StopHandles []func()
+
+	pushTarget
 }
 
 func (client *RTSPClient) String() string {
@@ -80,7 +87,7 @@ func NewRTSPClient(server *Server, rawUrl string, sendOptionMillis int64, agent
 	if err != nil {
 		return
 	}
-	debugLogEnable := 0 //Key("debug_log_enable").MustInt(0)
+	debugLogEnable := key("debug_log_enable").MustInt(0)
 	client = &RTSPClient{
 		Server:               server,
 		Stoped:               false,
@@ -132,7 +139,7 @@ func DigestAuth(authLine string, method string, URL string) (string, error) {
 	password, _ := l.User.Password()
 	l.User = nil
 	if l.Port() == "" {
-		l.Host = fmt.Sprintf("%s:%s", l.Host, "554")
+		l.Host = fmt.Sprintf("%s:%s", l.Host, defaultPort(l.Scheme))
 	}
 	md5UserRealmPwd := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", username, realm, password))))
 	md5MethodURL := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s", method, l.String()))))
@@ -179,19 +186,14 @@ func (client *RTSPClient) checkAuth(method string, resp *Response) (string, erro
 	return "", nil
 }
 
-func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
-	defer func() {
-		if err != nil {
-			client.Status = "Error"
-		} else {
-			client.Status = "OK"
-		}
-	}()
+// connect dials the server of client url
+func (client *RTSPClient) connect(timeout time.Duration) error {
 	l, err := url.Parse(client.URL)
 	if err != nil {
 		return err
 	}
-	if strings.ToLower(l.Scheme) != "rtsp" {
+	scheme := strings.ToLower(l.Scheme)
+	if scheme != "rtsp" && scheme != "rtsps" {
 		err = fmt.Errorf("RTSP url is invalid")
 		return err
 	}
@@ -201,15 +203,25 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 	}
 	port := l.Port()
 	if len(port) == 0 {
-		port = "554"
+		port = defaultPort(scheme)
+	}
+	var conn net.Conn
+	if scheme == "rtsps" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", l.Hostname()+":"+port, clientTLSConfig(l.Hostname()))
+		if client.TransType != TRANS_TYPE_TCP {
+			// udp would carry the media in clear text
+			client.logger.Printf("rtsps uses tcp transport")
+			client.TransType = TRANS_TYPE_TCP
+		}
+	} else {
+		conn, err = net.DialTimeout("tcp", l.Hostname()+":"+port, timeout)
 	}
-	conn, err := net.DialTimeout("tcp", l.Hostname()+":"+port, timeout)
 	if err != nil {
 		// handle error
 		return err
 	}
 
-	networkBuffer := 204800 //Key("network_buffer").MustInt(204800)
+	networkBuffer := key("network_buffer").MustInt(204800)
 
 	timeoutConn := RichConn{
 		conn,
@@ -217,6 +229,20 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 	}
 	client.Conn = &timeoutConn
 	client.connRW = bufio.NewReadWriter(bufio.NewReaderSize(&timeoutConn, networkBuffer), bufio.NewWriterSize(&timeoutConn, networkBuffer))
+	return nil
+}
+
+func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
+	defer func() {
+		if err != nil {
+			client.Status = "Error"
+		} else {
+			client.Status = "OK"
+		}
+	}()
+	if err = client.connect(timeout); err != nil {
+		return
+	}
 
 	headers := make(map[string]string)
 	headers["Require"] = "implicit-play"
@@ -275,7 +301,7 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 			client.VControl = media.Attributes.Get("control")
 			client.VCodec = media.Format[0].Name
 			var _url = ""
-			if strings.Index(strings.ToLower(client.VControl), "rtsp://") == 0 {
+			if isAbsoluteURL(client.VControl) {
 				_url = client.VControl
 			} else {
 				_url = strings.TrimRight(client.URL, "/") + "/" + strings.TrimLeft(client.VControl, "/")
@@ -283,6 +309,9 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 			headers = make(map[string]string)
 			if client.TransType == TRANS_TYPE_TCP {
 				headers["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", client.vRTPChannel, client.vRTPControlChannel)
+			} else if client.TransType == TRANS_TYPE_MULTICAST {
+				headers["Transport"] = "RTP/AVP;multicast"
+				client.Conn.timeout = 0
 			} else {
 				if client.UDPServer == nil {
 					client.UDPServer = &UDPServer{RTSPClient: client}
@@ -305,11 +334,14 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 				return err
 			}
 			session, _ = resp.Header["Session"].(string)
+			if err = client.setupSource("video", resp); err != nil {
+				return err
+			}
 		case "audio":
 			client.AControl = media.Attributes.Get("control")
 			client.ACodec = media.Format[0].Name
 			var _url = ""
-			if strings.Index(strings.ToLower(client.AControl), "rtsp://") == 0 {
+			if isAbsoluteURL(client.AControl) {
 				_url = client.AControl
 			} else {
 				_url = strings.TrimRight(client.URL, "/") + "/" + strings.TrimLeft(client.AControl, "/")
@@ -317,6 +349,9 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 			headers = make(map[string]string)
 			if client.TransType == TRANS_TYPE_TCP {
 				headers["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", client.aRTPChannel, client.aRTPControlChannel)
+			} else if client.TransType == TRANS_TYPE_MULTICAST {
+				headers["Transport"] = "RTP/AVP;multicast"
+				client.Conn.timeout = 0
 			} else {
 				if client.UDPServer == nil {
 					client.UDPServer = &UDPServer{RTSPClient: client}
@@ -338,6 +373,9 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 				return err
 			}
 			session, _ = resp.Header["Session"].(string)
+			if err = client.setupSource("audio", resp); err != nil {
+				return err
+			}
 		}
 	}
 	headers = make(map[string]string)
@@ -354,6 +392,7 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 func (client *RTSPClient) startStream() {
 	startTime := time.Now()
 	loggerTime := time.Now().Add(-10 * time.Second)
+	keepaliveAt := time.Time{}
 	defer client.Stop()
 	for !client.Stoped {
 		if client.OptionIntervalMillis > 0 {
@@ -365,6 +404,7 @@ func (client *RTSPClient) startStream() {
 				if err := client.RequestNoResp("OPTIONS", headers); err != nil {
 					// ignore...
 				}
+				keepaliveAt = time.Now()
 			}
 		}
 		b, err := client.connRW.ReadByte()
@@ -446,7 +486,7 @@ func (client *RTSPClient) startStream() {
 				}
 			}
 
-			client.InBytes += int(length + 4)
+			atomic.AddInt64(&client.InBytes, int64(length+4))
 			for _, h := range client.RTPHandles {
 				h(pack)
 			}
@@ -476,6 +516,10 @@ func (client *RTSPClient) startStream() {
 						builder.Write(content)
 					}
 					client.logger.Printf("<<<[IN]\n%s", builder.String())
+					if !keepaliveAt.IsZero() {
+						client.RTT = time.Since(keepaliveAt)
+						keepaliveAt = time.Time{}
+					}
 					break
 				}
 				s := string(line)
@@ -501,9 +545,12 @@ func (client *RTSPClient) startStream() {
 
 func (client *RTSPClient) Start(timeout time.Duration) (err error) {
 	if timeout == 0 {
-		timeoutMillis := 0 //Key("timeout").MustInt(0)
+		timeoutMillis := key("timeout").MustInt(0)
 		timeout = time.Duration(timeoutMillis) * time.Millisecond
 	}
+	if client.TransType == TRANS_TYPE_AUTO {
+		return client.startAuto(timeout)
+	}
 	err = client.requestStream(timeout)
 	if err != nil {
 		return
@@ -532,6 +579,15 @@ func (client *RTSPClient) Stop() {
 }
 
 func (client *RTSPClient) RequestWithPath(method string, path string, headers map[string]string, needResp bool) (resp *Response, err error) {
+	return client.request(method, path, headers, "", needResp)
+}
+
+// RequestWithBody sends a request carrying body, like ANNOUNCE with an sdp
+func (client *RTSPClient) RequestWithBody(method string, path string, headers map[string]string, body string) (resp *Response, err error) {
+	return client.request(method, path, headers, body, true)
+}
+
+func (client *RTSPClient) request(method string, path string, headers map[string]string, body string, needResp bool) (resp *Response, err error) {
 	logger := client.logger
 	headers["User-Agent"] = client.Agent
 	if len(headers["Authorization"]) == 0 {
@@ -545,6 +601,9 @@ func (client *RTSPClient) RequestWithPath(method string, path string, headers ma
 	if len(client.Session) > 0 {
 		headers["Session"] = client.Session
 	}
+	if len(body) > 0 {
+		headers["Content-Length"] = strconv.Itoa(len(body))
+	}
 	client.Seq++
 	cseq := client.Seq
 	builder := bytes.Buffer{}
@@ -554,13 +613,18 @@ func (client *RTSPClient) RequestWithPath(method string, path string, headers ma
 		builder.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
 	}
 	builder.WriteString(fmt.Sprintf("\r\n"))
+	builder.WriteString(body)
 	s := builder.String()
 	logger.Printf("[OUT]>>>\n%s", s)
+	client.connWLock.Lock()
 	_, err = client.connRW.WriteString(s)
+	if err == nil {
+		err = client.connRW.Flush()
+	}
+	client.connWLock.Unlock()
 	if err != nil {
 		return
 	}
-	client.connRW.Flush()
 
 	if !needResp {
 		return nil, nil
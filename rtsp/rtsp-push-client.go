@@ -0,0 +1,262 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pushTarget udp destinations of a pushing client
+type pushTarget struct {
+	aRTPAddr        *net.UDPAddr
+	aRTPControlAddr *net.UDPAddr
+	vRTPAddr        *net.UDPAddr
+	vRTPControlAddr *net.UDPAddr
+}
+
+// requestWithAuth sends a request, answering a digest challenge once
+func (client *RTSPClient) requestWithAuth(method, path string, headers map[string]string, body string) (resp *Response, err error) {
+	resp, err = client.RequestWithBody(method, path, headers, body)
+	if err != nil && resp != nil {
+		authorization, _ := client.checkAuth(method, resp)
+		if len(authorization) > 0 {
+			headers["Authorization"] = authorization
+			resp, err = client.RequestWithBody(method, path, headers, body)
+		}
+	}
+	return
+}
+
+// recordSDP makes media controls of sdpRaw relative, absolute ones point at
+// the source of the stream, not at the server it is pushed to
+func recordSDP(sdpRaw string) (sdp string, controls map[string]string) {
+	controls = make(map[string]string)
+	lines := strings.Split(strings.TrimSpace(sdpRaw), "\n")
+	media := ""
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			media = strings.SplitN(line[2:], " ", 2)[0]
+		case media != "" && strings.HasPrefix(line, "a=control:"):
+			control := strings.TrimPrefix(line, "a=control:")
+			if strings.Contains(control, "://") {
+				control = "streamid=0"
+				if media == "audio" {
+					control = "streamid=1"
+				}
+				line = "a=control:" + control
+			}
+			controls[media] = control
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "\r\n") + "\r\n", controls
+}
+
+// requestRecord announces sdpRaw and sets up its tracks with mode=record
+func (client *RTSPClient) requestRecord(timeout time.Duration, sdpRaw string) (err error) {
+	defer func() {
+		if err != nil {
+			client.Status = "Error"
+		} else {
+			client.Status = "OK"
+		}
+	}()
+	if err = client.connect(timeout); err != nil {
+		return
+	}
+	l, err := url.Parse(client.URL)
+	if err != nil {
+		return
+	}
+	l.User = nil
+	aggregate := l.String()
+	if _, err = client.requestWithAuth("OPTIONS", aggregate, map[string]string{}, ""); err != nil {
+		return
+	}
+	sdp, controls := recordSDP(sdpRaw)
+	headers := map[string]string{"Content-Type": "application/sdp"}
+	if _, err = client.requestWithAuth("ANNOUNCE", aggregate, headers, sdp); err != nil {
+		return
+	}
+	client.SDPRaw = sdp
+	for _, media := range []string{"video", "audio"} {
+		control, ok := controls[media]
+		if !ok {
+			continue
+		}
+		rtpChannel, rtpControlChannel := client.vRTPChannel, client.vRTPControlChannel
+		if media == "audio" {
+			rtpChannel, rtpControlChannel = client.aRTPChannel, client.aRTPControlChannel
+			client.AControl = control
+		} else {
+			client.VControl = control
+		}
+		setupURL := control
+		if !isAbsoluteURL(control) {
+			setupURL = strings.TrimRight(aggregate, "/") + "/" + strings.TrimLeft(control, "/")
+		}
+		headers = make(map[string]string)
+		if client.TransType == TRANS_TYPE_TCP {
+			headers["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;mode=record;interleaved=%d-%d", rtpChannel, rtpControlChannel)
+		} else {
+			if client.UDPServer == nil {
+				client.UDPServer = &UDPServer{RTSPClient: client}
+			}
+			port := 0
+			if media == "audio" {
+				if err = client.UDPServer.SetupAudio(); err != nil {
+					return
+				}
+				port = client.UDPServer.APort
+			} else {
+				if err = client.UDPServer.SetupVideo(); err != nil {
+					return
+				}
+				port = client.UDPServer.VPort
+			}
+			headers["Transport"] = fmt.Sprintf("RTP/AVP/UDP;unicast;mode=record;client_port=%d-%d", port, port+1)
+		}
+		var resp *Response
+		if resp, err = client.RequestWithPath("SETUP", setupURL, headers, true); err != nil {
+			return
+		}
+		if sid, ok := resp.Header["Session"].(string); ok && client.Session == "" {
+			client.Session = strings.TrimSpace(strings.Split(sid, ";")[0])
+		}
+		if client.TransType == TRANS_TYPE_UDP {
+			transport, _ := resp.Header["Transport"].(string)
+			if err = client.setupTarget(media, transport); err != nil {
+				return
+			}
+		}
+	}
+	if _, err = client.Request("RECORD", map[string]string{"Range": "npt=0.000-"}); err != nil {
+		return
+	}
+	// the server only answers keepalives from now on
+	client.Conn.timeout = 0
+	return
+}
+
+// setupTarget resolves udp destinations from server_port of a SETUP response
+func (client *RTSPClient) setupTarget(media, transport string) (err error) {
+	match := regexp.MustCompile(`server_port=(\d+)(-(\d+))?`).FindStringSubmatch(transport)
+	if match == nil {
+		return fmt.Errorf("no server_port in transport %q", transport)
+	}
+	host := client.Conn.RemoteAddr().(*net.TCPAddr).IP.String()
+	rtpPort, _ := strconv.Atoi(match[1])
+	rtpControlPort := rtpPort + 1
+	if match[3] != "" {
+		rtpControlPort, _ = strconv.Atoi(match[3])
+	}
+	rtpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(rtpPort)))
+	if err != nil {
+		return
+	}
+	rtpControlAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(rtpControlPort)))
+	if err != nil {
+		return
+	}
+	if media == "audio" {
+		client.aRTPAddr, client.aRTPControlAddr = rtpAddr, rtpControlAddr
+	} else {
+		client.vRTPAddr, client.vRTPControlAddr = rtpAddr, rtpControlAddr
+	}
+	return
+}
+
+// StartPush announces sdpRaw to the server of client url and records to it,
+// packets are then sent with WriteRTP
+func (client *RTSPClient) StartPush(timeout time.Duration, sdpRaw string) (err error) {
+	if timeout == 0 {
+		timeoutMillis := key("timeout").MustInt(0)
+		timeout = time.Duration(timeoutMillis) * time.Millisecond
+	}
+	if err = client.requestRecord(timeout, sdpRaw); err != nil {
+		return
+	}
+	// reads keepalive answers and rtcp until the connection goes away
+	go client.startStream()
+	return
+}
+
+// setupReportTarget keeps where receiver reports of a pulling udp client go
+func (client *RTSPClient) setupReportTarget(media string, resp *Response) {
+	if client.TransType != TRANS_TYPE_UDP {
+		return
+	}
+	transport, _ := resp.Header["Transport"].(string)
+	if err := client.setupTarget(media, transport); err != nil {
+		client.logger.Printf("no rtcp target for %s yet, %v", media, err)
+	}
+}
+
+// WriteRTP sends pack to the server of client, media of a pushing client or
+// reports of a pulling one
+func (client *RTSPClient) WriteRTP(pack *RTPPack) (err error) {
+	if client.Stoped {
+		return fmt.Errorf("client stoped")
+	}
+	data := pack.Buffer.Bytes()
+	if client.TransType == TRANS_TYPE_UDP || client.TransType == TRANS_TYPE_MULTICAST {
+		var conn *net.UDPConn
+		var addr *net.UDPAddr
+		udp := client.UDPServer
+		switch pack.Type {
+		case RTP_TYPE_AUDIO:
+			conn, addr = udp.AConn, client.aRTPAddr
+		case RTP_TYPE_AUDIOCONTROL:
+			conn, addr = udp.AControlConn, client.aRTPControlAddr
+		case RTP_TYPE_VIDEO:
+			conn, addr = udp.VConn, client.vRTPAddr
+		case RTP_TYPE_VIDEOCONTROL:
+			conn, addr = udp.VControlConn, client.vRTPControlAddr
+		}
+		if addr == nil && (pack.Type == RTP_TYPE_AUDIOCONTROL || pack.Type == RTP_TYPE_VIDEOCONTROL) {
+			// servers without server_port get reports where their rtcp comes from
+			return udp.SendRTCP(pack)
+		}
+		if conn == nil || addr == nil {
+			return
+		}
+		n, err := conn.WriteToUDP(data, addr)
+		client.OutBytes += n
+		return err
+	}
+	channel := -1
+	switch pack.Type {
+	case RTP_TYPE_AUDIO:
+		channel = client.aRTPChannel
+	case RTP_TYPE_AUDIOCONTROL:
+		channel = client.aRTPControlChannel
+	case RTP_TYPE_VIDEO:
+		channel = client.vRTPChannel
+	case RTP_TYPE_VIDEOCONTROL:
+		channel = client.vRTPControlChannel
+	}
+	if channel < 0 || (channel == client.aRTPChannel && client.AControl == "") || (channel == client.vRTPChannel && client.VControl == "") {
+		return
+	}
+	header := make([]byte, 4)
+	header[0] = 0x24
+	header[1] = byte(channel)
+	binary.BigEndian.PutUint16(header[2:], uint16(len(data)))
+	client.connWLock.Lock()
+	defer client.connWLock.Unlock()
+	if _, err = client.connRW.Write(header); err != nil {
+		return
+	}
+	if _, err = client.connRW.Write(data); err != nil {
+		return
+	}
+	client.OutBytes += len(data) + 4
+	return client.connRW.Flush()
+}
@@ -1,11 +1,18 @@
 package rtsp
 
 import (
+	"crypto/md5"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"sync"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/tectiv3/edrtsp/utils"
 )
 
 // Server rtsp server
@@ -13,11 +20,23 @@ type Server struct {
 	SessionLogger
 	TCPListener    *net.TCPListener
 	TCPPort        int
+	TLSListener    *net.TCPListener // rtsps, nil unless tls_port is set
+	TLSPort        int
+	Agent          string // User-Agent of pull clients
+	Credentials    CredentialStore
+	Sources        SourceProvider // nil pulls nothing on demand
+	ACL            *ACL           // nil allows everything
+	Hooks          *Hooks         // nil disables callbacks
 	Stoped         bool
 	pushers        map[string]*Pusher // Path <-> Pusher
 	pushersLock    sync.RWMutex
 	addPusherCh    chan *Pusher
 	removePusherCh chan *Pusher
+	tunnels        map[string]*tunnelConn // x-sessioncookie <-> http tunnel
+	tunnelsLock    sync.RWMutex
+
+	// AddPusherHandles are called with every pusher added
+	AddPusherHandles []func(*Pusher)
 }
 
 // Instance server instance
@@ -25,9 +44,11 @@ var instance = &Server{
 	SessionLogger:  SessionLogger{log.New(os.Stdout, "[RTSPServer]", log.LstdFlags|log.Lshortfile)},
 	Stoped:         true,
 	TCPPort:        554,
+	Agent:          "edrtsp/0.0.1",
 	pushers:        make(map[string]*Pusher),
 	addPusherCh:    make(chan *Pusher),
 	removePusherCh: make(chan *Pusher),
+	tunnels:        make(map[string]*tunnelConn),
 }
 
 // GetServer get instance
@@ -35,6 +56,87 @@ func GetServer() *Server {
 	return instance
 }
 
+// key gets key from [rtsp] config section
+func key(name string) *ini.Key {
+	return utils.Conf().Section("rtsp").Key(name)
+}
+
+// SourceProvider pulls the source of a path without a pusher when a player
+// describes it, nil pusher and error when no source is configured for path
+type SourceProvider interface {
+	Demand(path string) (*Pusher, error)
+}
+
+// CredentialStore gives HA1 = md5(username:realm:password) of rtsp users
+type CredentialStore interface {
+	HA1(username, realm string) (string, bool)
+}
+
+// Realm gets digest realm of the server
+func (server *Server) Realm() string {
+	return key("realm").MustString("edrtsp")
+}
+
+// AuthorizationEnable tells whether clients must authenticate
+func (server *Server) AuthorizationEnable() bool {
+	return key("authorization_enable").MustInt(0) != 0
+}
+
+// CheckPassword checks a plain password against the credentials, for
+// protocols without digest authentication
+func (server *Server) CheckPassword(username, password string) bool {
+	if server.Credentials == nil {
+		return false
+	}
+	ha1, ok := server.Credentials.HA1(username, server.Realm())
+	return ok && ha1 == fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", username, server.Realm(), password))))
+}
+
+// ErrCredentialsRequired anonymous client while authorization is enabled
+var ErrCredentialsRequired = errors.New("credentials required")
+
+// Authenticate checks plain credentials of clients served outside rtsp
+// sessions, like rtmp and http ones. An empty username is anonymous, only
+// allowed while authorization is disabled.
+func (server *Server) Authenticate(username, password string) error {
+	if username == "" {
+		if server.AuthorizationEnable() {
+			return ErrCredentialsRequired
+		}
+		return nil
+	}
+	if !server.CheckPassword(username, password) {
+		return fmt.Errorf("user %s authentication failed", username)
+	}
+	return nil
+}
+
+// Authorize checks an authenticated client served outside rtsp sessions
+// against the acl, then asks the on_publish or on_play callback of event
+func (server *Server) Authorize(event *HookEvent) error {
+	action := ACL_ACTION_READ
+	if event.Event == "on_publish" {
+		action = ACL_ACTION_PUBLISH
+	}
+	if acl := server.ACL; acl != nil {
+		if host, _, err := net.SplitHostPort(event.RemoteAddr); err == nil {
+			if ip := net.ParseIP(host); ip != nil && !acl.AllowIP(ip) {
+				return fmt.Errorf("ip %v denied by acl", ip)
+			}
+		}
+		if !acl.Allow(event.User, action, event.Path) {
+			return fmt.Errorf("user[%s] %s %s denied by acl", event.User, action, event.Path)
+		}
+	}
+	return server.Hooks.Authorize(event)
+}
+
+// AuthorizeSession authorizes a session built by another protocol, like an
+// rtmp publisher, for the callback of name
+func (server *Server) AuthorizeSession(name string, session *Session) error {
+	return server.Authorize(sessionEvent(name, session))
+}
+
 // Start server
 func (server *Server) Start() (err error) {
 	logger := server.logger
@@ -46,6 +148,13 @@ func (server *Server) Start() (err error) {
 	if err != nil {
 		return
 	}
+	var tlsConfig *tls.Config
+	if server.TLSPort > 0 {
+		if server.TLSListener, tlsConfig, err = server.listenTLS(); err != nil {
+			listener.Close()
+			return
+		}
+	}
 
 	go func() {
 		for {
@@ -65,9 +174,20 @@ func (server *Server) Start() (err error) {
 	server.Stoped = false
 	server.TCPListener = listener
 	logger.Println("started on", server.TCPPort)
-	networkBuffer := 1048576 //Key("network_buffer").MustInt(1048576)
+	if server.TLSListener != nil {
+		logger.Println("rtsps started on", server.TLSPort)
+		go server.serve(server.TLSListener, tlsConfig)
+	}
+	server.serve(listener, nil)
+	return
+}
+
+// serve accepts connections of listener, encrypted with config unless nil
+func (server *Server) serve(listener *net.TCPListener, config *tls.Config) {
+	logger := server.logger
+	networkBuffer := key("network_buffer").MustInt(1048576)
 	for !server.Stoped {
-		conn, err := server.TCPListener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			logger.Println(err)
 			continue
@@ -80,11 +200,13 @@ func (server *Server) Start() (err error) {
 				logger.Printf("rtsp server conn set write buffer error, %v", err)
 			}
 		}
+		if config != nil {
+			// the handshake happens on the first read of the session
+			conn = tls.Server(conn, config)
+		}
 
-		session := NewSession(server, conn)
-		go session.Start()
+		go server.serveConn(conn)
 	}
-	return
 }
 
 // Stop server
@@ -96,6 +218,10 @@ func (server *Server) Stop() {
 		server.TCPListener.Close()
 		server.TCPListener = nil
 	}
+	if server.TLSListener != nil {
+		server.TLSListener.Close()
+		server.TLSListener = nil
+	}
 	server.pushersLock.Lock()
 	server.pushers = make(map[string]*Pusher)
 	server.pushersLock.Unlock()
@@ -130,10 +256,37 @@ func (server *Server) AddPusher(pusher *Pusher) bool {
 	if added {
 		go pusher.Start()
 		server.addPusherCh <- pusher
+		server.Hooks.Notify(pusherEvent("on_pusher_start", pusher))
+		for _, h := range server.AddPusherHandles {
+			h(pusher)
+		}
 	}
 	return added
 }
 
+//PullStream pulls url into a new client pusher, the pusher is removed once the client stops
+func (server *Server) PullStream(rawURL, customPath string, transType TransType, idleTimeout, heartbeatInterval time.Duration) (pusher *Pusher, err error) {
+	client, err := NewRTSPClient(server, rawURL, int64(heartbeatInterval/time.Millisecond), server.Agent)
+	if err != nil {
+		return
+	}
+	client.CustomPath = customPath
+	client.TransType = transType
+	pusher = NewClientPusher(client)
+	if server.GetPusher(pusher.Path()) != nil {
+		err = fmt.Errorf("path %s already has a pusher", pusher.Path())
+		return
+	}
+	if err = client.Start(idleTimeout); err != nil {
+		return
+	}
+	if !server.AddPusher(pusher) {
+		client.Stop()
+		err = fmt.Errorf("add pusher %s failed", pusher.Path())
+	}
+	return
+}
+
 //TryAttachToPusher attach to existing pusher
 func (server *Server) TryAttachToPusher(session *Session) (int, *Pusher) {
 	server.pushersLock.Lock()
@@ -166,6 +319,7 @@ func (server *Server) RemovePusher(pusher *Pusher) bool {
 	server.pushersLock.Unlock()
 	if removed {
 		server.removePusherCh <- pusher
+		server.Hooks.Notify(pusherEvent("on_pusher_stop", pusher))
 	}
 	return removed
 }
@@ -178,6 +332,15 @@ func (server *Server) GetPusher(path string) (pusher *Pusher) {
 	return
 }
 
+// DemandPusher gets the pusher of path, pulling its source on demand when
+// there is none
+func (server *Server) DemandPusher(path string) (pusher *Pusher, err error) {
+	if pusher = server.GetPusher(path); pusher == nil && server.Sources != nil {
+		pusher, err = server.Sources.Demand(path)
+	}
+	return
+}
+
 //GetPushers gets all pushers
 func (server *Server) GetPushers() (pushers map[string]*Pusher) {
 	pushers = make(map[string]*Pusher)
@@ -21,6 +21,10 @@ import (
 type RTPPack struct {
 	Type   RTPType
 	Buffer *bytes.Buffer
+	// SequenceStart first packet of a GOP, set by the pusher before broadcasting
+	SequenceStart bool
+	// generation of the pusher source the packet came from
+	generation uint32
 }
 
 type SessionType int
@@ -68,6 +72,8 @@ type TransType int
 const (
 	TRANS_TYPE_TCP TransType = iota
 	TRANS_TYPE_UDP
+	TRANS_TYPE_MULTICAST
+	TRANS_TYPE_AUTO // pulls over udp, tcp when nothing arrives
 )
 
 func (tt TransType) String() string {
@@ -76,10 +82,28 @@ func (tt TransType) String() string {
 		return "TCP"
 	case TRANS_TYPE_UDP:
 		return "UDP"
+	case TRANS_TYPE_MULTICAST:
+		return "MULTICAST"
+	case TRANS_TYPE_AUTO:
+		return "AUTO"
 	}
 	return "unknown"
 }
 
+func ParseTransType(s string) (TransType, error) {
+	switch strings.ToUpper(s) {
+	case "", "TCP":
+		return TRANS_TYPE_TCP, nil
+	case "UDP":
+		return TRANS_TYPE_UDP, nil
+	case "MULTICAST":
+		return TRANS_TYPE_MULTICAST, nil
+	case "AUTO":
+		return TRANS_TYPE_AUTO, nil
+	}
+	return TRANS_TYPE_TCP, fmt.Errorf("unknown transport %s", s)
+}
+
 const UDP_BUF_SIZE = 1048576
 
 type Session struct {
@@ -98,6 +122,7 @@ type Session struct {
 
 	authorizationEnable bool
 	nonce               string
+	User                string // authenticated username
 	closeOld            bool
 
 	AControl string
@@ -122,6 +147,7 @@ type Session struct {
 	Pusher      *Pusher
 	Player      *Player
 	UDPClient   *UDPClient
+	announceSeq int // CSeq of requests the server sends
 	RTPHandles  []func(*RTPPack)
 	StopHandles []func()
 
@@ -133,19 +159,19 @@ func (session *Session) String() string {
 }
 
 func NewSession(server *Server, conn net.Conn) *Session {
-	networkBuffer := 204800 //Key("network_buffer").MustInt(204800)
-	timeoutMillis := 0      //Key("timeout").MustInt(0)
+	networkBuffer := key("network_buffer").MustInt(204800)
+	timeoutMillis := key("timeout").MustInt(0)
 	timeoutTCPConn := &RichConn{conn, time.Duration(timeoutMillis) * time.Millisecond}
-	authorizationEnable := 0 //Key("authorization_enable").MustInt(0)
-	close_old := 0           //Key("close_old").MustInt(0)
-	debugLogEnable := 0      //Key("debug_log_enable").MustInt(0)
+	authorizationEnable := key("authorization_enable").MustInt(0)
+	close_old := key("close_old").MustInt(0)
+	debugLogEnable := key("debug_log_enable").MustInt(0)
 	session := &Session{
 		ID:                  shortid(10),
 		Server:              server,
 		Conn:                timeoutTCPConn,
 		connRW:              bufio.NewReadWriter(bufio.NewReaderSize(timeoutTCPConn, networkBuffer), bufio.NewWriterSize(timeoutTCPConn, networkBuffer)),
 		StartAt:             time.Now(),
-		Timeout:             0, //Key("timeout").MustInt(0),
+		Timeout:             key("timeout").MustInt(0),
 		authorizationEnable: authorizationEnable != 0,
 		debugLogEnable:      debugLogEnable != 0,
 		RTPHandles:          make([]func(*RTPPack), 0),
@@ -269,6 +295,11 @@ func (session *Session) Start() {
 					reqBuf.WriteString("\r\n")
 				}
 				if len(line) == 0 {
+					if strings.HasPrefix(reqBuf.String(), RTSP_VERSION) {
+						// answer of a player to an ANNOUNCE of the server
+						session.InBytes += reqBuf.Len()
+						break
+					}
 					req := NewRequest(reqBuf.String())
 					if req == nil {
 						break
@@ -295,62 +326,161 @@ func (session *Session) Start() {
 	}
 }
 
-func CheckAuth(authLine string, method string, sessionNonce string) error {
+func CheckAuth(authLine string, method string, sessionNonce string, realm string, credentials CredentialStore) (string, error) {
 	realmRex := regexp.MustCompile(`realm="(.*?)"`)
 	nonceRex := regexp.MustCompile(`nonce="(.*?)"`)
 	usernameRex := regexp.MustCompile(`username="(.*?)"`)
 	responseRex := regexp.MustCompile(`response="(.*?)"`)
 	uriRex := regexp.MustCompile(`uri="(.*?)"`)
 
-	realm := ""
 	nonce := ""
 	username := ""
 	response := ""
 	uri := ""
 	result1 := realmRex.FindStringSubmatch(authLine)
-	if len(result1) == 2 {
-		realm = result1[1]
-	} else {
-		return fmt.Errorf("CheckAuth error : no realm found")
+	if len(result1) != 2 {
+		return "", fmt.Errorf("CheckAuth error : no realm found")
+	} else if result1[1] != realm {
+		return "", fmt.Errorf("CheckAuth error : realm not same as %s", realm)
 	}
 	result1 = nonceRex.FindStringSubmatch(authLine)
 	if len(result1) == 2 {
 		nonce = result1[1]
 	} else {
-		return fmt.Errorf("CheckAuth error : no nonce found")
+		return "", fmt.Errorf("CheckAuth error : no nonce found")
 	}
 	if sessionNonce != nonce {
-		return fmt.Errorf("CheckAuth error : sessionNonce not same as nonce")
+		return "", fmt.Errorf("CheckAuth error : sessionNonce not same as nonce")
 	}
 
 	result1 = usernameRex.FindStringSubmatch(authLine)
 	if len(result1) == 2 {
 		username = result1[1]
 	} else {
-		return fmt.Errorf("CheckAuth error : username not found")
+		return "", fmt.Errorf("CheckAuth error : username not found")
 	}
 
 	result1 = responseRex.FindStringSubmatch(authLine)
 	if len(result1) == 2 {
 		response = result1[1]
 	} else {
-		return fmt.Errorf("CheckAuth error : response not found")
+		return "", fmt.Errorf("CheckAuth error : response not found")
 	}
 
 	result1 = uriRex.FindStringSubmatch(authLine)
 	if len(result1) == 2 {
 		uri = result1[1]
 	} else {
-		return fmt.Errorf("CheckAuth error : uri not found")
+		return "", fmt.Errorf("CheckAuth error : uri not found")
 	}
 
-	md5UserRealmPwd := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", username, realm, "hardcoded"))))
+	if credentials == nil {
+		return "", fmt.Errorf("CheckAuth error : no credential store")
+	}
+	md5UserRealmPwd, ok := credentials.HA1(username, realm)
+	if !ok {
+		return "", fmt.Errorf("CheckAuth error : user %s not found", username)
+	}
 	md5MethodURL := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s", method, uri))))
 	myResponse := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", md5UserRealmPwd, nonce, md5MethodURL))))
 	if myResponse != response {
-		return fmt.Errorf("CheckAuth error : response not equal")
+		return "", fmt.Errorf("CheckAuth error : response not equal")
+	}
+	return username, nil
+}
+
+func (session *Session) challenge(res *Response) {
+	res.StatusCode = 401
+	res.Status = "Unauthorized"
+	nonce := fmt.Sprintf("%x", md5.Sum([]byte(shortid(10))))
+	session.nonce = nonce
+	res.Header["WWW-Authenticate"] = fmt.Sprintf(`Digest realm="%s", nonce="%s", algorithm="MD5"`, session.Server.Realm(), nonce)
+}
+
+func (session *Session) remoteIP() net.IP {
+	if addr, ok := session.Conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	host, _, _ := net.SplitHostPort(session.Conn.RemoteAddr().String())
+	return net.ParseIP(host)
+}
+
+// Announce sends sdpRaw to the client of a player session, which answers
+// on the connection like to any request
+func (session *Session) Announce(sdpRaw string) (err error) {
+	session.announceSeq++
+	req := &Request{
+		Method:  ANNOUNCE,
+		URL:     session.URL,
+		Version: RTSP_VERSION,
+		Header: map[string]string{
+			"CSeq":           strconv.Itoa(session.announceSeq),
+			"Session":        session.ID,
+			"Content-Type":   "application/sdp",
+			"Content-Length": strconv.Itoa(len(sdpRaw)),
+		},
+		Body: sdpRaw,
+	}
+	outBytes := []byte(req.String())
+	session.logger.Printf(">>>\n%s", req)
+	session.connWLock.Lock()
+	defer session.connWLock.Unlock()
+	if _, err = session.connRW.Write(outBytes); err != nil {
+		return
+	}
+	session.OutBytes += len(outBytes)
+	return session.connRW.Flush()
+}
+
+// withServerPort adds server_port after clientPort of transport ts
+func withServerPort(ts, clientPort string, rtpPort, rtcpPort int) string {
+	tss := strings.Split(ts, ";")
+	idx := -1
+	for i, val := range tss {
+		if val == clientPort {
+			idx = i
+		}
+	}
+	tail := append([]string{}, tss[idx+1:]...)
+	tss = append(tss[:idx+1], fmt.Sprintf("server_port=%d-%d", rtpPort, rtcpPort))
+	tss = append(tss, tail...)
+	return strings.Join(tss, ";")
+}
+
+func localPort(conn *net.UDPConn) int {
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// controlRemote gets the rtcp address from client_port of a udp transport
+func (session *Session) controlRemote(udpMatchs []string) *net.UDPAddr {
+	port, _ := strconv.Atoi(udpMatchs[3])
+	if port == 0 {
+		port, _ = strconv.Atoi(udpMatchs[1])
+		port++
+	}
+	return &net.UDPAddr{IP: session.remoteIP(), Port: port}
+}
+
+// aclTarget gets action and path a request needs permission for
+func (session *Session) aclTarget(req *Request) (action ACLAction, path string, ok bool) {
+	switch req.Method {
+	case "ANNOUNCE", "RECORD":
+		action = ACL_ACTION_PUBLISH
+	case "DESCRIBE", "PLAY":
+		action = ACL_ACTION_READ
+	default:
+		return
+	}
+	path = session.Path
+	if req.Method == "ANNOUNCE" || req.Method == "DESCRIBE" {
+		l, err := url.Parse(req.URL)
+		if err != nil {
+			return
+		}
+		path = l.Path
 	}
-	return nil
+	ok = true
+	return
 }
 
 func (session *Session) handleRequest(req *Request) {
@@ -402,26 +532,39 @@ func (session *Session) handleRequest(req *Request) {
 			session.Stop()
 		}
 	}()
+	acl := session.Server.ACL
+	if acl != nil && !acl.AllowIP(session.remoteIP()) {
+		logger.Printf("ip %v denied by acl", session.remoteIP())
+		res.StatusCode = 403
+		res.Status = "Forbidden"
+		return
+	}
 	if req.Method != "OPTIONS" {
-		if session.authorizationEnable {
-			authLine := req.Header["Authorization"]
-			authFailed := true
-			if authLine != "" {
-				err := CheckAuth(authLine, req.Method, session.nonce)
-				if err == nil {
-					authFailed = false
-				} else {
-					logger.Printf("%v", err)
-				}
+		authLine := req.Header["Authorization"]
+		authFailed := true
+		if authLine != "" && session.nonce != "" {
+			user, err := CheckAuth(authLine, req.Method, session.nonce, session.Server.Realm(), session.Server.Credentials)
+			if err == nil {
+				session.User = user
+				authFailed = false
+			} else {
+				logger.Printf("%v", err)
 			}
-			if authFailed {
-				res.StatusCode = 401
-				res.Status = "Unauthorized"
-				nonce := fmt.Sprintf("%x", md5.Sum([]byte(shortid(10))))
-				session.nonce = nonce
-				res.Header["WWW-Authenticate"] = fmt.Sprintf(`Digest realm="edrtsp", nonce="%s", algorithm="MD5"`, nonce)
+		}
+		if session.authorizationEnable && authFailed {
+			session.challenge(res)
+			return
+		}
+		if action, path, ok := session.aclTarget(req); acl != nil && ok && !acl.Allow(session.User, action, path) {
+			logger.Printf("user[%s] %s %s denied by acl", session.User, action, path)
+			if session.User == "" {
+				// anonymous, credentials may grant it
+				session.challenge(res)
 				return
 			}
+			res.StatusCode = 403
+			res.Status = "Forbidden"
+			return
 		}
 	}
 	switch req.Method {
@@ -454,6 +597,12 @@ func (session *Session) handleRequest(req *Request) {
 			session.VCodec = sdp.Codec
 			logger.Printf("video codec[%s]\n", session.VCodec)
 		}
+		if err := session.Server.Hooks.Authorize(sessionEvent("on_publish", session)); err != nil {
+			logger.Printf("publish denied by hook, %v", err)
+			res.StatusCode = 403
+			res.Status = "Forbidden"
+			return
+		}
 		addPusher := false
 		if session.closeOld {
 			logger.Println("trying to attach to pusher")
@@ -465,24 +614,8 @@ func (session *Session) handleRequest(req *Request) {
 			} else if r == 0 {
 				addPusher = true
 			} else {
+				// players get an ANNOUNCE if the sdp changed, see Pusher.RebindSession
 				logger.Printf("Attached to old pusher")
-				// 尝试发给客户端ANNOUCE
-				// players := pusher.GetPlayers()
-				// for _, v := range players {
-				// 	sess := v.Session
-
-				// 	hearers := make(map[string]string)
-				// 	hearers["Content-Type"] = "application/sdp"
-				// 	hearers["Session"] = sess.ID
-				// 	hearers["Content-Length"] = strconv.Itoa(len(v.SDPRaw))
-				// 	var req = Request{Method: ANNOUNCE, URL: v.URL, Version: "1.0", Header: hearers, Body: pusher.SDPRaw()}
-				// 	sess.connWLock.Lock()
-				// 	logger.Println(req.String())
-				// 	outBytes := []byte(req.String())
-				// 	sess.connRW.Write(outBytes)
-				// 	sess.connRW.Flush()
-				// 	sess.connWLock.Unlock()
-				// }
 			}
 		} else {
 			addPusher = true
@@ -508,18 +641,31 @@ func (session *Session) handleRequest(req *Request) {
 			return
 		}
 		session.Path = url.Path
-		pusher := session.Server.GetPusher(session.Path)
+		// asked before pulling on demand, a denied player must not start a source
+		if err := session.Server.Hooks.Authorize(sessionEvent("on_play", session)); err != nil {
+			logger.Printf("play denied by hook, %v", err)
+			res.StatusCode = 403
+			res.Status = "Forbidden"
+			return
+		}
+		pusher, err := session.Server.DemandPusher(session.Path)
+		if err != nil {
+			logger.Printf("pull %s on demand failed, %v", session.Path, err)
+			res.StatusCode = 502
+			res.Status = "Bad Gateway"
+			return
+		}
 		if pusher == nil {
 			res.StatusCode = 404
 			res.Status = "NOT FOUND"
 			return
 		}
-		session.Player = NewPlayer(session, pusher)
-		session.Pusher = pusher
 		session.AControl = pusher.AControl()
 		session.VControl = pusher.VControl()
 		session.ACodec = pusher.ACodec()
 		session.VCodec = pusher.VCodec()
+		session.Player = NewPlayer(session, pusher)
+		session.Pusher = pusher
 		session.Conn.timeout = 0
 		res.SetBody(session.Pusher.SDPRaw())
 	case "SETUP":
@@ -538,7 +684,7 @@ func (session *Session) handleRequest(req *Request) {
 			return
 		}
 		if setupURL.Port() == "" {
-			setupURL.Host = fmt.Sprintf("%s:554", setupURL.Host)
+			setupURL.Host = fmt.Sprintf("%s:%s", setupURL.Host, defaultPort(setupURL.Scheme))
 		}
 		setupPath := setupURL.String()
 
@@ -550,7 +696,7 @@ func (session *Session) handleRequest(req *Request) {
 		}
 		//setupPath = setupPath[strings.LastIndex(setupPath, "/")+1:]
 		vPath := ""
-		if strings.Index(strings.ToLower(session.VControl), "rtsp://") == 0 {
+		if isAbsoluteURL(session.VControl) {
 			vControlURL, err := url.Parse(session.VControl)
 			if err != nil {
 				res.StatusCode = 500
@@ -558,7 +704,7 @@ func (session *Session) handleRequest(req *Request) {
 				return
 			}
 			if vControlURL.Port() == "" {
-				vControlURL.Host = fmt.Sprintf("%s:554", vControlURL.Host)
+				vControlURL.Host = fmt.Sprintf("%s:%s", vControlURL.Host, defaultPort(vControlURL.Scheme))
 			}
 			vPath = vControlURL.String()
 		} else {
@@ -566,7 +712,7 @@ func (session *Session) handleRequest(req *Request) {
 		}
 
 		aPath := ""
-		if strings.Index(strings.ToLower(session.AControl), "rtsp://") == 0 {
+		if isAbsoluteURL(session.AControl) {
 			aControlURL, err := url.Parse(session.AControl)
 			if err != nil {
 				res.StatusCode = 500
@@ -574,7 +720,7 @@ func (session *Session) handleRequest(req *Request) {
 				return
 			}
 			if aControlURL.Port() == "" {
-				aControlURL.Host = fmt.Sprintf("%s:554", aControlURL.Host)
+				aControlURL.Host = fmt.Sprintf("%s:%s", aControlURL.Host, defaultPort(aControlURL.Scheme))
 			}
 			aPath = aControlURL.String()
 		} else {
@@ -584,7 +730,43 @@ func (session *Session) handleRequest(req *Request) {
 		mtcp := regexp.MustCompile("interleaved=(\\d+)(-(\\d+))?")
 		mudp := regexp.MustCompile("client_port=(\\d+)(-(\\d+))?")
 
-		if tcpMatchs := mtcp.FindStringSubmatch(ts); tcpMatchs != nil {
+		if strings.Contains(strings.ToLower(ts), "multicast") {
+			if session.Type != SESSION_TYPE_PLAYER || isTLS(session.Conn) {
+				res.StatusCode = 461
+				res.Status = "Unsupported Transport"
+				return
+			}
+			typ := RTP_TYPE_VIDEO
+			if setupPath == aPath || aPath != "" && strings.LastIndex(setupPath, aPath) == len(setupPath)-len(aPath) {
+				typ = RTP_TYPE_AUDIO
+			} else if !(setupPath == vPath || vPath != "" && strings.LastIndex(setupPath, vPath) == len(setupPath)-len(vPath)) {
+				res.StatusCode = 500
+				res.Status = fmt.Sprintf("SETUP [MULTICAST] got UnKown control:%s", setupPath)
+				return
+			}
+			if session.TransType != TRANS_TYPE_MULTICAST {
+				session.StopHandles = append(session.StopHandles, func() {
+					session.Pusher.LeaveMulticast(session.Player)
+				})
+			}
+			session.TransType = TRANS_TYPE_MULTICAST
+			session.Conn.timeout = 0
+			multicast, err := session.Pusher.JoinMulticast(session.Player)
+			if err != nil {
+				res.StatusCode = 503
+				res.Status = "Service Unavailable"
+				logger.Printf("join multicast failed, %v", err)
+				return
+			}
+			port, err := multicast.Setup(typ)
+			if err != nil {
+				res.StatusCode = 500
+				res.Status = fmt.Sprintf("multicast setup error, %v", err)
+				return
+			}
+			ts = multicast.Transport(port)
+			logger.Printf("Parse SETUP req.TRANSPORT:MULTICAST.Session.Type:%d,control:%s, transport:%s", session.Type, setupPath, ts)
+		} else if tcpMatchs := mtcp.FindStringSubmatch(ts); tcpMatchs != nil {
 			session.TransType = TRANS_TYPE_TCP
 			if setupPath == aPath || aPath != "" && strings.LastIndex(setupPath, aPath) == len(setupPath)-len(aPath) {
 				session.aRTPChannel, _ = strconv.Atoi(tcpMatchs[1])
@@ -598,7 +780,12 @@ func (session *Session) handleRequest(req *Request) {
 				logger.Printf("SETUP [TCP] got UnKown control:%s", setupPath)
 			}
 			logger.Printf("Parse SETUP req.TRANSPORT:TCP.Session.Type:%d,control:%s, AControl:%s,VControl:%s", session.Type, setupPath, aPath, vPath)
-		} else if udpMatchs := mudp.FindStringSubmatch(ts); udpMatchs != nil {
+		} else if udpMatchs := mudp.FindStringSubmatch(ts); udpMatchs != nil && isTLS(session.Conn) {
+			// udp would carry the media of an rtsps session in clear text
+			res.StatusCode = 461
+			res.Status = "Unsupported Transport"
+			return
+		} else if udpMatchs != nil {
 			session.TransType = TRANS_TYPE_UDP
 			// no need for tcp timeout.
 			session.Conn.timeout = 0
@@ -622,6 +809,8 @@ func (session *Session) handleRequest(req *Request) {
 						res.Status = fmt.Sprintf("udp client setup audio error, %v", err)
 						return
 					}
+					// players send receiver reports there
+					ts = withServerPort(ts, udpMatchs[0], localPort(session.UDPClient.AConn), localPort(session.UDPClient.AControlConn))
 				}
 				if session.Type == SESSION_TYPE_PUSHER {
 					if err := session.Pusher.UDPServer.SetupAudio(); err != nil {
@@ -629,17 +818,8 @@ func (session *Session) handleRequest(req *Request) {
 						res.Status = fmt.Sprintf("udp server setup audio error, %v", err)
 						return
 					}
-					tss := strings.Split(ts, ";")
-					idx := -1
-					for i, val := range tss {
-						if val == udpMatchs[0] {
-							idx = i
-						}
-					}
-					tail := append([]string{}, tss[idx+1:]...)
-					tss = append(tss[:idx+1], fmt.Sprintf("server_port=%d-%d", session.Pusher.UDPServer.APort, session.Pusher.UDPServer.AControlPort))
-					tss = append(tss, tail...)
-					ts = strings.Join(tss, ";")
+					session.Pusher.UDPServer.SetControlRemote(RTP_TYPE_AUDIOCONTROL, session.controlRemote(udpMatchs))
+					ts = withServerPort(ts, udpMatchs[0], session.Pusher.UDPServer.APort, session.Pusher.UDPServer.AControlPort)
 				}
 			} else if setupPath == vPath || vPath != "" && strings.LastIndex(setupPath, vPath) == len(setupPath)-len(vPath) {
 				if session.Type == SESSION_TYPE_PLAYER {
@@ -650,6 +830,8 @@ func (session *Session) handleRequest(req *Request) {
 						res.Status = fmt.Sprintf("udp client setup video error, %v", err)
 						return
 					}
+					// players send receiver reports there
+					ts = withServerPort(ts, udpMatchs[0], localPort(session.UDPClient.VConn), localPort(session.UDPClient.VControlConn))
 				}
 
 				if session.Type == SESSION_TYPE_PUSHER {
@@ -658,17 +840,8 @@ func (session *Session) handleRequest(req *Request) {
 						res.Status = fmt.Sprintf("udp server setup video error, %v", err)
 						return
 					}
-					tss := strings.Split(ts, ";")
-					idx := -1
-					for i, val := range tss {
-						if val == udpMatchs[0] {
-							idx = i
-						}
-					}
-					tail := append([]string{}, tss[idx+1:]...)
-					tss = append(tss[:idx+1], fmt.Sprintf("server_port=%d-%d", session.Pusher.UDPServer.VPort, session.Pusher.UDPServer.VControlPort))
-					tss = append(tss, tail...)
-					ts = strings.Join(tss, ";")
+					session.Pusher.UDPServer.SetControlRemote(RTP_TYPE_VIDEOCONTROL, session.controlRemote(udpMatchs))
+					ts = withServerPort(ts, udpMatchs[0], session.Pusher.UDPServer.VPort, session.Pusher.UDPServer.VControlPort)
 				}
 			} else {
 				logger.Printf("SETUP [UDP] got UnKown control:%s", setupPath)
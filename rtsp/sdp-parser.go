@@ -15,6 +15,9 @@ type SDPInfo struct {
 	Rtpmap             int
 	Config             []byte
 	SpropParameterSets [][]byte
+	SpropVPS           []byte
+	SpropSPS           []byte
+	SpropPPS           []byte
 	PayloadType        int
 	SizeLength         int
 	IndexLength        int
@@ -72,7 +75,7 @@ func ParseSDP(sdpRaw string) map[string]*SDPInfo {
 							}
 						}
 						keyval = strings.Split(field, ";")
-						if len(keyval) > 1 {
+						if len(keyval) > 1 || strings.Contains(field, "=") {
 							for _, field := range keyval {
 								keyval := strings.SplitN(field, "=", 2)
 								if len(keyval) == 2 {
@@ -91,6 +94,12 @@ func ParseSDP(sdpRaw string) map[string]*SDPInfo {
 											val, _ := base64.StdEncoding.DecodeString(field)
 											info.SpropParameterSets = append(info.SpropParameterSets, val)
 										}
+									case "sprop-vps":
+										info.SpropVPS, _ = base64.StdEncoding.DecodeString(val)
+									case "sprop-sps":
+										info.SpropSPS, _ = base64.StdEncoding.DecodeString(val)
+									case "sprop-pps":
+										info.SpropPPS, _ = base64.StdEncoding.DecodeString(val)
 									}
 								}
 							}
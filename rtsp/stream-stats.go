@@ -0,0 +1,72 @@
+package rtsp
+
+import (
+	"time"
+)
+
+// TrackStats link quality of one track of a pusher or a player. Pushers
+// report what the server receives from the source, players what their
+// receiver reports tell about the packets the server sent.
+type TrackStats struct {
+	PacketsLost  int64      `json:"packetsLost"`
+	FractionLost float64    `json:"fractionLost"` // 0-1, since the previous report
+	Jitter       float64    `json:"jitter"`       // milliseconds
+	RTT          float64    `json:"rtt"`          // milliseconds, 0 while unknown
+	Bitrate      int64      `json:"bitrate"`      // bits per second
+	Framerate    float64    `json:"framerate"`
+	LastSR       *time.Time `json:"lastSR,omitempty"` // ntp time of the last sender report
+
+	Reorder *ReorderStats `json:"reorder,omitempty"` // udp sources only
+}
+
+// rateMeter counts octets and frames of a track, sampled every RTCP_INTERVAL
+type rateMeter struct {
+	octets     uint64
+	frames     uint64
+	lastTS     uint32
+	started    bool
+	prevOctets uint64
+	prevFrames uint64
+	sampleAt   time.Time
+	bitrate    int64
+	framerate  float64
+}
+
+// add counts a packet, packets with a new timestamp start a frame
+func (m *rateMeter) add(octets int, ts uint32) {
+	m.octets += uint64(octets)
+	if !m.started || ts != m.lastTS {
+		m.frames++
+	}
+	m.started, m.lastTS = true, ts
+}
+
+func (m *rateMeter) sample(now time.Time) {
+	if !m.sampleAt.IsZero() {
+		if elapsed := now.Sub(m.sampleAt).Seconds(); elapsed > 0 {
+			m.bitrate = int64(float64(m.octets-m.prevOctets) * 8 / elapsed)
+			m.framerate = float64(m.frames-m.prevFrames) / elapsed
+		}
+	}
+	m.prevOctets, m.prevFrames, m.sampleAt = m.octets, m.frames, now
+}
+
+// rates gets the last sampled rates, zero once the track stalled
+func (m *rateMeter) rates(now time.Time) (bitrate int64, framerate float64) {
+	if m.sampleAt.IsZero() || now.Sub(m.sampleAt) > 2*RTCP_INTERVAL {
+		return
+	}
+	return m.bitrate, m.framerate
+}
+
+// ntpToTime converts a 64 bit ntp timestamp to time
+func ntpToTime(ntp uint64) time.Time {
+	secs := int64(ntp>>32) - ntpEpochOffset
+	nanos := int64((ntp & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(secs, nanos)
+}
+
+// ntpMiddle gets the middle 32 bits of an ntp timestamp, as LSR in reports
+func ntpMiddle(ntp uint64) uint32 {
+	return uint32(ntp >> 16)
+}
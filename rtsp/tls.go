@@ -0,0 +1,96 @@
+package rtsp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/tectiv3/edrtsp/utils"
+)
+
+// default ports of rtsp:// and rtsps:// urls
+const (
+	RTSP_PORT  = "554"
+	RTSPS_PORT = "322"
+)
+
+// defaultPort gets the port of urls with scheme that don't have one
+func defaultPort(scheme string) string {
+	if strings.ToLower(scheme) == "rtsps" {
+		return RTSPS_PORT
+	}
+	return RTSP_PORT
+}
+
+// isAbsoluteURL tells a control attribute with a full rtsp or rtsps url
+// from one relative to the presentation
+func isAbsoluteURL(control string) bool {
+	control = strings.ToLower(control)
+	return strings.HasPrefix(control, "rtsp://") || strings.HasPrefix(control, "rtsps://")
+}
+
+// isTLS tells whether conn, possibly wrapped by a session, is encrypted
+func isTLS(conn net.Conn) bool {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		return true
+	case *RichConn:
+		return isTLS(c.Conn)
+	case *peekedConn:
+		return isTLS(c.Conn)
+	case *tunnelConn:
+		return isTLS(c.get)
+	}
+	return false
+}
+
+// listenTLS opens the rtsps listener with the config of its connections
+func (server *Server) listenTLS() (listener *net.TCPListener, config *tls.Config, err error) {
+	if config, err = serverTLSConfig(); err != nil {
+		return
+	}
+	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", server.TLSPort))
+	if err != nil {
+		return
+	}
+	listener, err = net.ListenTCP("tcp", addr)
+	return
+}
+
+// serverTLSConfig loads the certificate of the rtsps listener, clients must
+// present a certificate signed by tls_client_ca_file when it is set
+func serverTLSConfig() (config *tls.Config, err error) {
+	certFile, keyFile := key("tls_cert_file").String(), key("tls_key_file").String()
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("tls_cert_file and tls_key_file required for rtsps")
+	}
+	cert, err := tls.LoadX509KeyPair(utils.DataDir(certFile), utils.DataDir(keyFile))
+	if err != nil {
+		return
+	}
+	config = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caFile := key("tls_client_ca_file").String(); caFile != "" {
+		pem, err := ioutil.ReadFile(utils.DataDir(caFile))
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return
+}
+
+// clientTLSConfig gets the tls config of rtsps pulls and relays to host
+func clientTLSConfig(host string) *tls.Config {
+	return &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: key("tls_skip_verify").MustInt(0) != 0,
+	}
+}
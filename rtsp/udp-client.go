@@ -1,9 +1,12 @@
 package rtsp
 
 import (
+	"bytes"
 	"fmt"
 	"net"
+	"os"
 	"strings"
+	"syscall"
 )
 
 type UDPClient struct {
@@ -62,7 +65,7 @@ func (c *UDPClient) SetupAudio() (err error) {
 	if err != nil {
 		return
 	}
-	networkBuffer := 1048576 //Key("network_buffer").MustInt(1048576)
+	networkBuffer := key("network_buffer").MustInt(1048576)
 	if err := c.AConn.SetReadBuffer(networkBuffer); err != nil {
 		logger.Printf("udp client audio conn set read buffer error, %v", err)
 	}
@@ -84,6 +87,7 @@ func (c *UDPClient) SetupAudio() (err error) {
 	if err := c.AControlConn.SetWriteBuffer(networkBuffer); err != nil {
 		logger.Printf("udp client audio control conn set write buffer error, %v", err)
 	}
+	go c.readControl(c.AControlConn, RTP_TYPE_AUDIOCONTROL)
 	return
 }
 
@@ -105,7 +109,7 @@ func (c *UDPClient) SetupVideo() (err error) {
 	if err != nil {
 		return
 	}
-	networkBuffer := 1048576 //Key("network_buffer").MustInt(1048576)
+	networkBuffer := key("network_buffer").MustInt(1048576)
 	if err := c.VConn.SetReadBuffer(networkBuffer); err != nil {
 		logger.Printf("udp client video conn set read buffer error, %v", err)
 	}
@@ -127,9 +131,53 @@ func (c *UDPClient) SetupVideo() (err error) {
 	if err := c.VControlConn.SetWriteBuffer(networkBuffer); err != nil {
 		logger.Printf("udp client video control conn set write buffer error, %v", err)
 	}
+	go c.readControl(c.VControlConn, RTP_TYPE_VIDEOCONTROL)
 	return
 }
 
+// readControl passes receiver reports the player sends back to its session
+func (c *UDPClient) readControl(conn *net.UDPConn, typ RTPType) {
+	bufUDP := make([]byte, UDP_BUF_SIZE)
+	for !c.Stoped {
+		n, err := conn.Read(bufUDP)
+		if err != nil {
+			if c.Stoped {
+				return
+			}
+			if refused(err) {
+				// nothing listens on the port of the player yet
+				continue
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			c.logger.Printf("udp client read %v pack error %v", typ, err)
+			return
+		}
+		rtcpBytes := make([]byte, n)
+		copy(rtcpBytes, bufUDP)
+		c.Session.InBytes += n
+		pack := &RTPPack{
+			Type:   typ,
+			Buffer: bytes.NewBuffer(rtcpBytes),
+		}
+		for _, h := range c.Session.RTPHandles {
+			h(pack)
+		}
+	}
+}
+
+// refused reports the icmp port unreachable answering an earlier send of a
+// connected udp socket
+func refused(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	return ok && sysErr.Err == syscall.ECONNREFUSED
+}
+
 func (c *UDPClient) SendRTP(pack *RTPPack) (err error) {
 	if pack == nil {
 		err = fmt.Errorf("udp client send rtp got nil pack")
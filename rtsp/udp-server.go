@@ -7,6 +7,8 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,6 +25,15 @@ type UDPServer struct {
 	VControlPort int
 	VControlConn *net.UDPConn
 
+	// rtcp addresses of the source, receiver reports are sent there
+	AControlRemote *net.UDPAddr
+	VControlRemote *net.UDPAddr
+	remoteLock     sync.Mutex
+
+	// put media back in order, nil when udp_reorder_latency is 0
+	aReorder *reorderBuffer
+	vReorder *reorderBuffer
+
 	Stoped bool
 }
 
@@ -32,7 +43,7 @@ func (s *UDPServer) AddInputBytes(bytes int) {
 		return
 	}
 	if s.RTSPClient != nil {
-		s.RTSPClient.InBytes += bytes
+		atomic.AddInt64(&s.RTSPClient.InBytes, int64(bytes))
 		return
 	}
 	panic(fmt.Errorf("session and RTSPClient both nil"))
@@ -65,11 +76,81 @@ func (s *UDPServer) Logger() *log.Logger {
 	panic(fmt.Errorf("session and RTSPClient both nil"))
 }
 
+// SetControlRemote keeps the rtcp address of the source for track typ
+func (s *UDPServer) SetControlRemote(typ RTPType, addr *net.UDPAddr) {
+	s.remoteLock.Lock()
+	defer s.remoteLock.Unlock()
+	switch typ {
+	case RTP_TYPE_AUDIOCONTROL:
+		s.AControlRemote = addr
+	case RTP_TYPE_VIDEOCONTROL:
+		s.VControlRemote = addr
+	}
+}
+
+// updateControlRemote follows the rtcp port of the source from what it sends,
+// NATs may map it anew, but keeps the host from SETUP so that nobody else
+// can redirect reports
+func (s *UDPServer) updateControlRemote(typ RTPType, addr *net.UDPAddr) {
+	s.remoteLock.Lock()
+	defer s.remoteLock.Unlock()
+	remote := &s.AControlRemote
+	if typ == RTP_TYPE_VIDEOCONTROL {
+		remote = &s.VControlRemote
+	}
+	if *remote != nil && (*remote).IP.Equal(addr.IP) {
+		*remote = addr
+	}
+}
+
+// SendRTCP sends a control pack back to the source, dropped while its
+// address is unknown
+func (s *UDPServer) SendRTCP(pack *RTPPack) (err error) {
+	s.remoteLock.Lock()
+	conn, addr := s.AControlConn, s.AControlRemote
+	if pack.Type == RTP_TYPE_VIDEOCONTROL {
+		conn, addr = s.VControlConn, s.VControlRemote
+	}
+	s.remoteLock.Unlock()
+	if conn == nil || addr == nil {
+		return
+	}
+	_, err = conn.WriteToUDP(pack.Buffer.Bytes(), addr)
+	return
+}
+
+// newReorder gets a reorder buffer handing packets to HandleRTP, nil if disabled
+func (s *UDPServer) newReorder() *reorderBuffer {
+	latency := time.Duration(key("udp_reorder_latency").MustInt(50)) * time.Millisecond
+	if latency <= 0 {
+		return nil
+	}
+	return newReorderBuffer(latency, s.HandleRTP)
+}
+
+// ReorderStats gets counters of the reorder buffer of media typ
+func (s *UDPServer) ReorderStats(typ RTPType) (stats ReorderStats, ok bool) {
+	b := s.vReorder
+	if typ == RTP_TYPE_AUDIO {
+		b = s.aReorder
+	}
+	if b == nil {
+		return
+	}
+	return b.Stats(), true
+}
+
 func (s *UDPServer) Stop() {
 	if s.Stoped {
 		return
 	}
 	s.Stoped = true
+	if s.aReorder != nil {
+		s.aReorder.stop()
+	}
+	if s.vReorder != nil {
+		s.vReorder.stop()
+	}
 	if s.AConn != nil {
 		s.AConn.Close()
 		s.AConn = nil
@@ -89,188 +170,137 @@ func (s *UDPServer) Stop() {
 }
 
 func (s *UDPServer) SetupAudio() (err error) {
-	logger := s.Logger()
-	addr, err := net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
-		return
-	}
-	s.AConn, err = net.ListenUDP("udp", addr)
-	if err != nil {
-		return
-	}
-	networkBuffer := 1048576 //Key("network_buffer").MustInt(1048576)
-	if err := s.AConn.SetReadBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server audio conn set read buffer error, %v", err)
-	}
-	if err := s.AConn.SetWriteBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server audio conn set write buffer error, %v", err)
+	return s.setup(RTP_TYPE_AUDIO, &net.UDPAddr{}, &net.UDPAddr{})
+}
+
+func (s *UDPServer) SetupVideo() (err error) {
+	return s.setup(RTP_TYPE_VIDEO, &net.UDPAddr{}, &net.UDPAddr{})
+}
+
+// SetupMulticast joins group to receive track typ, rtp on port and rtcp on controlPort
+func (s *UDPServer) SetupMulticast(typ RTPType, group net.IP, port, controlPort int) (err error) {
+	return s.setup(typ, &net.UDPAddr{IP: group, Port: port}, &net.UDPAddr{IP: group, Port: controlPort})
+}
+
+// setup listens on addr for media of typ and on controlAddr for its rtcp
+func (s *UDPServer) setup(typ RTPType, addr, controlAddr *net.UDPAddr) (err error) {
+	controlType := RTP_TYPE_VIDEOCONTROL
+	if typ == RTP_TYPE_AUDIO {
+		controlType = RTP_TYPE_AUDIOCONTROL
 	}
-	la := s.AConn.LocalAddr().String()
-	strPort := la[strings.LastIndex(la, ":")+1:]
-	s.APort, err = strconv.Atoi(strPort)
+	conn, port, err := s.listen(typ, addr)
 	if err != nil {
 		return
 	}
-	go func() {
-		bufUDP := make([]byte, UDP_BUF_SIZE)
-		logger.Printf("udp server start listen audio port[%d]", s.APort)
-		defer logger.Printf("udp server stop listen audio port[%d]", s.APort)
-		timer := time.Unix(0, 0)
-		for !s.Stoped {
-			if n, _, err := s.AConn.ReadFromUDP(bufUDP); err == nil {
-				elapsed := time.Now().Sub(timer)
-				if elapsed >= 30*time.Second {
-					logger.Printf("Package recv from AConn.len:%d\n", n)
-					timer = time.Now()
-				}
-				rtpBytes := make([]byte, n)
-				s.AddInputBytes(n)
-				copy(rtpBytes, bufUDP)
-				pack := &RTPPack{
-					Type:   RTP_TYPE_AUDIO,
-					Buffer: bytes.NewBuffer(rtpBytes),
-				}
-				s.HandleRTP(pack)
-			} else {
-				logger.Println("udp server read audio pack error", err)
-				continue
-			}
+	var reorder *reorderBuffer
+	if typ == RTP_TYPE_AUDIO {
+		s.AConn, s.APort = conn, port
+		if s.aReorder == nil {
+			s.aReorder = s.newReorder()
 		}
-	}()
-	addr, err = net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
-		return
+		reorder = s.aReorder
+	} else {
+		s.VConn, s.VPort = conn, port
+		if s.vReorder == nil {
+			s.vReorder = s.newReorder()
+		}
+		reorder = s.vReorder
 	}
-	s.AControlConn, err = net.ListenUDP("udp", addr)
+	go s.readMedia(conn, typ, port, reorder)
+	controlConn, controlPort, err := s.listen(controlType, controlAddr)
 	if err != nil {
 		return
 	}
-	if err := s.AControlConn.SetReadBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server audio control conn set read buffer error, %v", err)
-	}
-	if err := s.AControlConn.SetWriteBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server audio control conn set write buffer error, %v", err)
+	if typ == RTP_TYPE_AUDIO {
+		s.AControlConn, s.AControlPort = controlConn, controlPort
+	} else {
+		s.VControlConn, s.VControlPort = controlConn, controlPort
 	}
-	la = s.AControlConn.LocalAddr().String()
-	strPort = la[strings.LastIndex(la, ":")+1:]
-	s.AControlPort, err = strconv.Atoi(strPort)
-	if err != nil {
-		return
-	}
-	go func() {
-		bufUDP := make([]byte, UDP_BUF_SIZE)
-		logger.Printf("udp server start listen audio control port[%d]", s.AControlPort)
-		defer logger.Printf("udp server stop listen audio control port[%d]", s.AControlPort)
-		for !s.Stoped {
-			if n, _, err := s.AControlConn.ReadFromUDP(bufUDP); err == nil {
-				//logger.Printf("Package recv from AControlConn.len:%d\n", n)
-				rtpBytes := make([]byte, n)
-				s.AddInputBytes(n)
-				copy(rtpBytes, bufUDP)
-				pack := &RTPPack{
-					Type:   RTP_TYPE_AUDIOCONTROL,
-					Buffer: bytes.NewBuffer(rtpBytes),
-				}
-				s.HandleRTP(pack)
-			} else {
-				logger.Println("udp server read audio control pack error", err)
-				continue
-			}
-		}
-	}()
+	go s.readControl(controlConn, controlType, controlPort)
 	return
 }
 
-func (s *UDPServer) SetupVideo() (err error) {
+// listen opens a udp port for typ, any free one when addr has none, joining
+// the group when addr is a multicast address
+func (s *UDPServer) listen(typ RTPType, addr *net.UDPAddr) (conn *net.UDPConn, port int, err error) {
 	logger := s.Logger()
-	addr, err := net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
-		return
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", nil, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
 	}
-	s.VConn, err = net.ListenUDP("udp", addr)
 	if err != nil {
 		return
 	}
-	networkBuffer := 1048576 //Key("network_buffer").MustInt(1048576)
-	if err := s.VConn.SetReadBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server video conn set read buffer error, %v", err)
+	networkBuffer := key("network_buffer").MustInt(1048576)
+	if err := conn.SetReadBuffer(networkBuffer); err != nil {
+		logger.Printf("udp server %v conn set read buffer error, %v", typ, err)
 	}
-	if err := s.VConn.SetWriteBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server video conn set write buffer error, %v", err)
+	if err := conn.SetWriteBuffer(networkBuffer); err != nil {
+		logger.Printf("udp server %v conn set write buffer error, %v", typ, err)
 	}
-	la := s.VConn.LocalAddr().String()
-	strPort := la[strings.LastIndex(la, ":")+1:]
-	s.VPort, err = strconv.Atoi(strPort)
+	la := conn.LocalAddr().String()
+	port, err = strconv.Atoi(la[strings.LastIndex(la, ":")+1:])
 	if err != nil {
-		return
+		conn.Close()
 	}
-	go func() {
-		bufUDP := make([]byte, UDP_BUF_SIZE)
-		logger.Printf("udp server start listen video port[%d]", s.VPort)
-		defer logger.Printf("udp server stop listen video port[%d]", s.VPort)
-		timer := time.Unix(0, 0)
-		for !s.Stoped {
-			if n, _, err := s.VConn.ReadFromUDP(bufUDP); err == nil {
-				elapsed := time.Now().Sub(timer)
-				if elapsed >= 30*time.Second {
-					logger.Printf("Package recv from VConn.len:%d\n", n)
-					timer = time.Now()
-				}
-				rtpBytes := make([]byte, n)
-				s.AddInputBytes(n)
-				copy(rtpBytes, bufUDP)
-				pack := &RTPPack{
-					Type:   RTP_TYPE_VIDEO,
-					Buffer: bytes.NewBuffer(rtpBytes),
-				}
-				s.HandleRTP(pack)
+	return
+}
+
+// readMedia hands rtp read from conn to the reorder buffer, or to HandleRTP
+// when reorder is nil
+func (s *UDPServer) readMedia(conn *net.UDPConn, typ RTPType, port int, reorder *reorderBuffer) {
+	logger := s.Logger()
+	bufUDP := make([]byte, UDP_BUF_SIZE)
+	logger.Printf("udp server start listen %v port[%d]", typ, port)
+	defer logger.Printf("udp server stop listen %v port[%d]", typ, port)
+	timer := time.Unix(0, 0)
+	for !s.Stoped {
+		if n, _, err := conn.ReadFromUDP(bufUDP); err == nil {
+			elapsed := time.Now().Sub(timer)
+			if elapsed >= 30*time.Second {
+				logger.Printf("Package recv from %v conn.len:%d\n", typ, n)
+				timer = time.Now()
+			}
+			rtpBytes := make([]byte, n)
+			s.AddInputBytes(n)
+			copy(rtpBytes, bufUDP)
+			pack := &RTPPack{
+				Type:   typ,
+				Buffer: bytes.NewBuffer(rtpBytes),
+			}
+			if reorder != nil {
+				reorder.push(pack)
 			} else {
-				logger.Println("udp server read video pack error", err)
-				continue
+				s.HandleRTP(pack)
 			}
+		} else {
+			logger.Printf("udp server read %v pack error %v", typ, err)
+			continue
 		}
-	}()
-
-	addr, err = net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
-		return
-	}
-	s.VControlConn, err = net.ListenUDP("udp", addr)
-	if err != nil {
-		return
-	}
-	if err := s.VControlConn.SetReadBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server video control conn set read buffer error, %v", err)
-	}
-	if err := s.VControlConn.SetWriteBuffer(networkBuffer); err != nil {
-		logger.Printf("udp server video control conn set write buffer error, %v", err)
 	}
-	la = s.VControlConn.LocalAddr().String()
-	strPort = la[strings.LastIndex(la, ":")+1:]
-	s.VControlPort, err = strconv.Atoi(strPort)
-	if err != nil {
-		return
-	}
-	go func() {
-		bufUDP := make([]byte, UDP_BUF_SIZE)
-		logger.Printf("udp server start listen video control port[%d]", s.VControlPort)
-		defer logger.Printf("udp server stop listen video control port[%d]", s.VControlPort)
-		for !s.Stoped {
-			if n, _, err := s.VControlConn.ReadFromUDP(bufUDP); err == nil {
-				//logger.Printf("Package recv from VControlConn.len:%d\n", n)
-				rtpBytes := make([]byte, n)
-				s.AddInputBytes(n)
-				copy(rtpBytes, bufUDP)
-				pack := &RTPPack{
-					Type:   RTP_TYPE_VIDEOCONTROL,
-					Buffer: bytes.NewBuffer(rtpBytes),
-				}
-				s.HandleRTP(pack)
-			} else {
-				logger.Println("udp server read video control pack error", err)
-				continue
+}
+
+// readControl hands rtcp read from conn to HandleRTP, keeping where it came from
+func (s *UDPServer) readControl(conn *net.UDPConn, typ RTPType, port int) {
+	logger := s.Logger()
+	bufUDP := make([]byte, UDP_BUF_SIZE)
+	logger.Printf("udp server start listen %v port[%d]", typ, port)
+	defer logger.Printf("udp server stop listen %v port[%d]", typ, port)
+	for !s.Stoped {
+		if n, remote, err := conn.ReadFromUDP(bufUDP); err == nil {
+			s.updateControlRemote(typ, remote)
+			rtpBytes := make([]byte, n)
+			s.AddInputBytes(n)
+			copy(rtpBytes, bufUDP)
+			pack := &RTPPack{
+				Type:   typ,
+				Buffer: bytes.NewBuffer(rtpBytes),
 			}
+			s.HandleRTP(pack)
+		} else {
+			logger.Printf("udp server read %v pack error %v", typ, err)
+			continue
 		}
-	}()
-	return
+	}
 }
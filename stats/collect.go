@@ -135,6 +135,7 @@ func GetPushers() []interface{} {
 			"outBytes":  pusher.OutBytes(),
 			"startAt":   pusher.StartAt(),
 			"online":    len(pusher.GetPlayers()),
+			"stats":     pusher.Stats(),
 		})
 	}
 	return pushers
@@ -175,6 +176,7 @@ func GetPlayers() []interface{} {
 			"inBytes":   player.InBytes,
 			"outBytes":  player.OutBytes,
 			"startAt":   player.StartAt,
+			"stats":     player.Stats(),
 		})
 	}
 	return _players
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//Stream pull source kept across restarts
+type Stream struct {
+	URL               string `json:"url"`
+	CustomPath        string `json:"customPath"`
+	TransType         string `json:"transType"`
+	IdleTimeout       int    `json:"idleTimeout"`
+	HeartbeatInterval int    `json:"heartbeatInterval"`
+	OnDemand          bool   `json:"onDemand"` // pulled only while played
+	// BackupURLs are pulled in order when URL fails
+	BackupURLs []string `json:"backupURLs,omitempty"`
+}
+
+//URLs returns URL followed by the backups
+func (s Stream) URLs() []string {
+	return append([]string{s.URL}, s.BackupURLs...)
+}
+
+//Path returns path the stream is published on
+func (s Stream) Path() string {
+	if s.CustomPath != "" {
+		return s.CustomPath
+	}
+	if l, err := url.Parse(s.URL); err == nil {
+		return l.Path
+	}
+	return ""
+}
+
+var (
+	streams     = make([]Stream, 0)
+	streamsFile string
+	streamsLock sync.RWMutex
+)
+
+//Open loads streams from json file, a missing file is an empty store
+func Open(path string) (err error) {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	streamsFile = path
+	streams = make([]Stream, 0)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &streams); err != nil {
+		err = fmt.Errorf("parse streams file %s failed, %v", path, err)
+	}
+	return
+}
+
+//Streams returns a copy of stored streams
+func Streams() []Stream {
+	streamsLock.RLock()
+	defer streamsLock.RUnlock()
+	return append([]Stream{}, streams...)
+}
+
+//GetStream finds stream by url
+func GetStream(url string) (stream Stream, ok bool) {
+	streamsLock.RLock()
+	defer streamsLock.RUnlock()
+	for _, v := range streams {
+		if v.URL == url {
+			return v, true
+		}
+	}
+	return
+}
+
+//SaveStream inserts stream or updates the one with the same url
+func SaveStream(stream Stream) error {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	for i, v := range streams {
+		if v.URL == stream.URL {
+			streams[i] = stream
+			return flush()
+		}
+	}
+	streams = append(streams, stream)
+	return flush()
+}
+
+//DeleteStream removes stream by url
+func DeleteStream(url string) error {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	for i, v := range streams {
+		if v.URL == url {
+			streams = append(streams[:i], streams[i+1:]...)
+			return flush()
+		}
+	}
+	return nil
+}
+
+// flush writes streams to a temp file and renames it over the store, caller holds the lock
+func flush() (err error) {
+	if streamsFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(streams, "", "  ")
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(streamsFile), 0755); err != nil {
+		return
+	}
+	tmp := streamsFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp, streamsFile)
+}
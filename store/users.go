@@ -0,0 +1,129 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//User rtsp digest credential, one "username:realm:ha1" line in htdigest format
+type User struct {
+	Username string `json:"username"`
+	Realm    string `json:"realm"`
+	HA1      string `json:"-"`
+}
+
+var (
+	users     = make([]User, 0)
+	usersFile string
+	usersLock sync.RWMutex
+)
+
+//UserStore looks up users loaded by OpenUsers
+type UserStore struct {
+}
+
+//HA1 returns md5(username:realm:password) of user
+func (UserStore) HA1(username, realm string) (string, bool) {
+	usersLock.RLock()
+	defer usersLock.RUnlock()
+	for _, v := range users {
+		if v.Username == username && v.Realm == realm {
+			return v.HA1, true
+		}
+	}
+	return "", false
+}
+
+//OpenUsers loads htdigest users file, a missing file has no users
+func OpenUsers(path string) (err error) {
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	usersFile = path
+	users = make([]User, 0)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			err = fmt.Errorf("parse users file %s failed, line %d", path, n)
+			return
+		}
+		users = append(users, User{Username: fields[0], Realm: fields[1], HA1: fields[2]})
+	}
+	return
+}
+
+//Users returns a copy of stored users
+func Users() []User {
+	usersLock.RLock()
+	defer usersLock.RUnlock()
+	return append([]User{}, users...)
+}
+
+//SaveUser adds user or changes its password
+func SaveUser(username, realm, password string) error {
+	if strings.Contains(username, ":") || strings.Contains(realm, ":") {
+		return fmt.Errorf("username and realm must not contain ':'")
+	}
+	ha1 := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", username, realm, password))))
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	for i, v := range users {
+		if v.Username == username && v.Realm == realm {
+			users[i].HA1 = ha1
+			return flushUsers()
+		}
+	}
+	users = append(users, User{Username: username, Realm: realm, HA1: ha1})
+	return flushUsers()
+}
+
+//DeleteUser removes user, reports whether it existed
+func DeleteUser(username, realm string) (bool, error) {
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	for i, v := range users {
+		if v.Username == username && v.Realm == realm {
+			users = append(users[:i], users[i+1:]...)
+			return true, flushUsers()
+		}
+	}
+	return false, nil
+}
+
+// flushUsers rewrites users file, caller holds the lock
+func flushUsers() (err error) {
+	if usersFile == "" {
+		return
+	}
+	buf := bytes.Buffer{}
+	for _, v := range users {
+		buf.WriteString(fmt.Sprintf("%s:%s:%s\n", v.Username, v.Realm, v.HA1))
+	}
+	if err = os.MkdirAll(filepath.Dir(usersFile), 0755); err != nil {
+		return
+	}
+	tmp := usersFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return
+	}
+	return os.Rename(tmp, usersFile)
+}
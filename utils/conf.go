@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-ini/ini"
+)
+
+//EnvPrefix prefix of environment variables overriding config keys,
+// e.g. EDRTSP_RTSP_NETWORK_BUFFER overrides [rtsp] network_buffer
+const EnvPrefix = "EDRTSP_"
+
+var (
+	conf     *ini.File
+	confPath string
+	confLock sync.RWMutex
+)
+
+//ConfFile returns path of the loaded config file
+func ConfFile() string {
+	confLock.RLock()
+	defer confLock.RUnlock()
+	return confPath
+}
+
+//Conf returns loaded config, an empty one if LoadConf was never called
+func Conf() *ini.File {
+	confLock.RLock()
+	if conf != nil {
+		defer confLock.RUnlock()
+		return conf
+	}
+	confLock.RUnlock()
+	confLock.Lock()
+	defer confLock.Unlock()
+	if conf == nil {
+		conf = ini.Empty()
+	}
+	return conf
+}
+
+//LoadConf loads ini file from path, or the default one which may be missing,
+//then applies environment variables and "section.key=value" overrides in that order
+func LoadConf(path string, overrides []string) (err error) {
+	file := ini.Empty()
+	explicit := path != ""
+	if !explicit {
+		path = DefaultConfFile()
+	}
+	if _, statErr := os.Stat(path); statErr == nil || explicit {
+		if file, err = ini.Load(path); err != nil {
+			return
+		}
+		log.Printf("config file loaded --> %s", path)
+	} else {
+		log.Printf("config file not found --> %s, using defaults", path)
+	}
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, EnvPrefix) {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(env, EnvPrefix), "=", 2)
+		sk := strings.SplitN(strings.ToLower(kv[0]), "_", 2)
+		if len(kv) != 2 || len(sk) != 2 {
+			continue
+		}
+		file.Section(sk[0]).Key(sk[1]).SetValue(kv[1])
+	}
+	for _, o := range overrides {
+		kv := strings.SplitN(o, "=", 2)
+		sk := strings.SplitN(kv[0], ".", 2)
+		if len(kv) != 2 || len(sk) != 2 {
+			err = fmt.Errorf("invalid config override %q, expect section.key=value", o)
+			return
+		}
+		file.Section(sk[0]).Key(sk[1]).SetValue(kv[1])
+	}
+	confLock.Lock()
+	conf = file
+	confPath = path
+	confLock.Unlock()
+	return
+}
+
+//DefaultConfFile returns edrtsp.ini next to the executable
+func DefaultConfFile() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return "edrtsp.ini"
+	}
+	return filepath.Join(filepath.Dir(exe), "edrtsp.ini")
+}
+
+//DataDir resolves path of files written at runtime, relative paths are
+//taken from the config file's directory
+func DataDir(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(ConfFile()), path)
+}